@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig 启用时 HTTPS 证书由 ACME（Let's Encrypt 等）自动申请和续期，不再使用 certFile/keyFile。
+// 验证方式是 HTTP-01，由 HTTP 监听（listen.http）应答，所以它必须能从公网的 80 端口访问到。
+type ACMEConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Domains []string `yaml:"domains"`
+	Email   string   `yaml:"email"`
+	// CacheDir 保存账号密钥和证书
+	CacheDir string `yaml:"cacheDir"`
+	// DirectoryURL 为空时使用 Let's Encrypt 正式环境
+	DirectoryURL string `yaml:"directoryURL"`
+	// CACert 用来校验 DirectoryURL 的 HTTPS 证书，测试时指向 Pebble 的根证书
+	CACert string `yaml:"caCert"`
+	// RenewBefore 证书剩余有效期少于这个时间时续期，0 为 autocert 的默认值（30 天）
+	RenewBefore time.Duration `yaml:"renewBefore"`
+}
+
+func (c *ACMEConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Domains) == 0 {
+		return errors.New("acme.domains is required")
+	}
+	if len(c.CacheDir) == 0 {
+		return errors.New("acme.cacheDir is required")
+	}
+	if len(c.CACert) > 0 {
+		if _, err := os.Stat(c.CACert); err != nil {
+			return fmt.Errorf("acme.caCert: %w", err)
+		}
+	}
+	return nil
+}
+
+// newACMEManager 按配置创建 autocert.Manager，cache 为 nil 时使用 CacheDir 目录
+func newACMEManager(c *ACMEConfig, cache autocert.Cache) (*autocert.Manager, error) {
+	if cache == nil {
+		cache = autocert.DirCache(c.CacheDir)
+	}
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+	if len(client.DirectoryURL) == 0 {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if len(c.CACert) > 0 {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", c.CACert)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       cache,
+		HostPolicy:  autocert.HostWhitelist(c.Domains...),
+		Email:       c.Email,
+		Client:      client,
+		RenewBefore: c.RenewBefore,
+	}, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const acmeTestDomain = "blinder.example.com"
+
+// acmeStub 是只实现 autocert 用到的那部分 RFC 8555 的 ACME 服务端：
+// 只提供 http-01 验证，验证时直接调用 validator（autocert 的 HTTPHandler），不会真的访问域名
+type acmeStub struct {
+	t         *testing.T
+	server    *httptest.Server
+	validator http.Handler
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu         sync.Mutex
+	nonce      int
+	thumbprint string
+	contact    []string
+	orders     int
+	authzValid bool
+	certPEM    []byte
+}
+
+func newACMEStub(t *testing.T) *acmeStub {
+	s := &acmeStub{t: t}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acme stub CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.caKey = key
+	s.caCert, _ = x509.ParseCertificate(der)
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// writeServerCert 把 httptest 服务端的证书写成 PEM，作为 acme.caCert
+func (s *acmeStub) writeServerCert(dir string) string {
+	file := filepath.Join(dir, "acme-ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		s.t.Fatal(err)
+	}
+	return file
+}
+
+func (s *acmeStub) url(path string) string {
+	return s.server.URL + path
+}
+
+// jws 是 flattened JSON 格式的请求，签名不校验
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+}
+
+type jwsHeader struct {
+	URL string `json:"url"`
+	JWK *struct {
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"jwk"`
+}
+
+func (s *acmeStub) reply(w http.ResponseWriter, status int, location string, v interface{}) {
+	s.mu.Lock()
+	s.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", s.nonce))
+	s.mu.Unlock()
+	if len(location) > 0 {
+		w.Header().Set("Location", location)
+	}
+	if data, ok := v.([]byte); ok {
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.WriteHeader(status)
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeStub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/directory" {
+		s.reply(w, http.StatusOK, "", map[string]string{
+			"newNonce":   s.url("/nonce"),
+			"newAccount": s.url("/account"),
+			"newOrder":   s.url("/order"),
+			"revokeCert": s.url("/revoke"),
+			"keyChange":  s.url("/key-change"),
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		s.reply(w, http.StatusOK, "", struct{}{})
+		return
+	}
+
+	var req jws
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var header jwsHeader
+	protected, _ := base64.RawURLEncoding.DecodeString(req.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(req.Payload)
+	if err := json.Unmarshal(protected, &header); err != nil || header.URL != s.url(r.URL.Path) {
+		http.Error(w, "bad protected header", http.StatusBadRequest)
+		return
+	}
+
+	status, location, body := s.handle(r.URL.Path, &header, payload)
+	if body == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.reply(w, status, location, body)
+}
+
+// handle 处理一个已经解开的 JWS 请求，返回状态码、Location 和应答，body 为 nil 时是 404
+func (s *acmeStub) handle(path string, header *jwsHeader, payload []byte) (int, string, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": acmeTestDomain}},
+		"authorizations": []string{s.url("/authz")},
+		"finalize":       s.url("/finalize"),
+	}
+	if s.authzValid {
+		order["status"] = "ready"
+	}
+	if s.certPEM != nil {
+		order["status"] = "valid"
+		order["certificate"] = s.url("/cert")
+	}
+
+	switch path {
+	case "/account":
+		var account struct {
+			Contact []string `json:"contact"`
+		}
+		json.Unmarshal(payload, &account)
+		s.contact = account.Contact
+		// RFC 7638 的 JWK thumbprint，用来算 http-01 的 key authorization
+		if header.JWK != nil {
+			sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, header.JWK.Crv, header.JWK.X, header.JWK.Y)))
+			s.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+		}
+		return http.StatusCreated, s.url("/account/1"), map[string]interface{}{"status": "valid", "contact": account.Contact}
+	case "/order":
+		s.orders++
+		return http.StatusCreated, s.url("/order/1"), order
+	case "/order/1":
+		return http.StatusOK, s.url("/order/1"), order
+	case "/authz":
+		status := "pending"
+		if s.authzValid {
+			status = "valid"
+		}
+		return http.StatusOK, "", map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": acmeTestDomain},
+			"challenges": []map[string]string{{"type": "http-01", "url": s.url("/challenge"), "token": "token-1", "status": status}},
+		}
+	case "/challenge":
+		// 像 CA 一样去取 /.well-known/acme-challenge/<token>，内容必须是 key authorization
+		rec := httptest.NewRecorder()
+		s.validator.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+acmeTestDomain+"/.well-known/acme-challenge/token-1", nil))
+		body, _ := io.ReadAll(rec.Body)
+		s.authzValid = rec.Code == http.StatusOK && string(body) == "token-1."+s.thumbprint
+		status := "invalid"
+		if s.authzValid {
+			status = "valid"
+		}
+		return http.StatusOK, "", map[string]string{"type": "http-01", "url": s.url("/challenge"), "token": "token-1", "status": status}
+	case "/finalize":
+		var finalize struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &finalize)
+		csrDER, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		certPEM, err := s.issue(csrDER)
+		if err != nil {
+			return http.StatusBadRequest, "", map[string]string{"type": "urn:ietf:params:acme:error:badCSR", "detail": err.Error()}
+		}
+		s.certPEM = certPEM
+		order["status"] = "valid"
+		order["certificate"] = s.url("/cert")
+		return http.StatusOK, s.url("/order/1"), order
+	case "/cert":
+		return http.StatusOK, "", s.certPEM
+	}
+	return 0, "", nil
+}
+
+// issue 用 CA 的密钥签发 CSR 里的域名，返回证书链
+func (s *acmeStub) issue(csrDER []byte) ([]byte, error) {
+	if !s.authzValid {
+		return nil, fmt.Errorf("order is not authorized")
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+	if len(csr.DNSNames) != 1 || csr.DNSNames[0] != acmeTestDomain {
+		return nil, fmt.Errorf("unexpected names %v", csr.DNSNames)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: acmeTestDomain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...), nil
+}
+
+func acmeTestHello(serverName string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:       serverName,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	}
+}
+
+func TestACMEManagerIssuesCertificate(t *testing.T) {
+	stub := newACMEStub(t)
+	dir := t.TempDir()
+	c := &ACMEConfig{
+		Enabled:      true,
+		Domains:      []string{acmeTestDomain},
+		Email:        "admin@example.com",
+		CacheDir:     filepath.Join(dir, "cache"),
+		DirectoryURL: stub.url("/directory"),
+		CACert:       stub.writeServerCert(dir),
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	manager, err := newACMEManager(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.validator = manager.HTTPHandler(nil)
+
+	cert, err := manager.GetCertificate(acmeTestHello(acmeTestDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || cert.Leaf.Issuer.CommonName != "acme stub CA" || cert.Leaf.VerifyHostname(acmeTestDomain) != nil {
+		t.Fatalf("unexpected certificate %+v", cert.Leaf)
+	}
+	if fmt.Sprint(stub.contact) != "[mailto:admin@example.com]" {
+		t.Fatalf("account contact %v", stub.contact)
+	}
+	// 证书写进了 cacheDir，重启后不用重新申请
+	files, _ := os.ReadDir(c.CacheDir)
+	cached := false
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), acmeTestDomain) {
+			cached = true
+		}
+	}
+	if !cached {
+		t.Fatalf("no certificate for %s in %s", acmeTestDomain, c.CacheDir)
+	}
+
+	// 不在 domains 里的域名不会去申请
+	if _, err := manager.GetCertificate(acmeTestHello("other.example.com")); err == nil {
+		t.Fatal("certificate issued for a domain not in acme.domains")
+	}
+	if stub.orders != 1 {
+		t.Fatalf("%d orders, want 1", stub.orders)
+	}
+}
+
+func TestACMEManagerCACert(t *testing.T) {
+	stub := newACMEStub(t)
+	dir := t.TempDir()
+
+	// 没有 caCert 时不信任测试 CA 的 HTTPS 证书
+	c := &ACMEConfig{Enabled: true, Domains: []string{acmeTestDomain}, CacheDir: dir, DirectoryURL: stub.url("/directory")}
+	manager, err := newACMEManager(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.validator = manager.HTTPHandler(nil)
+	if _, err := manager.GetCertificate(acmeTestHello(acmeTestDomain)); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("directory with an unknown CA: %v", err)
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0600)
+	c.CACert = empty
+	if _, err := newACMEManager(c, nil); err == nil {
+		t.Fatal("caCert without a certificate is accepted")
+	}
+	c.CACert = filepath.Join(dir, "missing.pem")
+	if err := c.Validate(); err == nil {
+		t.Fatal("missing caCert is accepted")
+	}
+}
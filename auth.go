@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"yanglei_blinder/logger"
+)
+
+// 用户角色，写在 token 的 role 字段里
+const (
+	roleBlind     = "blind"
+	roleVolunteer = "volunteer"
+	roleAdmin     = "admin"
+)
+
+// AuthConfig 启用后 /ws 和 /api 需要带上用 Secret 签名的 JWT（HS256）。
+// token 由业务后台签发，字段：sub 用户 ID，role 角色，exp 过期时间，room 可选，限定只能操作这个房间
+type AuthConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Secret  string `yaml:"secret"`
+	// SecretFile 不为空时从文件读取 Secret，只在 Enabled 时读取
+	SecretFile string `yaml:"secretFile"`
+	// AllowedOrigins 是允许建立 /ws 连接的页面 Origin，为空时只允许同源，"*" 允许所有
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+}
+
+func (c *AuthConfig) Validate() error {
+	// 不启用鉴权时不需要密钥，也不要求密钥文件存在
+	if c.Enabled && len(c.SecretFile) > 0 {
+		b, err := os.ReadFile(c.SecretFile)
+		if err != nil {
+			return fmt.Errorf("auth.secretFile: %w", err)
+		}
+		c.Secret = strings.TrimSpace(string(b))
+	}
+	if c.Enabled && len(c.Secret) < 16 {
+		return errors.New("auth.secret must be at least 16 bytes")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return fmt.Errorf("auth.allowedOrigins: %q is not an origin like https://example.com", origin)
+		}
+	}
+	return nil
+}
+
+// authClaims 是 token 里的字段
+type authClaims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role"`
+	Room      string `json:"room,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+}
+
+// HasRole 管理员拥有所有角色
+func (c *authClaims) HasRole(roles ...string) bool {
+	if c.Role == roleAdmin {
+		return true
+	}
+	for _, role := range roles {
+		if c.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessRoom token 没有限定房间或者限定的就是这个房间
+func (c *authClaims) CanAccessRoom(roomName string) bool {
+	return len(c.Room) == 0 || c.Room == roomName
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+// parseToken 校验 HS256 签名和有效期，返回 token 里的字段
+func parseToken(token string, secret string, now time.Time) (*authClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" {
+		return nil, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	claims := &authClaims{}
+	if err := json.Unmarshal(claimsJSON, claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if len(claims.Subject) == 0 || claims.ExpiresAt == 0 {
+		return nil, errInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore > 0 && now.Unix() < claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+	switch claims.Role {
+	case roleBlind, roleVolunteer, roleAdmin:
+	default:
+		return nil, fmt.Errorf("unknown role %q", claims.Role)
+	}
+	return claims, nil
+}
+
+// requestToken 取出 HTTP 请求里的 token：Authorization: Bearer 或者 ?token=（浏览器的 WebSocket 不能带 header）
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticateRequest 未启用鉴权时返回 nil, nil
+func authenticateRequest(r *http.Request) (*authClaims, error) {
+	if !config.Auth.Enabled {
+		return nil, nil
+	}
+	token := requestToken(r)
+	if len(token) == 0 {
+		return nil, errors.New("token is required")
+	}
+	return parseToken(token, config.Auth.Secret, time.Now())
+}
+
+// checkOrigin 用于 websocket.Upgrader.CheckOrigin
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		// 非浏览器客户端
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if len(config.Auth.AllowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range config.Auth.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	logger.Warnf("reject websocket from origin %s", origin)
+	return false
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// signTestToken 用 secret 签一个 JWT，alg 写在 header 里，签名总是 HS256
+func signTestToken(secret string, alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// testClaims 返回一小时后过期的 claims，extra 覆盖或者删除（值为 nil）其中的字段
+func testClaims(sub string, role string, extra map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{"sub": sub, "role": role, "exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func TestParseToken(t *testing.T) {
+	now := time.Now()
+	valid := signTestToken(testSecret, "HS256", testClaims("v1", roleVolunteer, map[string]interface{}{"room": "room1"}))
+	parts := strings.Split(valid, ".")
+	unsigned := parts[0] + "." + parts[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", valid, ""},
+		{"bad signature", signTestToken("another secret 0123456789", "HS256", testClaims("v1", roleVolunteer, nil)), "invalid token"},
+		{"tampered claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"v1","role":"admin","exp":9999999999}`)) + "." + parts[2], "invalid token"},
+		{"alg none", signTestToken(testSecret, "none", testClaims("v1", roleVolunteer, nil)), "invalid token"},
+		{"alg none unsigned", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", "invalid token"},
+		{"alg HS512", signTestToken(testSecret, "HS512", testClaims("v1", roleVolunteer, nil)), "invalid token"},
+		{"alg RS256", signTestToken(testSecret, "RS256", testClaims("v1", roleVolunteer, nil)), "invalid token"},
+		{"empty signature", unsigned, "invalid token"},
+		{"two parts", parts[0] + "." + parts[1], "invalid token"},
+		{"not base64", "!!!." + parts[1] + "." + parts[2], "invalid token"},
+		{"expired", signTestToken(testSecret, "HS256", testClaims("v1", roleVolunteer, map[string]interface{}{"exp": now.Add(-time.Second).Unix()})), "token expired"},
+		{"expires now", signTestToken(testSecret, "HS256", testClaims("v1", roleVolunteer, map[string]interface{}{"exp": now.Unix()})), "token expired"},
+		{"no exp", signTestToken(testSecret, "HS256", testClaims("v1", roleVolunteer, map[string]interface{}{"exp": nil})), "invalid token"},
+		{"nbf in the future", signTestToken(testSecret, "HS256", testClaims("v1", roleVolunteer, map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), "token not valid yet"},
+		{"nbf in the past", signTestToken(testSecret, "HS256", testClaims("v1", roleVolunteer, map[string]interface{}{"nbf": now.Add(-time.Minute).Unix()})), ""},
+		{"no sub", signTestToken(testSecret, "HS256", testClaims("", roleVolunteer, nil)), "invalid token"},
+		{"unknown role", signTestToken(testSecret, "HS256", testClaims("v1", "root", nil)), `unknown role "root"`},
+		{"no role", signTestToken(testSecret, "HS256", testClaims("v1", "", nil)), `unknown role ""`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := parseToken(test.token, testSecret, now)
+			switch {
+			case len(test.err) == 0 && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case len(test.err) > 0 && (err == nil || err.Error() != test.err):
+				t.Fatalf("error %v, want %s", err, test.err)
+			case err == nil && claims.Subject != "v1":
+				t.Fatalf("claims %+v", claims)
+			}
+		})
+	}
+
+	claims, _ := parseToken(valid, testSecret, now)
+	if !claims.HasRole(roleVolunteer) || claims.HasRole(roleBlind) || !claims.CanAccessRoom("room1") || claims.CanAccessRoom("room2") {
+		t.Fatalf("volunteer token for room1: %+v", claims)
+	}
+	admin := &authClaims{Subject: "a", Role: roleAdmin}
+	if !admin.HasRole(roleBlind) || !admin.CanAccessRoom("room2") {
+		t.Fatal("admin without room has every role and room")
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		header string
+		want   string
+	}{
+		{"none", "", "", ""},
+		{"query", "token=q", "", "q"},
+		{"bearer", "", "Bearer h", "h"},
+		// header 优先于 query
+		{"bearer and query", "token=q", "Bearer h", "h"},
+		{"basic falls back to query", "token=q", "Basic dTpw", "q"},
+		{"lower case bearer", "", "bearer h", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws?"+test.query, nil)
+			if len(test.header) > 0 {
+				r.Header.Set("Authorization", test.header)
+			}
+			if got := requestToken(r); got != test.want {
+				t.Fatalf("token %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"no origin", nil, "", true},
+		{"same origin", nil, "https://blinder.example.com", true},
+		{"same origin other case", nil, "https://Blinder.Example.com", true},
+		{"cross origin", nil, "https://evil.example.com", false},
+		{"bad origin", nil, "://", false},
+		{"allowed", []string{"https://app.example.com"}, "https://app.example.com", true},
+		{"allowed list replaces same origin", []string{"https://app.example.com"}, "https://blinder.example.com", false},
+		{"not allowed", []string{"https://app.example.com"}, "https://evil.example.com", false},
+		{"other scheme", []string{"https://app.example.com"}, "http://app.example.com", false},
+		{"wildcard", []string{"*"}, "https://evil.example.com", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Auth.AllowedOrigins = test.allowed
+			r := httptest.NewRequest(http.MethodGet, "https://blinder.example.com/ws", nil)
+			if len(test.origin) > 0 {
+				r.Header.Set("Origin", test.origin)
+			}
+			if got := checkOrigin(r); got != test.want {
+				t.Fatalf("checkOrigin %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthValidate(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	os.WriteFile(secretFile, []byte(testSecret+"\n"), 0600)
+	shortFile := filepath.Join(dir, "short")
+	os.WriteFile(shortFile, []byte("short"), 0600)
+
+	tests := []struct {
+		name   string
+		config AuthConfig
+		err    string
+	}{
+		{"disabled", AuthConfig{}, ""},
+		// 不启用时不读密钥文件
+		{"disabled with missing secret file", AuthConfig{SecretFile: filepath.Join(dir, "missing")}, ""},
+		{"secret", AuthConfig{Enabled: true, Secret: testSecret}, ""},
+		{"short secret", AuthConfig{Enabled: true, Secret: "short"}, "at least 16 bytes"},
+		{"secret file", AuthConfig{Enabled: true, SecretFile: secretFile}, ""},
+		{"secret file overrides secret", AuthConfig{Enabled: true, Secret: "ignored-but-long-enough", SecretFile: secretFile}, ""},
+		{"short secret file", AuthConfig{Enabled: true, SecretFile: shortFile}, "at least 16 bytes"},
+		{"missing secret file", AuthConfig{Enabled: true, SecretFile: filepath.Join(dir, "missing")}, "auth.secretFile"},
+		{"origin", AuthConfig{AllowedOrigins: []string{"https://app.example.com", "*"}}, ""},
+		{"bad origin", AuthConfig{AllowedOrigins: []string{"app.example.com"}}, "auth.allowedOrigins"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.Validate()
+			switch {
+			case len(test.err) == 0 && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Fatalf("error %v, want %s", err, test.err)
+			case len(test.config.SecretFile) > 0 && test.config.Enabled && err == nil && test.config.Secret != testSecret:
+				t.Fatalf("secret %q read from file, want it trimmed", test.config.Secret)
+			}
+		})
+	}
+}
+
+func TestAuthorizeWebSocket(t *testing.T) {
+	setupTest(t)
+	config.Auth.Enabled = true
+	config.Auth.Secret = testSecret
+	server := startSignaling(t)
+	if _, err := Rooms.Create("room1", "blind", "", "zh"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rooms.Create("room2", "blind2", "", "zh"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Rooms.Shutdown(ctx)
+	}()
+	token := func(sub string, role string, extra map[string]interface{}) string {
+		return signTestToken(testSecret, "HS256", testClaims(sub, role, extra))
+	}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	// 升级之前就拒绝：没有 token、token 无效、跨域
+	for name, dial := range map[string]struct {
+		query  string
+		header http.Header
+		status int
+	}{
+		"no token":     {"", nil, http.StatusUnauthorized},
+		"bad token":    {"token=x.y.z", nil, http.StatusUnauthorized},
+		"expired":      {"token=" + token("v1", roleVolunteer, map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}), nil, http.StatusUnauthorized},
+		"cross origin": {"token=" + token("v1", roleVolunteer, nil), http.Header{"Origin": {"https://evil.example.com"}}, http.StatusForbidden},
+	} {
+		_, resp, err := websocket.DefaultDialer.Dial(url+"?"+dial.query, dial.header)
+		if err == nil || resp == nil || resp.StatusCode != dial.status {
+			t.Fatalf("%s: dial %v, want status %d", name, err, dial.status)
+		}
+	}
+	config.Auth.AllowedOrigins = []string{"https://app.example.com"}
+	dialSignaling(t, server, "token="+token("v1", roleVolunteer, nil), http.Header{"Origin": {"https://app.example.com"}})
+	config.Auth.AllowedOrigins = nil
+
+	// 盲人的 token 不能 join 或者 control
+	blind := dialSignaling(t, server, "", http.Header{"Authorization": {"Bearer " + token("blind", roleBlind, nil)}})
+	blind.send(cmdJoin, map[string]interface{}{"roomName": "room1", "userId": "blind", "sdp": "x"})
+	blind.expectError(cmdJoin, errCodeForbidden)
+	blind.send(cmdControl, map[string]interface{}{"roomName": "room1", "userId": "blind", "cmdDetail": "ting"})
+	blind.expectError(cmdControl, errCodeForbidden)
+	blind.send(cmdAvailable, map[string]interface{}{"userId": "blind"})
+	blind.expectError(cmdAvailable, errCodeForbidden)
+
+	// 限定 room1 的 token 不能进入 room2，也不能操作 room2
+	scoped := dialSignaling(t, server, "token="+token("v1", roleVolunteer, map[string]interface{}{"room": "room1"}), nil)
+	scoped.send(cmdJoin, map[string]interface{}{"roomName": "room2", "userId": "v1", "sdp": "x"})
+	scoped.expectError(cmdJoin, errCodeForbidden)
+	scoped.send(cmdControl, map[string]interface{}{"roomName": "room2", "userId": "v1", "cmdDetail": "ting"})
+	scoped.expectError(cmdControl, errCodeForbidden)
+
+	// userId 以 token 为准，客户端填的被覆盖
+	scoped.send(cmdJoin, map[string]interface{}{"roomName": "room1", "userId": "spoofed", "sdp": testOffer(t)})
+	scoped.expect("answer")
+	room1, _ := Rooms.Get("room1")
+	if room1.SubscriberRole("v1") != subRoleGuide || len(room1.SubscriberRole("spoofed")) > 0 {
+		t.Fatal("join used the userId from the message instead of the token")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"yanglei_blinder/logger"
+)
+
+// certManager 为 TLS 监听提供证书，证书文件更新或收到 SIGHUP 时重新加载，已有连接不受影响。
+type certManager struct {
+	certFile      string
+	keyFile       string
+	expiryWarning time.Duration
+
+	cert atomic.Pointer[tls.Certificate]
+
+	mu       sync.Mutex
+	certMod  time.Time
+	keyMod   time.Time
+	lastWarn time.Time
+}
+
+func newCertManager(certFile, keyFile string, expiryWarning time.Duration) (*certManager, error) {
+	m := &certManager{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		expiryWarning: expiryWarning,
+	}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetCertificate 用于 tls.Config.GetCertificate
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.cert.Load(), nil
+}
+
+// Reload 重新读取证书和私钥，读取失败时继续使用原来的证书
+func (m *certManager) Reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	certMod, keyMod, err := m.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	m.cert.Store(&cert)
+	m.certMod, m.keyMod = certMod, keyMod
+	m.lastWarn = time.Time{}
+	logger.Infof("load certificate %s, subject %s, expire at %v", m.certFile, cert.Leaf.Subject, cert.Leaf.NotAfter)
+	m.checkExpiryLocked()
+	return nil
+}
+
+func (m *certManager) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(m.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(m.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// changed 证书或私钥文件的修改时间和上次加载时不同
+func (m *certManager) changed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	certMod, keyMod, err := m.modTimes()
+	if err != nil {
+		// 文件正在被替换，下次再检查
+		return false
+	}
+	return !certMod.Equal(m.certMod) || !keyMod.Equal(m.keyMod)
+}
+
+// checkExpiryLocked 证书快要过期时每天警告一次
+func (m *certManager) checkExpiryLocked() {
+	leaf := m.cert.Load().Leaf
+	left := time.Until(leaf.NotAfter)
+	if left > m.expiryWarning || time.Since(m.lastWarn) < 24*time.Hour {
+		return
+	}
+	m.lastWarn = time.Now()
+	if left <= 0 {
+		logger.Errorf("certificate %s expired at %v", m.certFile, leaf.NotAfter)
+		return
+	}
+	logger.Warnf("certificate %s will expire in %v (at %v)", m.certFile, left.Round(time.Hour), leaf.NotAfter)
+}
+
+// Watch 每隔 interval 检查一次证书文件，收到 SIGHUP 时立即重新加载，ctx 结束时返回
+func (m *certManager) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Infof("SIGHUP, reload certificate %s", m.certFile)
+			if err := m.Reload(); err != nil {
+				logger.Errorf("reload certificate %s: %v", m.certFile, err)
+			}
+		case <-ticker.C:
+			if m.changed() {
+				if err := m.Reload(); err != nil {
+					logger.Errorf("reload certificate %s: %v", m.certFile, err)
+				}
+				continue
+			}
+			m.mu.Lock()
+			m.checkExpiryLocked()
+			m.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config 是服务的全部配置。
+// 优先级从低到高：默认值、配置文件（-config，YAML，JSON 也可以）、环境变量 BLINDER_*、命令行参数。
+type Config struct {
+	Listen    ListenConfig    `yaml:"listen"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Auth      AuthConfig      `yaml:"auth"`
+	ICE       ICEConfig       `yaml:"ice"`
+	Room      RoomConfig      `yaml:"room"`
+	Dispatch  DispatchConfig  `yaml:"dispatch"`
+	Mixer     MixerConfig     `yaml:"mixer"`
+	Web       WebConfig       `yaml:"web"`
+	Recording RecordingConfig `yaml:"recording"`
+	Snapshot  SnapshotConfig  `yaml:"snapshot"`
+	Prompts   PromptsConfig   `yaml:"prompts"`
+	TTS       TTSConfig       `yaml:"tts"`
+	Log       LogConfig       `yaml:"log"`
+}
+
+type ListenConfig struct {
+	HTTP string `yaml:"http"`
+	// HTTPS 为空时不启动 HTTPS 服务
+	HTTPS string `yaml:"https"`
+	// ShutdownTimeout 收到 SIGTERM 后等待房间结束录制、连接关闭的最长时间
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// MinVersion 取值 1.0、1.1、1.2、1.3
+	MinVersion string `yaml:"minVersion"`
+	// ReloadInterval 检查证书文件是否更新的间隔，收到 SIGHUP 时也会重新加载
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+	// ExpiryWarning 证书剩余有效期少于这个时间时开始警告
+	ExpiryWarning time.Duration `yaml:"expiryWarning"`
+	ACME          ACMEConfig    `yaml:"acme"`
+}
+
+type RoomConfig struct {
+	// ReconnectGrace 盲人断线后房间保留的时间
+	ReconnectGrace time.Duration `yaml:"reconnectGrace"`
+}
+
+type WebConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+type RecordingConfig struct {
+	Path string `yaml:"path"`
+}
+
+type SnapshotConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+}
+
+type PromptsConfig struct {
+	Dir string `yaml:"dir"`
+	// Manifest 是提示音清单，为空时是 dir 下的 prompts.yaml
+	Manifest string `yaml:"manifest"`
+	// DefaultLanguage 是没有写语言的提示音的语言，盲人的语言没有对应的提示音时也用它
+	DefaultLanguage string `yaml:"defaultLanguage"`
+}
+
+// ManifestPath 返回提示音清单的路径
+func (c *PromptsConfig) ManifestPath() string {
+	if len(c.Manifest) == 0 {
+		return filepath.Join(c.Dir, "prompts.yaml")
+	}
+	return c.Manifest
+}
+
+type LogConfig struct {
+	// File 为空时输出到终端
+	File string `yaml:"file"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen: ListenConfig{
+			HTTP:            ":9000",
+			HTTPS:           ":9443",
+			ShutdownTimeout: 10 * time.Second,
+		},
+		TLS: TLSConfig{
+			CertFile:       "./blinder.aiiyou.cn/aliyun/blinder.aiiyou.cn.pem",
+			KeyFile:        "./blinder.aiiyou.cn/aliyun/blinder.aiiyou.cn.key",
+			MinVersion:     "1.2",
+			ReloadInterval: time.Minute,
+			ExpiryWarning:  30 * 24 * time.Hour,
+			ACME:           ACMEConfig{CacheDir: "./acme-cache"},
+		},
+		ICE:  *defaultICEConfig(),
+		Room: RoomConfig{ReconnectGrace: 30 * time.Second},
+		Dispatch: DispatchConfig{
+			RingBatch:      3,
+			RingTimeout:    15 * time.Second,
+			RequestTimeout: 90 * time.Second,
+			EscalatePrompt: "deng_dai",
+			TimeoutPrompt:  "wu_ren_jie_ting",
+		},
+		Mixer: MixerConfig{
+			VolunteerGain: 1,
+			PromptGain:    1,
+			PromptMode:    promptModeDuck,
+			DuckGain:      0.25,
+			DuckAttack:    50 * time.Millisecond,
+			DuckRelease:   300 * time.Millisecond,
+		},
+		Web:       WebConfig{Dir: "./web"},
+		Recording: RecordingConfig{Path: "./record"},
+		Snapshot:  SnapshotConfig{Enabled: true, Path: "./record"},
+		Prompts:   PromptsConfig{Dir: "./audio", DefaultLanguage: "zh"},
+		TTS:       TTSConfig{CacheDir: "./tts-cache", MaxCacheMB: 200, MaxText: 100, Timeout: 10 * time.Second},
+	}
+}
+
+var config = defaultConfig()
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// configSetting 是可以用环境变量和命令行参数覆盖的一项配置
+type configSetting struct {
+	name  string
+	usage string
+	value interface{}
+}
+
+func (c *Config) settings() []configSetting {
+	return []configSetting{
+		{"http", "HTTP 监听地址", &c.Listen.HTTP},
+		{"https", "HTTPS 监听地址，为空时不启动", &c.Listen.HTTPS},
+		{"shutdown-timeout", "收到 SIGTERM 后优雅关闭的最长时间", &c.Listen.ShutdownTimeout},
+		{"tls-cert", "证书文件", &c.TLS.CertFile},
+		{"tls-key", "私钥文件", &c.TLS.KeyFile},
+		{"tls-min-version", "TLS 最低版本：1.0、1.1、1.2、1.3", &c.TLS.MinVersion},
+		{"tls-reload-interval", "检查证书文件是否更新的间隔", &c.TLS.ReloadInterval},
+		{"tls-expiry-warning", "证书剩余有效期少于这个时间时警告", &c.TLS.ExpiryWarning},
+		{"acme", "通过 ACME 自动申请 HTTPS 证书", &c.TLS.ACME.Enabled},
+		{"acme-domains", "ACME 申请证书的域名，逗号分隔", &c.TLS.ACME.Domains},
+		{"acme-email", "ACME 账号邮箱", &c.TLS.ACME.Email},
+		{"acme-cache-dir", "ACME 账号和证书的缓存目录", &c.TLS.ACME.CacheDir},
+		{"acme-directory-url", "ACME directory URL，为空时使用 Let's Encrypt", &c.TLS.ACME.DirectoryURL},
+		{"acme-ca-cert", "校验 ACME directory 的根证书", &c.TLS.ACME.CACert},
+		{"auth", "/ws 和 /api 需要 token", &c.Auth.Enabled},
+		{"auth-secret", "签名 token 的密钥，建议用环境变量或密钥文件", &c.Auth.Secret},
+		{"auth-secret-file", "签名 token 的密钥文件", &c.Auth.SecretFile},
+		{"allowed-origins", "允许建立 /ws 连接的 Origin，逗号分隔", &c.Auth.AllowedOrigins},
+		{"ice-udp-mux-port", "所有 PeerConnection 共用的 ICE UDP 端口，0 为随机端口", &c.ICE.UDPMuxPort},
+		{"ice-tcp-mux-port", "ICE-TCP 端口，0 为不启用", &c.ICE.TCPMuxPort},
+		{"ice-nat-ips", "本机公网 IP，逗号分隔", &c.ICE.NAT1To1IPs},
+		{"reconnect-grace", "盲人断线后房间保留的时间", &c.Room.ReconnectGrace},
+		{"dispatch-ring-batch", "每一轮同时呼叫的志愿者数，0 为所有空闲志愿者", &c.Dispatch.RingBatch},
+		{"dispatch-ring-timeout", "一轮呼叫无人接听后呼叫下一批的时间", &c.Dispatch.RingTimeout},
+		{"dispatch-request-timeout", "求助无人接听时放弃派单的时间", &c.Dispatch.RequestTimeout},
+		{"mixer-volunteer-gain", "志愿者声音的增益，1 为原音量", &c.Mixer.VolunteerGain},
+		{"mixer-prompt-gain", "提示音的增益，1 为原音量", &c.Mixer.PromptGain},
+		{"mixer-prompt-mode", "播放提示音时志愿者的声音：duck 压低，mute 丢弃", &c.Mixer.PromptMode},
+		{"mixer-duck-gain", "duck 模式下志愿者声音压低到的增益", &c.Mixer.DuckGain},
+		{"mixer-duck-attack", "压低志愿者声音所用的时间", &c.Mixer.DuckAttack},
+		{"mixer-duck-release", "提示音结束后恢复志愿者声音所用的时间", &c.Mixer.DuckRelease},
+		{"web-dir", "网页静态文件目录", &c.Web.Dir},
+		{"record-path", "录制文件目录", &c.Recording.Path},
+		{"snapshot", "是否保存盲人视频截图", &c.Snapshot.Enabled},
+		{"snapshot-path", "截图目录", &c.Snapshot.Path},
+		{"prompt-dir", "提示音目录", &c.Prompts.Dir},
+		{"prompt-manifest", "提示音清单，为空时是提示音目录下的 prompts.yaml", &c.Prompts.Manifest},
+		{"prompt-default-language", "提示音的默认语言", &c.Prompts.DefaultLanguage},
+		{"tts-engine", "文字转语音引擎：espeak-ng、piper，为空时不启用", &c.TTS.Engine},
+		{"tts-command", "文字转语音引擎的可执行文件，为空时就是引擎名", &c.TTS.Command},
+		{"tts-voice", "默认的声音，espeak-ng 是语音名（为空时是 cmn），piper 是模型文件（必填）", &c.TTS.Voice},
+		{"tts-voices", "control 里可以选择的其它声音，逗号分隔", &c.TTS.Voices},
+		{"tts-cache-dir", "合成好的语音的缓存目录", &c.TTS.CacheDir},
+		{"tts-max-cache-mb", "缓存目录最多占用的空间（MB），超过时删除最久没有用过的", &c.TTS.MaxCacheMB},
+		{"tts-max-text", "一次最多合成的字数", &c.TTS.MaxText},
+		{"tts-timeout", "合成一段文字的最长时间", &c.TTS.Timeout},
+		{"log-file", "日志文件，为空时输出到终端", &c.Log.File},
+	}
+}
+
+// envName 是配置项对应的环境变量，如 record-path 对应 BLINDER_RECORD_PATH
+func (s configSetting) envName() string {
+	return "BLINDER_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+func (s configSetting) set(str string) error {
+	switch v := s.value.(type) {
+	case *string:
+		*v = str
+	case *int:
+		i, err := strconv.Atoi(str)
+		if err != nil {
+			return err
+		}
+		*v = i
+	case *float64:
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return err
+		}
+		*v = f
+	case *bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		*v = b
+	case *time.Duration:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		*v = d
+	case *[]string:
+		*v = nil
+		for _, item := range strings.Split(str, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				*v = append(*v, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", s.value)
+	}
+	return nil
+}
+
+// loadConfig 解析命令行参数并合并配置文件和环境变量，返回是否只打印配置
+func loadConfig(args []string) (*Config, bool, error) {
+	c := defaultConfig()
+
+	flags := flag.NewFlagSet("yanglei_blinder", flag.ContinueOnError)
+	configFile := flags.String("config", "", "配置文件（YAML）")
+	iceConfigFile := flags.String("ice-config", "", "ICE 配置文件（JSON），覆盖配置文件里的 ice 部分")
+	printConfig := flags.Bool("print-config", false, "打印合并后的配置并退出")
+	// 命令行参数最后才应用，先记下来
+	flagValues := map[string]string{}
+	for _, setting := range c.settings() {
+		name := setting.name
+		usage := fmt.Sprintf("%s（环境变量 %s）", setting.usage, setting.envName())
+		record := func(s string) error {
+			flagValues[name] = s
+			return nil
+		}
+		if _, ok := setting.value.(*bool); ok {
+			flags.BoolFunc(name, usage, record)
+		} else {
+			flags.Func(name, usage, record)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	if len(*configFile) > 0 {
+		b, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := yaml.Unmarshal(b, c); err != nil {
+			return nil, false, fmt.Errorf("parse %s: %w", *configFile, err)
+		}
+	}
+	if len(*iceConfigFile) > 0 {
+		ice, err := loadICEConfig(*iceConfigFile)
+		if err != nil {
+			return nil, false, err
+		}
+		c.ICE = *ice
+	}
+
+	for _, setting := range c.settings() {
+		if s, ok := os.LookupEnv(setting.envName()); ok {
+			if err := setting.set(s); err != nil {
+				return nil, false, fmt.Errorf("%s: %w", setting.envName(), err)
+			}
+		}
+	}
+	for _, setting := range c.settings() {
+		if s, ok := flagValues[setting.name]; ok {
+			if err := setting.set(s); err != nil {
+				return nil, false, fmt.Errorf("-%s: %w", setting.name, err)
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, false, err
+	}
+	return c, *printConfig, nil
+}
+
+func validateListenAddr(name, addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func validateDir(name, dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: %s is not a directory", name, dir)
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if len(c.Listen.HTTP) == 0 {
+		return errors.New("listen.http is required")
+	}
+	if err := validateListenAddr("listen.http", c.Listen.HTTP); err != nil {
+		return err
+	}
+	if c.Listen.ShutdownTimeout <= 0 {
+		return errors.New("listen.shutdownTimeout must be positive")
+	}
+	if len(c.Listen.HTTPS) > 0 {
+		if err := validateListenAddr("listen.https", c.Listen.HTTPS); err != nil {
+			return err
+		}
+		if !c.TLS.ACME.Enabled {
+			if _, err := os.Stat(c.TLS.CertFile); err != nil {
+				return fmt.Errorf("tls.certFile: %w", err)
+			}
+			if _, err := os.Stat(c.TLS.KeyFile); err != nil {
+				return fmt.Errorf("tls.keyFile: %w", err)
+			}
+		}
+	}
+	if err := c.TLS.ACME.Validate(); err != nil {
+		return fmt.Errorf("tls.%w", err)
+	}
+	if _, ok := tlsVersions[c.TLS.MinVersion]; !ok {
+		return fmt.Errorf("tls.minVersion %q is invalid", c.TLS.MinVersion)
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		return errors.New("tls.reloadInterval must be positive")
+	}
+	if err := c.Auth.Validate(); err != nil {
+		return err
+	}
+	if err := c.ICE.Validate(); err != nil {
+		return fmt.Errorf("ice: %w", err)
+	}
+	if c.Room.ReconnectGrace <= 0 {
+		return errors.New("room.reconnectGrace must be positive")
+	}
+	if err := c.Dispatch.Validate(); err != nil {
+		return err
+	}
+	if err := c.Mixer.Validate(); err != nil {
+		return err
+	}
+	if err := c.TTS.Validate(); err != nil {
+		return err
+	}
+	if err := validateDir("web.dir", c.Web.Dir); err != nil {
+		return err
+	}
+	if err := validateDir("prompts.dir", c.Prompts.Dir); err != nil {
+		return err
+	}
+	if !promptIDPattern.MatchString(c.Prompts.DefaultLanguage) {
+		return fmt.Errorf("prompts.defaultLanguage %q is invalid", c.Prompts.DefaultLanguage)
+	}
+	if len(c.Recording.Path) == 0 {
+		return errors.New("recording.path is required")
+	}
+	if c.Snapshot.Enabled && len(c.Snapshot.Path) == 0 {
+		return errors.New("snapshot.path is required")
+	}
+	return nil
+}
+
+// TLSMinVersion 返回 tls.Config 使用的最低版本
+func (c *Config) TLSMinVersion() uint16 {
+	return tlsVersions[c.TLS.MinVersion]
+}
+
+const maskedSecret = "******"
+
+// Print 以 YAML 输出配置，密钥、密码和私钥文件的路径不输出
+func (c *Config) Print(w io.Writer) error {
+	masked := *c
+	if len(masked.TLS.KeyFile) > 0 {
+		masked.TLS.KeyFile = maskedSecret
+	}
+	masked.ICE.ICEServers = append([]ICEServerConfig{}, c.ICE.ICEServers...)
+	for i := range masked.ICE.ICEServers {
+		if len(masked.ICE.ICEServers[i].Credential) > 0 {
+			masked.ICE.ICEServers[i].Credential = maskedSecret
+		}
+		if len(masked.ICE.ICEServers[i].SharedSecret) > 0 {
+			masked.ICE.ICEServers[i].SharedSecret = maskedSecret
+		}
+	}
+	if len(masked.Auth.Secret) > 0 {
+		masked.Auth.Secret = maskedSecret
+	}
+	if c.ICE.TURNServer != nil {
+		turnServer := *c.ICE.TURNServer
+		turnServer.SharedSecret = maskedSecret
+		if len(turnServer.TLSKey) > 0 {
+			turnServer.TLSKey = maskedSecret
+		}
+		masked.ICE.TURNServer = &turnServer
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&masked); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
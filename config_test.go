@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile 写一个临时的配置文件，返回 -config 参数
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return "-config=" + file
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	configFile := writeConfigFile(t, `
+listen:
+  http: ":1000"
+room:
+  reconnectGrace: 10s
+auth:
+  allowedOrigins: [https://file.example.com]
+snapshot:
+  enabled: false
+`)
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(c *Config) interface{}
+		want  interface{}
+	}{
+		{"default", nil, nil, func(c *Config) interface{} { return c.Listen.HTTP }, ":9000"},
+		{"file over default", nil, []string{configFile}, func(c *Config) interface{} { return c.Listen.HTTP }, ":1000"},
+		{"env over file", map[string]string{"BLINDER_HTTP": ":2000"}, []string{configFile}, func(c *Config) interface{} { return c.Listen.HTTP }, ":2000"},
+		{"flag over env", map[string]string{"BLINDER_HTTP": ":2000"}, []string{configFile, "-http=:3000"}, func(c *Config) interface{} { return c.Listen.HTTP }, ":3000"},
+		{"duration", map[string]string{"BLINDER_RECONNECT_GRACE": "20s"}, []string{configFile}, func(c *Config) interface{} { return c.Room.ReconnectGrace }, 20 * time.Second},
+		{"duration flag", map[string]string{"BLINDER_RECONNECT_GRACE": "20s"}, []string{configFile, "-reconnect-grace=30s"}, func(c *Config) interface{} { return c.Room.ReconnectGrace }, 30 * time.Second},
+		{"list", map[string]string{"BLINDER_ALLOWED_ORIGINS": "https://a.example.com, https://b.example.com"}, []string{configFile}, func(c *Config) interface{} { return c.Auth.AllowedOrigins }, []string{"https://a.example.com", "https://b.example.com"}},
+		{"bool flag", nil, []string{configFile, "-snapshot"}, func(c *Config) interface{} { return c.Snapshot.Enabled }, true},
+		{"bool env", map[string]string{"BLINDER_SNAPSHOT": "true"}, []string{configFile, "-snapshot=false"}, func(c *Config) interface{} { return c.Snapshot.Enabled }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, _, err := loadConfig(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.check(c); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown flag", nil, []string{"-no-such-flag=1"}, "no-such-flag"},
+		{"missing file", nil, []string{"-config=" + filepath.Join(t.TempDir(), "missing.yaml")}, "missing.yaml"},
+		{"bad yaml", nil, []string{writeConfigFile(t, "room:\n  reconnectGrace: soon\n")}, "parse"},
+		{"bad env duration", map[string]string{"BLINDER_RECONNECT_GRACE": "soon"}, nil, "BLINDER_RECONNECT_GRACE"},
+		{"bad env bool", map[string]string{"BLINDER_AUTH": "maybe"}, nil, "BLINDER_AUTH"},
+		{"bad flag int", nil, []string{"-dispatch-ring-batch=three"}, "-dispatch-ring-batch"},
+		{"listen address", nil, []string{"-http=9000"}, "listen.http"},
+		{"tls version", nil, []string{"-tls-min-version=1.5"}, "tls.minVersion"},
+		{"https without cert", nil, []string{"-https=:9443", "-tls-cert=" + filepath.Join(t.TempDir(), "missing.pem")}, "tls.certFile"},
+		{"reconnect grace", nil, []string{"-reconnect-grace=0s"}, "room.reconnectGrace"},
+		{"ring batch", nil, []string{"-dispatch-ring-batch=-1"}, "dispatch.ringBatch"},
+		{"prompt mode", nil, []string{"-mixer-prompt-mode=loud"}, "mixer.promptMode"},
+		{"duck gain", nil, []string{"-mixer-duck-gain=2"}, "mixer.duckGain"},
+		{"web dir", nil, []string{"-web-dir=" + filepath.Join(t.TempDir(), "missing")}, "web.dir"},
+		{"default language", nil, []string{"-prompt-default-language=../zh"}, "prompts.defaultLanguage"},
+		{"nat ip", nil, []string{"-ice-nat-ips=example.com"}, "nat1To1IPs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if _, _, err := loadConfig(tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintConfigMasksSecrets(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "private.key")
+	os.WriteFile(certFile, []byte("cert"), 0644)
+	os.WriteFile(keyFile, []byte("key"), 0600)
+	configFile := writeConfigFile(t, `
+tls:
+  certFile: `+certFile+`
+  keyFile: `+keyFile+`
+ice:
+  iceServers:
+    - urls: ["turn:a.example.com"]
+      username: u
+      credential: static-credential
+    - urls: ["turn:b.example.com"]
+      sharedSecret: ice-shared-secret
+  turnServer:
+    enabled: true
+    host: turn.example.com
+    publicIP: 203.0.113.10
+    udpListen: "0.0.0.0:3478"
+    tlsListen: "0.0.0.0:5349"
+    tlsCert: /etc/blinder/turn.pem
+    tlsKey: /etc/blinder/turn.key
+    sharedSecret: turn-shared-secret
+`)
+	t.Setenv("BLINDER_AUTH_SECRET", "env-secret-0123456789")
+	c, printOnly, err := loadConfig([]string{configFile, "-print-config", "-auth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printOnly {
+		t.Fatal("-print-config is ignored")
+	}
+	var out bytes.Buffer
+	if err := c.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"env-secret-0123456789", "static-credential", "ice-shared-secret", "turn-shared-secret", "private.key", "turn.key"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("printed config contains %s", secret)
+		}
+	}
+	// 不是密钥的配置照常输出，配置本身没有被改掉
+	for _, s := range []string{"turn.example.com", "server.pem", "/etc/blinder/turn.pem", maskedSecret} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("printed config does not contain %s", s)
+		}
+	}
+	if c.Auth.Secret != "env-secret-0123456789" || c.TLS.KeyFile != keyFile || c.ICE.TURNServer.SharedSecret != "turn-shared-secret" || c.ICE.ICEServers[0].Credential != "static-credential" {
+		t.Fatal("Print changed the config")
+	}
+}
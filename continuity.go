@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// rtpContinuity 把盲人不同连接上的同类轨道拼成一条连续的 RTP 流。
+// 盲人重连后新轨道的 SSRC、序列号和时间戳都会重新开始，改写之后志愿者和录制文件
+// 看到的是同一条流，不需要重新协商。
+type rtpContinuity struct {
+	mu sync.Mutex
+
+	// frameTicks 是切换时在两段之间留出的时间戳间隔，音频 20ms、视频按 30fps
+	frameTicks uint32
+
+	started   bool
+	ssrc      uint32
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+}
+
+func newRTPContinuity(frameTicks uint32) *rtpContinuity {
+	return &rtpContinuity{frameTicks: frameTicks}
+}
+
+// Rewrite 返回改写后的包，原来的包不会被修改
+func (c *rtpContinuity) Rewrite(rtpPacket *rtp.Packet) *rtp.Packet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.started {
+		c.started = true
+		c.ssrc = rtpPacket.SSRC
+	} else if rtpPacket.SSRC != c.ssrc {
+		// 新的一段接在上一段后面
+		c.ssrc = rtpPacket.SSRC
+		c.seqOffset = c.lastSeq + 1 - rtpPacket.SequenceNumber
+		c.tsOffset = c.lastTS + c.frameTicks - rtpPacket.Timestamp
+	}
+
+	if c.seqOffset == 0 && c.tsOffset == 0 {
+		c.lastSeq, c.lastTS = rtpPacket.SequenceNumber, rtpPacket.Timestamp
+		return rtpPacket
+	}
+
+	rewritten := rtpPacket.Clone()
+	rewritten.SequenceNumber += c.seqOffset
+	rewritten.Timestamp += c.tsOffset
+	c.lastSeq, c.lastTS = rewritten.SequenceNumber, rewritten.Timestamp
+	return rewritten
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"yanglei_blinder/logger"
+)
+
+// DispatchConfig 是盲人求助的派单配置
+type DispatchConfig struct {
+	// RingBatch 每一轮最多同时呼叫的志愿者数，0 表示呼叫所有空闲志愿者
+	RingBatch int `yaml:"ringBatch"`
+	// RingTimeout 一轮呼叫无人接听后升级，呼叫下一批志愿者
+	RingTimeout time.Duration `yaml:"ringTimeout"`
+	// RequestTimeout 求助一直无人接听时放弃派单
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+	// EscalatePrompt 升级时给盲人播放的提示音，TimeoutPrompt 放弃派单时播放，为空时不播放。
+	// 清单里没有时不能启动；登记了但还没有录音时，启用了 TTS 就合成清单里的文字
+	EscalatePrompt string `yaml:"escalatePrompt"`
+	TimeoutPrompt  string `yaml:"timeoutPrompt"`
+}
+
+func (c *DispatchConfig) Validate() error {
+	if c.RingBatch < 0 {
+		return errors.New("dispatch.ringBatch must not be negative")
+	}
+	if c.RingTimeout <= 0 || c.RequestTimeout <= 0 {
+		return errors.New("dispatch.ringTimeout and dispatch.requestTimeout must be positive")
+	}
+	return nil
+}
+
+// 求助状态，通过 helpRequest 消息推给盲人
+const (
+	helpStateWaiting   = "waiting"
+	helpStateEscalated = "escalated"
+	helpStateAccepted  = "accepted"
+	helpStateTimeout   = "timeout"
+)
+
+// 呼叫被撤回的原因
+const (
+	cancelReasonTaken      = "taken"
+	cancelReasonTimeout    = "timeout"
+	cancelReasonRoomClosed = "room_closed"
+)
+
+// incomingMessage 呼叫志愿者，志愿者用 {"cmd":"accept","requestId":...,"sdp":...} 接听
+type incomingMessage struct {
+	Type      string    `json:"type"`
+	RequestID string    `json:"requestId"`
+	RoomName  string    `json:"roomName"`
+	Owner     string    `json:"owner"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// incomingCancelledMessage 呼叫已被别人接听、超时或者房间已关闭
+type incomingCancelledMessage struct {
+	Type      string `json:"type"`
+	RequestID string `json:"requestId"`
+	Reason    string `json:"reason"`
+}
+
+// helpRequestMessage 推给盲人的求助进度
+type helpRequestMessage struct {
+	Type      string `json:"type"`
+	RequestID string `json:"requestId"`
+	State     string `json:"state"`
+	Volunteer string `json:"volunteer,omitempty"`
+}
+
+// helpRequest 是一个等待志愿者接听的求助
+type helpRequest struct {
+	ID        string
+	room      *ConfRoom
+	createdAt time.Time
+
+	rung     map[*wsSession]bool
+	declined map[*wsSession]bool
+
+	ringTimer    *time.Timer
+	timeoutTimer *time.Timer
+	done         bool
+	// finished 在求助结束时关闭
+	finished chan struct{}
+}
+
+// outgoing 是一条待发送的消息，在释放锁之后再发送
+type outgoing struct {
+	signaler peerSignaler
+	v        interface{}
+}
+
+func deliver(messages []outgoing) {
+	for _, m := range messages {
+		if err := m.signaler.WriteJSON(m.v); err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// Dispatcher 把盲人的求助派给 Presence 中 available 的志愿者：先呼叫空闲最久的一批，
+// RingTimeout 内无人接听就升级呼叫下一批，RequestTimeout 后放弃并提示盲人
+type Dispatcher struct {
+	mu       sync.Mutex
+	requests map[string]*helpRequest
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		requests: make(map[string]*helpRequest),
+	}
+}
+
+// VolunteerAvailable 志愿者变成 available，正在等待的求助会立即呼叫他
+func (d *Dispatcher) VolunteerAvailable(session *wsSession) {
+	d.mu.Lock()
+	var messages []outgoing
+	for _, req := range d.pendingLocked() {
+		if req.ringable(session) {
+			req.rung[session] = true
+			messages = append(messages, outgoing{session, req.incoming()})
+		}
+	}
+	d.mu.Unlock()
+
+	deliver(messages)
+}
+
+// Enqueue 为新建的房间发起求助
+func (d *Dispatcher) Enqueue(confRoom *ConfRoom) {
+	req := &helpRequest{
+		ID:        newToken(),
+		room:      confRoom,
+		createdAt: time.Now(),
+		rung:      make(map[*wsSession]bool),
+		declined:  make(map[*wsSession]bool),
+		finished:  make(chan struct{}),
+	}
+
+	d.mu.Lock()
+	d.requests[req.ID] = req
+	messages := d.ringLocked(req)
+	req.ringTimer = time.AfterFunc(config.Dispatch.RingTimeout, func() { d.escalate(req) })
+	req.timeoutTimer = time.AfterFunc(config.Dispatch.RequestTimeout, func() { d.timeout(req) })
+	d.mu.Unlock()
+
+	logger.Infof("help request %s for room %s, ring %d volunteers", req.ID, confRoom.Name, len(messages))
+	confRoom.NotifyPublisher(helpRequestMessage{Type: "helpRequest", RequestID: req.ID, State: helpStateWaiting})
+	deliver(messages)
+
+	// 房间关闭时撤回呼叫
+	go func() {
+		select {
+		case <-confRoom.Done():
+			d.finish(req, cancelReasonRoomClosed)
+		case <-req.finished:
+		}
+	}()
+}
+
+// pendingLocked 按创建时间返回还在等待的求助
+func (d *Dispatcher) pendingLocked() []*helpRequest {
+	pending := make([]*helpRequest, 0, len(d.requests))
+	for _, req := range d.requests {
+		if !req.done {
+			pending = append(pending, req)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].createdAt.Before(pending[j].createdAt) })
+	return pending
+}
+
+// ringLocked 呼叫下一批还没呼叫过的空闲志愿者：会盲人的语言的优先，其次是有房间要求的全部技能的，
+// 同样匹配的空闲最久的优先
+func (d *Dispatcher) ringLocked(req *helpRequest) []outgoing {
+	var candidates []availableVolunteer
+	for _, volunteer := range Presence.Available() {
+		if req.ringable(volunteer.session) {
+			candidates = append(candidates, volunteer)
+		}
+	}
+	language := req.room.Language
+	if len(language) == 0 {
+		language = config.Prompts.DefaultLanguage
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return matchScore(candidates[i].info, language, req.room.Skills) > matchScore(candidates[j].info, language, req.room.Skills)
+	})
+	if batch := config.Dispatch.RingBatch; batch > 0 && len(candidates) > batch {
+		candidates = candidates[:batch]
+	}
+
+	messages := make([]outgoing, 0, len(candidates))
+	for _, volunteer := range candidates {
+		req.rung[volunteer.session] = true
+		messages = append(messages, outgoing{volunteer.session, req.incoming()})
+	}
+	return messages
+}
+
+// matchScore 志愿者和求助的匹配程度，语言比技能重要
+func matchScore(info VolunteerInfo, language string, skills []string) int {
+	score := 0
+	if speaksLanguage(info.Languages, language) {
+		score += 2
+	}
+	if hasSkills(info.Skills, skills) {
+		score++
+	}
+	return score
+}
+
+// speaksLanguage 按主语言比较，zh-CN 和 zh、zh-TW 都算会
+func speaksLanguage(languages []string, language string) bool {
+	base, _, _ := strings.Cut(strings.ToLower(language), "-")
+	for _, l := range languages {
+		if b, _, _ := strings.Cut(strings.ToLower(l), "-"); b == base {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSkills 志愿者登记了所有要求的技能，没有要求时都算有
+func hasSkills(skills []string, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, skill := range skills {
+			if strings.EqualFold(skill, r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ringable 志愿者还没有被呼叫过，并且 token 允许进入这个房间
+func (req *helpRequest) ringable(session *wsSession) bool {
+	return !req.rung[session] && !req.declined[session] && session.canAccessRoom(req.room.Name)
+}
+
+func (req *helpRequest) incoming() incomingMessage {
+	return incomingMessage{
+		Type:      "incoming",
+		RequestID: req.ID,
+		RoomName:  req.room.Name,
+		Owner:     req.room.Owner,
+		CreatedAt: req.createdAt,
+	}
+}
+
+// escalate 一轮呼叫无人接听，提示盲人继续等待并呼叫下一批
+func (d *Dispatcher) escalate(req *helpRequest) {
+	d.mu.Lock()
+	if req.done {
+		d.mu.Unlock()
+		return
+	}
+	messages := d.ringLocked(req)
+	req.ringTimer.Reset(config.Dispatch.RingTimeout)
+	d.mu.Unlock()
+
+	logger.Infof("help request %s escalated, ring %d more volunteers", req.ID, len(messages))
+	req.room.NotifyPublisher(helpRequestMessage{Type: "helpRequest", RequestID: req.ID, State: helpStateEscalated})
+	PlayPrompt(req.room, config.Dispatch.EscalatePrompt)
+	deliver(messages)
+}
+
+// timeout 一直无人接听，放弃派单。房间保留，志愿者仍然可以通过房间名或加入码加入
+func (d *Dispatcher) timeout(req *helpRequest) {
+	if !d.finish(req, cancelReasonTimeout) {
+		return
+	}
+	logger.Warnf("help request %s for room %s timeout", req.ID, req.room.Name)
+	req.room.NotifyPublisher(helpRequestMessage{Type: "helpRequest", RequestID: req.ID, State: helpStateTimeout})
+	PlayPrompt(req.room, config.Dispatch.TimeoutPrompt)
+}
+
+// finish 结束求助并撤回其它志愿者的呼叫，求助已经结束时返回 false
+func (d *Dispatcher) finish(req *helpRequest, reason string) bool {
+	return d.finishExcept(req, reason, nil)
+}
+
+func (d *Dispatcher) finishExcept(req *helpRequest, reason string, except *wsSession) bool {
+	d.mu.Lock()
+	if req.done {
+		d.mu.Unlock()
+		return false
+	}
+	req.done = true
+	req.ringTimer.Stop()
+	req.timeoutTimer.Stop()
+	close(req.finished)
+	delete(d.requests, req.ID)
+
+	var messages []outgoing
+	for session := range req.rung {
+		if session != except && !req.declined[session] {
+			messages = append(messages, outgoing{session, incomingCancelledMessage{Type: "incomingCancelled", RequestID: req.ID, Reason: reason}})
+		}
+	}
+	d.mu.Unlock()
+
+	deliver(messages)
+	return true
+}
+
+// Accept 志愿者接听，只有被呼叫过并且 token 允许进入房间的才能接听，第一个接听的成功，返回求助的房间
+func (d *Dispatcher) Accept(session *wsSession, requestID string, userID string) (*ConfRoom, error) {
+	d.mu.Lock()
+	req, exists := d.requests[requestID]
+	rung := exists && req.rung[session]
+	d.mu.Unlock()
+	if exists && (!rung || !session.canAccessRoom(req.room.Name)) {
+		return nil, newSignalError(errCodeForbidden, "help request %s was not offered to you", requestID)
+	}
+	if !exists || !d.finishExcept(req, cancelReasonTaken, session) {
+		return nil, newSignalError(errCodeRequestTaken, "help request %s is taken or cancelled", requestID)
+	}
+
+	logger.Infof("help request %s accepted by %s", requestID, userID)
+	req.room.NotifyPublisher(helpRequestMessage{Type: "helpRequest", RequestID: req.ID, State: helpStateAccepted, Volunteer: userID})
+	return req.room, nil
+}
+
+// Decline 志愿者拒绝，所有被呼叫的志愿者都拒绝时立即升级
+func (d *Dispatcher) Decline(session *wsSession, requestID string) {
+	d.mu.Lock()
+	req, exists := d.requests[requestID]
+	if !exists || req.done || !req.rung[session] {
+		d.mu.Unlock()
+		return
+	}
+	req.declined[session] = true
+	allDeclined := true
+	for rung := range req.rung {
+		if !req.declined[rung] {
+			allDeclined = false
+			break
+		}
+	}
+	d.mu.Unlock()
+
+	if allDeclined {
+		d.escalate(req)
+	}
+}
+
+// Fulfilled 有志愿者直接加入了房间，不再需要派单
+func (d *Dispatcher) Fulfilled(confRoom *ConfRoom) {
+	d.mu.Lock()
+	var found []*helpRequest
+	for _, req := range d.requests {
+		if req.room == confRoom {
+			found = append(found, req)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, req := range found {
+		d.finish(req, cancelReasonTaken)
+	}
+}
+
+// checkPrompts 启动时检查派单用到的提示音，否则要等到没人接听时才发现盲人什么也听不到：
+// 清单里没有登记的不能启动；登记了但文件不存在的，启用了 tts 时合成清单里的文字，否则打警告
+func (c *DispatchConfig) checkPrompts(tts *TTSConfig) error {
+	for _, setting := range []struct{ name, prompt string }{
+		{"dispatch.escalatePrompt", c.EscalatePrompt},
+		{"dispatch.timeoutPrompt", c.TimeoutPrompt},
+	} {
+		if len(setting.prompt) == 0 {
+			continue
+		}
+		if _, exists := Catalog.Get(setting.prompt); exists {
+			continue
+		}
+		missing, exists := Catalog.Missing(setting.prompt, "")
+		if !exists {
+			return fmt.Errorf("%s: prompt %s is not in the prompt catalog, add it or set %s to \"\"",
+				setting.name, setting.prompt, setting.name)
+		}
+		if tts.Enabled() && len(missing.Text) > 0 {
+			logger.Infof("%s: %s does not exist, %q will be synthesized", setting.name, missing.Path(), missing.Text)
+			continue
+		}
+		logger.Warnf("%s: %s does not exist and tts is disabled, the blind user hears nothing; record it or enable tts",
+			setting.name, missing.Path())
+	}
+	return nil
+}
+
+var Dispatch = NewDispatcher()
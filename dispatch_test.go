@@ -0,0 +1,323 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDispatchCheckPrompts(t *testing.T) {
+	setupTest(t)
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "zh"), 0755)
+	os.WriteFile(filepath.Join(dir, "zh", "deng_dai.ogg"), []byte("OggS"), 0644)
+	manifest := filepath.Join(dir, "prompts.yaml")
+	os.WriteFile(manifest, []byte(`prompts:
+  - id: deng_dai
+    category: system
+    language: zh
+  - id: wu_ren_jie_ting
+    text: 暂时没有志愿者接听
+    category: system
+    language: zh
+`), 0644)
+	if _, err := Catalog.Load(manifest, dir, "zh"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := DispatchConfig{}
+	if err := c.checkPrompts(&config.TTS); err != nil {
+		t.Fatalf("empty prompts: %v", err)
+	}
+	c.EscalatePrompt = "deng_dai"
+	if err := c.checkPrompts(&config.TTS); err != nil {
+		t.Fatal(err)
+	}
+	// 清单里有但文件不存在：启用 tts 时合成文字，没有启用时只警告
+	c.TimeoutPrompt = "wu_ren_jie_ting"
+	if err := c.checkPrompts(&config.TTS); err != nil {
+		t.Fatalf("missing timeout prompt without tts: %v", err)
+	}
+	config.TTS.Engine = "espeak-ng"
+	if err := c.checkPrompts(&config.TTS); err != nil {
+		t.Fatalf("missing timeout prompt with tts: %v", err)
+	}
+	c.TimeoutPrompt, c.EscalatePrompt = "", "bu_cun_zai"
+	if err := c.checkPrompts(&config.TTS); err == nil || !strings.Contains(err.Error(), "dispatch.escalatePrompt") {
+		t.Fatalf("unknown escalate prompt: %v", err)
+	}
+}
+
+func TestDispatchDefaultPromptsAreSynthesized(t *testing.T) {
+	setupTest(t)
+	loadTestPrompts(t)
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh-CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer confRoom.Close(closeReasonPublisherLeft)
+	runMixer(confRoom)
+
+	// 仓库里还没有派单提示音的录音，默认配置下没有 tts 时不播放
+	for _, id := range []string{config.Dispatch.EscalatePrompt, config.Dispatch.TimeoutPrompt} {
+		if _, exists := Catalog.Missing(id, confRoom.Language); !exists {
+			t.Fatalf("default dispatch prompt %s is not declared in audio/prompts.yaml", id)
+		}
+		if PlayPrompt(confRoom, id) {
+			t.Fatalf("%s played without a recording or tts", id)
+		}
+	}
+
+	useFakeTTS(t, 0)
+	if err := config.Dispatch.checkPrompts(&config.TTS); err != nil {
+		t.Fatal(err)
+	}
+	if !PlayPrompt(confRoom, config.Dispatch.EscalatePrompt) {
+		t.Fatal("escalate prompt is not synthesized")
+	}
+	if !waitFor(2*time.Second, confRoom.IsPlayingFile) {
+		t.Fatal("synthesized escalate prompt is not playing")
+	}
+	files, _ := filepath.Glob(filepath.Join(config.TTS.CacheDir, "*.ogg"))
+	if len(files) != 1 {
+		t.Fatalf("tts cache %v", files)
+	}
+}
+
+// dispatchTest 是一个等待派单的房间和按顺序登记为 available 的志愿者
+type dispatchTest struct {
+	room       *ConfRoom
+	publisher  *fakeSignaler
+	volunteers []*testClient
+}
+
+func newDispatchTest(t *testing.T, volunteers int) *dispatchTest {
+	t.Helper()
+	server := startSignaling(t)
+	d := &dispatchTest{publisher: &fakeSignaler{}}
+	for i := 0; i < volunteers; i++ {
+		c := dialSignaling(t, server, "", nil)
+		c.send(cmdAvailable, map[string]interface{}{"userId": "v" + string(rune('1'+i))})
+		if !waitFor(time.Second, func() bool { return len(Presence.Available()) == i+1 }) {
+			t.Fatalf("volunteer %d is not available", i+1)
+		}
+		// 空闲时间不同，先登记的空闲最久
+		time.Sleep(5 * time.Millisecond)
+		d.volunteers = append(d.volunteers, c)
+	}
+
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { confRoom.Close(closeReasonPublisherLeft) })
+	confRoom.SetPubSignaler(d.publisher)
+	d.room = confRoom
+	Dispatch.Enqueue(confRoom)
+	return d
+}
+
+// helpStates 是盲人收到的求助进度
+func (d *dispatchTest) helpStates() []string {
+	d.publisher.mu.Lock()
+	defer d.publisher.mu.Unlock()
+	var states []string
+	for _, v := range d.publisher.messages {
+		if msg, ok := v.(helpRequestMessage); ok {
+			states = append(states, msg.State)
+		}
+	}
+	return states
+}
+
+func (d *dispatchTest) waitState(t *testing.T, state string) {
+	t.Helper()
+	if !waitFor(2*time.Second, func() bool {
+		states := d.helpStates()
+		return len(states) > 0 && states[len(states)-1] == state
+	}) {
+		t.Fatalf("help request states %v, want %s", d.helpStates(), state)
+	}
+}
+
+func TestDispatchFirstAcceptWins(t *testing.T) {
+	setupTest(t)
+	config.Dispatch.RingBatch = 2
+	config.Dispatch.RingTimeout = time.Minute
+	d := newDispatchTest(t, 3)
+	v1, v2, v3 := d.volunteers[0], d.volunteers[1], d.volunteers[2]
+
+	// 空闲最久的两个被呼叫
+	incoming := v1.expect("incoming")
+	if incoming.RoomName != "room1" || v2.expect("incoming").RequestID != incoming.RequestID {
+		t.Fatalf("incoming %s", incoming.raw)
+	}
+	if !v3.quiet("incoming", 100*time.Millisecond) {
+		t.Fatal("third volunteer rung beyond the batch")
+	}
+	// 没有被呼叫的志愿者不能接听
+	v3.send(cmdAccept, map[string]interface{}{"userId": "v3", "requestId": incoming.RequestID, "sdp": "x"})
+	v3.expectError(cmdAccept, errCodeForbidden)
+
+	v1.send(cmdAccept, map[string]interface{}{"userId": "v1", "requestId": incoming.RequestID, "sdp": testOffer(t)})
+	if answer := v1.expect("answer"); answer.RoomName != "room1" || len(answer.Answer) == 0 {
+		t.Fatalf("answer %s", answer.raw)
+	}
+	if cancelled := v2.expect("incomingCancelled"); cancelled.Reason != cancelReasonTaken {
+		t.Fatalf("incomingCancelled %s", cancelled.raw)
+	}
+	v2.send(cmdAccept, map[string]interface{}{"userId": "v2", "requestId": incoming.RequestID, "sdp": testOffer(t)})
+	v2.expectError(cmdAccept, errCodeRequestTaken)
+	d.waitState(t, helpStateAccepted)
+	if role := d.room.SubscriberRole("v1"); role != subRoleGuide {
+		t.Fatalf("v1 is %q", role)
+	}
+}
+
+func TestDispatchDeclineAllEscalates(t *testing.T) {
+	setupTest(t)
+	config.Dispatch.RingBatch = 2
+	config.Dispatch.RingTimeout = time.Minute
+	d := newDispatchTest(t, 3)
+	v1, v2, v3 := d.volunteers[0], d.volunteers[1], d.volunteers[2]
+
+	requestID := v1.expect("incoming").RequestID
+	v2.expect("incoming")
+	// 没有被呼叫的拒绝不算
+	v3.send(cmdDecline, map[string]interface{}{"requestId": requestID})
+	v1.send(cmdDecline, map[string]interface{}{"requestId": requestID})
+	if !v3.quiet("incoming", 100*time.Millisecond) {
+		t.Fatal("escalated before every rung volunteer declined")
+	}
+	v2.send(cmdDecline, map[string]interface{}{"requestId": requestID})
+	if v3.expect("incoming").RequestID != requestID {
+		t.Fatal("third volunteer rung for another request")
+	}
+	d.waitState(t, helpStateEscalated)
+	// 拒绝过的不会再被呼叫
+	if !v1.quiet("incoming", 50*time.Millisecond) {
+		t.Fatal("declined volunteer rung again")
+	}
+}
+
+func TestDispatchRingTimeoutAndRequestTimeout(t *testing.T) {
+	setupTest(t)
+	config.Dispatch.RingBatch = 1
+	config.Dispatch.RingTimeout = 200 * time.Millisecond
+	config.Dispatch.RequestTimeout = time.Second
+	start := time.Now()
+	d := newDispatchTest(t, 2)
+	v1, v2 := d.volunteers[0], d.volunteers[1]
+
+	requestID := v1.expect("incoming").RequestID
+	// ringTimeout 后升级，呼叫下一个
+	if v2.expect("incoming").RequestID != requestID {
+		t.Fatal("second volunteer rung for another request")
+	}
+	if elapsed := time.Since(start); elapsed < config.Dispatch.RingTimeout {
+		t.Fatalf("escalated after %v", elapsed)
+	}
+	d.waitState(t, helpStateEscalated)
+
+	// requestTimeout 后放弃，撤回所有呼叫，房间保留
+	for _, v := range d.volunteers {
+		if cancelled := v.expect("incomingCancelled"); cancelled.Reason != cancelReasonTimeout || cancelled.RequestID != requestID {
+			t.Fatalf("incomingCancelled %s", cancelled.raw)
+		}
+	}
+	d.waitState(t, helpStateTimeout)
+	if !d.room.Joinable() {
+		t.Fatalf("room is %v after the help request timed out", d.room.State())
+	}
+	v1.send(cmdAccept, map[string]interface{}{"userId": "v1", "requestId": requestID, "sdp": testOffer(t)})
+	v1.expectError(cmdAccept, errCodeRequestTaken)
+}
+
+func TestDispatchRequeueWhenJoinFails(t *testing.T) {
+	setupTest(t)
+	config.Dispatch.RingBatch = 2
+	config.Dispatch.RingTimeout = time.Minute
+	d := newDispatchTest(t, 2)
+	v1, v2 := d.volunteers[0], d.volunteers[1]
+
+	requestID := v1.expect("incoming").RequestID
+	v2.expect("incoming")
+	// sdp 坏了，HandleSubOffer 失败，先重新派单再回错误
+	v1.send(cmdAccept, map[string]interface{}{"userId": "v1", "requestId": requestID, "sdp": "bad"})
+	v2.expect("incomingCancelled")
+	for _, v := range d.volunteers {
+		if again := v.expect("incoming"); again.RequestID == requestID || again.RoomName != "room1" {
+			t.Fatalf("incoming after a failed accept %s", again.raw)
+		}
+	}
+	v1.expectError(cmdAccept, errCodeBadSdp)
+	if subscriberCount(d.room) != 0 {
+		t.Fatal("failed accept left a subscriber")
+	}
+}
+
+func TestDispatchRanksLanguageAndSkills(t *testing.T) {
+	setupTest(t)
+	config.Dispatch.RingBatch = 1
+	config.Dispatch.RingTimeout = time.Minute
+	server := startSignaling(t)
+	// 按空闲时间从长到短登记：只会英语的、会中文的、会中文并且会导航的
+	registrations := []map[string]interface{}{
+		{"userId": "v1", "languages": []string{"en"}, "skills": []string{"navigation"}},
+		{"userId": "v2", "languages": []string{"zh-TW"}},
+		{"userId": "v3", "languages": []string{"en", "zh"}, "skills": []string{"Navigation", "reading"}},
+	}
+	volunteers := make([]*testClient, 0, len(registrations))
+	for i, fields := range registrations {
+		c := dialSignaling(t, server, "", nil)
+		c.send(cmdAvailable, fields)
+		if !waitFor(time.Second, func() bool { return len(Presence.Available()) == i+1 }) {
+			t.Fatalf("volunteer %d is not available", i+1)
+		}
+		time.Sleep(5 * time.Millisecond)
+		volunteers = append(volunteers, c)
+	}
+
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh-CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer confRoom.Close(closeReasonPublisherLeft)
+	confRoom.SetPubSignaler(&fakeSignaler{})
+	confRoom.Skills = []string{"navigation"}
+	Dispatch.Enqueue(confRoom)
+
+	// 语言比技能优先，同样匹配的空闲最久的优先，每次拒绝后呼叫下一个
+	for _, i := range []int{2, 1, 0} {
+		incoming := volunteers[i].expect("incoming")
+		for j, other := range volunteers {
+			if j != i && !other.quiet("incoming", 50*time.Millisecond) {
+				t.Fatalf("v%d rung together with v%d", j+1, i+1)
+			}
+		}
+		volunteers[i].send(cmdDecline, map[string]interface{}{"requestId": incoming.RequestID})
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	tests := []struct {
+		languages, skills []string
+		language          string
+		required          []string
+		want              int
+	}{
+		{[]string{"zh"}, nil, "zh-CN", nil, 3},
+		{[]string{"ZH-tw"}, nil, "zh", []string{"navigation"}, 2},
+		{[]string{"en"}, []string{"navigation"}, "zh", []string{"navigation"}, 1},
+		{[]string{"en"}, []string{"navigation"}, "zh", []string{"navigation", "reading"}, 0},
+		{nil, nil, "", nil, 1},
+	}
+	for _, tt := range tests {
+		info := VolunteerInfo{Languages: tt.languages, Skills: tt.skills}
+		if got := matchScore(info, tt.language, tt.required); got != tt.want {
+			t.Errorf("%v %v for %s %v: score %d, want %d", tt.languages, tt.skills, tt.language, tt.required, got, tt.want)
+		}
+	}
+}
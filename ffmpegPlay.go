@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"net"
 	"os/exec"
 	"strconv"
@@ -13,15 +14,11 @@ import (
 )
 
 // EncodeOpusFileToRTPPackets 通过UDP接收FFmpeg生成的RTP数据包，并通过给定的通道返回RTP包。
-func FFmpegFileToRTPPackets(filePath string, confRoom *ConfRoom) (int, error) {
+// ctx 取消（提示音被打断或房间关闭）时 ffmpeg 会被 kill
+func FFmpegFileToRTPPackets(ctx context.Context, filePath string, confRoom *ConfRoom) (int, error) {
 	logger.Info("EncodeOpusFileToRTPPackets comming...")
 	defer logger.Info("EncodeOpusFileToRTPPackets end")
 
-	confRoom.IsPlayingFile = true
-	defer func() {
-		confRoom.IsPlayingFile = false
-	}()
-
 	// 创建一个UDP监听器以获取随机端口
 	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
 	if err != nil {
@@ -35,7 +32,8 @@ func FFmpegFileToRTPPackets(filePath string, confRoom *ConfRoom) (int, error) {
 	udpPort := udpAddr.Port
 
 	// 启动FFmpeg进程
-	cmd := exec.Command(
+	// 房间关闭或提示音被打断时 ffmpeg 会被 kill，不再等它播完
+	cmd := exec.CommandContext(ctx,
 		"ffmpeg",
 		"-re",
 		"-i", filePath, // 输入文件
@@ -68,7 +66,7 @@ func FFmpegFileToRTPPackets(filePath string, confRoom *ConfRoom) (int, error) {
 		buf := make([]byte, 1500) // RTP包通常小于1500字节
 
 		for {
-			if confRoom.PubQuit || confRoom.PubLocalAudioChan == nil {
+			if confRoom.PubQuit() || ctx.Err() != nil {
 				return
 			}
 			// 设置读取操作的截止时间
@@ -94,17 +92,22 @@ func FFmpegFileToRTPPackets(filePath string, confRoom *ConfRoom) (int, error) {
 				continue
 			}
 
-			confRoom.PubLocalAudioChan <- packet
+			if !confRoom.SendToPublisher(audioSourcePrompt, packet) {
+				return
+			}
 		}
 	}()
 
 	// 等待FFmpeg进程结束
 	err = cmd.Wait()
+	wg.Wait()
+	if ctx.Err() != nil {
+		return udpPort, nil
+	}
 	if err != nil {
 		logger.Errorf("FFmpeg exited with error: %v", err)
 		return udpPort, err
 	}
-	wg.Wait()
 
 	return udpPort, nil
 }
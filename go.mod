@@ -7,6 +7,7 @@ require (
 	github.com/pion/interceptor v0.1.30
 	github.com/pion/webrtc/v3 v3.3.3
 	github.com/pion/webrtc/v4 v4.0.0-beta.30
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -25,10 +26,11 @@ require (
 	github.com/pion/srtp/v3 v3.0.3 // indirect
 	github.com/pion/stun/v3 v3.0.0 // indirect
 	github.com/pion/transport/v3 v3.0.7 // indirect
-	github.com/pion/turn/v4 v4.0.0 // indirect
+	github.com/pion/turn/v4 v4.0.0
 	github.com/wlynxg/anet v0.0.3 // indirect
-	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/crypto v0.26.0
 	golang.org/x/image v0.21.0
 	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sys v0.24.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
 )
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+	"yanglei_blinder/logger"
+
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// 服务端自己的 PeerConnection 申请 TURN 临时凭证时使用的用户名
+const serverICEUser = "blinder-server"
+
+// ICEServerConfig 是配置文件里的一个 ICE server
+type ICEServerConfig struct {
+	URLs       []string `json:"urls" yaml:"urls"`
+	Username   string   `json:"username,omitempty" yaml:"username,omitempty"`
+	Credential string   `json:"credential,omitempty" yaml:"credential,omitempty"`
+
+	// SharedSecret 不为空时按 TURN REST API 为每个用户生成有时效的用户名和密码：
+	// username = "<过期时间戳>:<userId>"，credential = base64(HMAC-SHA1(SharedSecret, username))
+	SharedSecret string `json:"sharedSecret,omitempty" yaml:"sharedSecret,omitempty"`
+	// CredentialTTL 临时凭证的有效期，单位秒
+	CredentialTTL int `json:"credentialTTL,omitempty" yaml:"credentialTTL,omitempty"`
+}
+
+type ICEConfig struct {
+	ICEServers []ICEServerConfig `json:"iceServers" yaml:"iceServers"`
+	// TURNServer 启用时在本进程内运行 TURN server，并自动加到 ICEServers 里
+	TURNServer *TURNServerConfig `json:"turnServer,omitempty" yaml:"turnServer,omitempty"`
+
+	// UDPMuxPort 不为 0 时所有 PeerConnection 共用这个 UDP 端口，否则每个连接使用随机端口
+	UDPMuxPort int `json:"udpMuxPort,omitempty" yaml:"udpMuxPort,omitempty"`
+	// TCPMuxPort 不为 0 时额外提供 ICE-TCP candidate
+	TCPMuxPort int `json:"tcpMuxPort,omitempty" yaml:"tcpMuxPort,omitempty"`
+	// NAT1To1IPs 是本机对外的公网 IP，用来替换 host candidate 的地址
+	NAT1To1IPs []string `json:"nat1To1IPs,omitempty" yaml:"nat1To1IPs,omitempty"`
+}
+
+// iceServerReply 是下发给浏览器的 RTCIceServer
+type iceServerReply struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+const defaultCredentialTTL = 24 * 60 * 60
+
+func defaultICEConfig() *ICEConfig {
+	return &ICEConfig{
+		ICEServers: []ICEServerConfig{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+}
+
+var iceConfig = defaultICEConfig()
+
+// loadICEConfig 从 JSON 文件读取 ICE server 配置
+func loadICEConfig(path string) (*ICEConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ice := &ICEConfig{}
+	if err := json.Unmarshal(b, ice); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := ice.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return ice, nil
+}
+
+func (c *ICEConfig) Validate() error {
+	for i, server := range c.ICEServers {
+		if len(server.URLs) == 0 {
+			return fmt.Errorf("iceServers[%d]: urls is required", i)
+		}
+		if len(server.SharedSecret) > 0 && len(server.Username) > 0 {
+			return fmt.Errorf("iceServers[%d]: username and sharedSecret are exclusive", i)
+		}
+		if server.CredentialTTL < 0 {
+			return fmt.Errorf("iceServers[%d]: credentialTTL must not be negative", i)
+		}
+	}
+	if c.UDPMuxPort < 0 || c.UDPMuxPort > 65535 {
+		return fmt.Errorf("udpMuxPort %d is invalid", c.UDPMuxPort)
+	}
+	if c.TCPMuxPort < 0 || c.TCPMuxPort > 65535 {
+		return fmt.Errorf("tcpMuxPort %d is invalid", c.TCPMuxPort)
+	}
+	for _, ip := range c.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("nat1To1IPs: %q is not an IP", ip)
+		}
+	}
+	if c.TURNServer != nil {
+		return c.TURNServer.Validate()
+	}
+	return nil
+}
+
+// credentialsFor 返回 userID 使用这个 server 的用户名和密码
+func (s *ICEServerConfig) credentialsFor(userID string) (string, string, error) {
+	if len(s.SharedSecret) == 0 {
+		return s.Username, s.Credential, nil
+	}
+	ttl := s.CredentialTTL
+	if ttl == 0 {
+		ttl = defaultCredentialTTL
+	}
+	return turn.GenerateLongTermTURNRESTCredentials(s.SharedSecret, userID, time.Duration(ttl)*time.Second)
+}
+
+// allServers 返回配置的 ICE server，内置 TURN server 启用时也包含在内
+func (c *ICEConfig) allServers() []ICEServerConfig {
+	if c.TURNServer == nil || !c.TURNServer.Enabled {
+		return c.ICEServers
+	}
+	turnServer, err := c.TURNServer.ICEServer()
+	if err != nil {
+		logger.Error(err)
+		return c.ICEServers
+	}
+	return append(append([]ICEServerConfig{}, c.ICEServers...), turnServer)
+}
+
+// ReplyFor 生成下发给浏览器的 ICE server 列表，TURN 临时凭证按 userID 生成
+func (c *ICEConfig) ReplyFor(userID string) []iceServerReply {
+	iceServers := c.allServers()
+	servers := make([]iceServerReply, 0, len(iceServers))
+	for i := range iceServers {
+		username, credential, err := iceServers[i].credentialsFor(userID)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		servers = append(servers, iceServerReply{
+			URLs:       iceServers[i].URLs,
+			Username:   username,
+			Credential: credential,
+		})
+	}
+	return servers
+}
+
+// PeerConnectionConfig 服务端 PeerConnection 使用和浏览器相同的 ICE server
+func (c *ICEConfig) PeerConnectionConfig() webrtc.Configuration {
+	var servers []webrtc.ICEServer
+	for _, reply := range c.ReplyFor(serverICEUser) {
+		server := webrtc.ICEServer{URLs: reply.URLs}
+		if len(reply.Username) > 0 {
+			server.Username = reply.Username
+			server.Credential = reply.Credential
+			server.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		servers = append(servers, server)
+	}
+	return webrtc.Configuration{ICEServers: servers}
+}
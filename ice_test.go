@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// turnPassword 按 TURN REST API 计算用户名对应的密码
+func turnPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestCredentialsFor(t *testing.T) {
+	static := ICEServerConfig{URLs: []string{"turn:example.com"}, Username: "u", Credential: "p"}
+	if username, credential, err := static.credentialsFor("v1"); err != nil || username != "u" || credential != "p" {
+		t.Fatalf("static credentials %q %q %v", username, credential, err)
+	}
+
+	tests := []struct {
+		name string
+		ttl  int
+		want time.Duration
+	}{
+		{"default ttl", 0, defaultCredentialTTL * time.Second},
+		{"configured ttl", 600, 600 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := ICEServerConfig{URLs: []string{"turn:example.com"}, SharedSecret: "s3cret", CredentialTTL: tt.ttl}
+			now := time.Now()
+			username, credential, err := server.credentialsFor("v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// username 是 "<过期时间戳>:<userId>"
+			expiry, user, found := strings.Cut(username, ":")
+			if !found || user != "v1" {
+				t.Fatalf("username %q", username)
+			}
+			unix, err := strconv.ParseInt(expiry, 10, 64)
+			if err != nil {
+				t.Fatalf("username %q: %v", username, err)
+			}
+			if d := time.Unix(unix, 0).Sub(now) - tt.want; d < -2*time.Second || d > 2*time.Second {
+				t.Fatalf("credentials expire at %v, want about %v", time.Unix(unix, 0), now.Add(tt.want))
+			}
+			if credential != turnPassword("s3cret", username) {
+				t.Fatalf("credential %q is not HMAC-SHA1 of %q", credential, username)
+			}
+		})
+	}
+}
+
+func TestLoadICEConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"valid", `{"iceServers": [{"urls": ["turn:example.com"], "sharedSecret": "s"}], "udpMuxPort": 8443}`, ""},
+		{"bad json", `{"iceServers": `, "parse"},
+		{"no urls", `{"iceServers": [{"username": "u"}]}`, "urls is required"},
+		{"username and secret", `{"iceServers": [{"urls": ["turn:a"], "username": "u", "sharedSecret": "s"}]}`, "exclusive"},
+		{"bad port", `{"udpMuxPort": 70000}`, "udpMuxPort"},
+		{"bad nat ip", `{"nat1To1IPs": ["example.com"]}`, "not an IP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "ice.json")
+			if err := os.WriteFile(file, []byte(tt.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ice, err := loadICEConfig(file)
+			if len(tt.want) == 0 {
+				if err != nil || len(ice.ICEServers) != 1 || ice.UDPMuxPort != 8443 {
+					t.Fatalf("%+v %v", ice, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want %s", err, tt.want)
+			}
+		})
+	}
+	if _, err := loadICEConfig("ice.example.json"); err != nil {
+		t.Fatalf("ice.example.json: %v", err)
+	}
+}
+
+// iceServersIn 取出 create/join 应答里的 iceServers
+func iceServersIn(t *testing.T, reply testReply) []iceServerReply {
+	t.Helper()
+	var answer answerReply
+	if err := json.Unmarshal(reply.raw, &answer); err != nil {
+		t.Fatal(err)
+	}
+	return answer.ICEServers
+}
+
+func TestICEServersInAnswers(t *testing.T) {
+	setupTest(t)
+	saved := iceConfig
+	t.Cleanup(func() { iceConfig = saved })
+	iceConfig = &ICEConfig{ICEServers: []ICEServerConfig{
+		{URLs: []string{"stun:stun.example.com:3478"}},
+		{URLs: []string{"turn:turn.example.com:3478"}, SharedSecret: "s3cret", CredentialTTL: 600},
+	}}
+	server := startSignaling(t)
+
+	blind := dialSignaling(t, server, "", nil)
+	blind.send(cmdCreate, map[string]interface{}{"roomName": "room1", "userId": "blind1", "sdp": testPublisherOffer(t)})
+	volunteer := dialSignaling(t, server, "", nil)
+	replies := map[string]testReply{"blind1": blind.expect("answer")}
+	volunteer.send(cmdJoin, map[string]interface{}{"roomName": "room1", "userId": "v1", "sdp": testOffer(t)})
+	replies["v1"] = volunteer.expect("answer")
+
+	for userID, reply := range replies {
+		servers := iceServersIn(t, reply)
+		if len(servers) != 2 {
+			t.Fatalf("%s: iceServers %s", userID, reply.raw)
+		}
+		if stun := servers[0]; stun.URLs[0] != "stun:stun.example.com:3478" || len(stun.Username) > 0 || len(stun.Credential) > 0 {
+			t.Fatalf("%s: stun server %+v", userID, stun)
+		}
+		// TURN 临时凭证按应答的用户生成
+		turn := servers[1]
+		if !strings.HasSuffix(turn.Username, ":"+userID) || turn.Credential != turnPassword("s3cret", turn.Username) {
+			t.Fatalf("%s: turn server %+v", userID, turn)
+		}
+	}
+}
@@ -1,21 +1,22 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"yanglei_blinder/logger"
 
 	"github.com/gorilla/websocket"
-	"github.com/pion/interceptor"
-	"github.com/pion/interceptor/pkg/intervalpli"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 
@@ -24,67 +25,157 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
-type ConfRoom struct {
-	Name                string
-	PubPC               *webrtc.PeerConnection
-	PubRemoteVideoTrack *webrtc.TrackRemote
-	PubRemoteAudioTrack *webrtc.TrackRemote
-	PubLocalAudioTrack  *webrtc.TrackLocalStaticRTP
-	PubLocalAudioChan   chan *rtp.Packet
-	SubLocalVideoTrack  map[string]*webrtc.TrackLocalStaticRTP
-	SublocalAudioTrack  map[string]*webrtc.TrackLocalStaticRTP
-	CreatedAt           time.Time
-	PubQuit             bool
-	IsPlayingFile       bool
-}
-
-type ConfInfo struct {
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"createdAt"`
-}
-
-var ConfRoomList = make(map[string]*ConfRoom, 0)
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
 }
-var webPort = ":9000"
-var httpsPort = ":9443"
-
-var recordPath = "./record"
 
 func main() {
+	loadedConfig, printConfig, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		if err := loadedConfig.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	config = loadedConfig
+	iceConfig = &config.ICE
+
+	if len(config.Log.File) > 0 {
+		logFile, err := os.OpenFile(config.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Switch(logFile)
+		log.SetOutput(logFile)
+	}
+
+	// 第一次 SIGTERM/SIGINT 开始优雅关闭，关闭过程中再收到信号直接退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	api, err := newWebRTCAPI(iceConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webrtcAPI = api
+	if iceConfig.TURNServer != nil && iceConfig.TURNServer.Enabled {
+		turnServer, err := startTURNServer(iceConfig.TURNServer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer turnServer.Close()
+	}
+
+	if n, err := Catalog.Load(config.Prompts.ManifestPath(), config.Prompts.Dir, config.Prompts.DefaultLanguage); err != nil {
+		logger.Errorf("load prompt catalog: %v", err)
+	} else {
+		logger.Infof("loaded %d prompts, cached %d", n, PromptClips.Load(Catalog))
+	}
+	if err := config.Dispatch.checkPrompts(&config.TTS); err != nil {
+		log.Fatal(err)
+	}
+	checkOpus()
+	config.Mixer.checkDuck()
+
 	http.HandleFunc("/ws", HandleWebSocket)
-	fs := http.FileServer(http.Dir("./web"))
+	fs := http.FileServer(http.Dir(config.Web.Dir))
 	http.Handle("/", fs)
 	http.HandleFunc("/api/confInfo", HandleGetConfInfo) // 新增的 GET endpoint
+	http.HandleFunc("/api/volunteers", HandleGetVolunteers)
+	http.HandleFunc("/api/prompts", HandleGetPrompts)
+
+	// 启用 ACME 时 HTTP 服务器同时应答 HTTP-01 验证
+	var httpHandler http.Handler = http.DefaultServeMux
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if len(config.Listen.HTTPS) > 0 {
+		if config.TLS.ACME.Enabled {
+			acmeManager, err := newACMEManager(&config.TLS.ACME, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			httpHandler = acmeManager.HTTPHandler(http.DefaultServeMux)
+			getCertificate = acmeManager.GetCertificate
+		} else {
+			// 证书更新后不需要重启
+			certs, err := newCertManager(config.TLS.CertFile, config.TLS.KeyFile, config.TLS.ExpiryWarning)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go certs.Watch(ctx, config.TLS.ReloadInterval)
+			getCertificate = certs.GetCertificate
+		}
+	}
 
 	// 启动 HTTP 服务器
+	httpServer := &http.Server{
+		Addr:    config.Listen.HTTP,
+		Handler: httpHandler,
+	}
 	go func() {
-		log.Printf("Starting HTTP server at %s\n", webPort)
-		log.Fatal(http.ListenAndServe(webPort, nil))
+		log.Printf("Starting HTTP server at %s\n", config.Listen.HTTP)
+		if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
 	}()
+	servers := []*http.Server{httpServer}
 
 	// 启动 HTTPS 服务器
-	go func() {
-		log.Printf("Starting HTTPS server at %s\n", httpsPort)
-		certFile := "./blinder.aiiyou.cn/aliyun/blinder.aiiyou.cn.pem" // 替换为你的证书路径
-		keyFile := "./blinder.aiiyou.cn/aliyun/blinder.aiiyou.cn.key"  // 替换为你的私钥路径
+	if len(config.Listen.HTTPS) > 0 {
 		tlsConfig := &tls.Config{
-			MinVersion: tls.VersionTLS10,
+			MinVersion:     config.TLSMinVersion(),
+			GetCertificate: getCertificate,
 		}
 		srv := &http.Server{
-			Addr:      httpsPort,
+			Addr:      config.Listen.HTTPS,
 			Handler:   nil,
 			TLSConfig: tlsConfig,
 		}
-		log.Fatal(srv.ListenAndServeTLS(certFile, keyFile))
-	}()
+		go func() {
+			log.Printf("Starting HTTPS server at %s\n", config.Listen.HTTPS)
+			if err := srv.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+		servers = append(servers, srv)
+	}
 
-	os.MkdirAll(recordPath, os.ModePerm)
+	os.MkdirAll(config.Recording.Path, os.ModePerm)
+	if config.Snapshot.Enabled {
+		os.MkdirAll(config.Snapshot.Path, os.ModePerm)
+	}
 
-	select {} // 阻止主 goroutine 退出
+	<-ctx.Done()
+	stop()
+	shutdown(servers)
+}
+
+// shutdown 优雅关闭：不再创建房间，通知所有客户端，关闭所有 PeerConnection 并结束录制和截图，
+// 最后关闭 HTTP/HTTPS 服务器。整个过程最多等待 listen.shutdownTimeout
+func shutdown(servers []*http.Server) {
+	logger.Infof("shutting down, wait at most %v", config.Listen.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.Listen.ShutdownTimeout)
+	defer cancel()
+
+	Sessions.NotifyShutdown()
+	if err := Rooms.Shutdown(ctx); err != nil {
+		logger.Errorf("close rooms: %v", err)
+	}
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Errorf("shutdown %s: %v", srv.Addr, err)
+		}
+	}
+	// WebSocket 连接已经被 hijack，http.Server.Shutdown 不会关闭它们
+	Sessions.CloseAll()
+	logger.Info("server stopped")
 }
 
 func HandleGetConfInfo(w http.ResponseWriter, r *http.Request) {
@@ -92,13 +183,20 @@ func HandleGetConfInfo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
+	// 房间列表只给志愿者和管理员看
+	claims, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims != nil && !claims.HasRole(roleVolunteer) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
 
 	var confRooms []ConfInfo
-	for _, room := range ConfRoomList {
-		confRooms = append(confRooms, ConfInfo{
-			Name:      room.Name,
-			CreatedAt: room.CreatedAt,
-		})
+	for _, room := range Rooms.List() {
+		confRooms = append(confRooms, room.Info())
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -106,6 +204,12 @@ func HandleGetConfInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	claims, err := authenticateRequest(r)
+	if err != nil {
+		logger.Warnf("reject websocket from %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logger.Error(err)
@@ -113,6 +217,14 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
+	session := newWsSession(conn, claims)
+	if !Sessions.Add(session) {
+		session.SendError("", newSignalError(errCodeServerShutdown, "server is shutting down"))
+		return
+	}
+	defer Sessions.Remove(session)
+	defer Presence.Remove(session)
+
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
@@ -121,128 +233,55 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 		logger.Infof("recv message:%s", string(message))
 
-		var msg map[string]interface{}
-		if err := json.Unmarshal(message, &msg); err != nil {
+		var envelope signalEnvelope
+		if err := json.Unmarshal(message, &envelope); err != nil {
 			logger.Error(err)
+			session.SendError("", newSignalError(errCodeBadMessage, "%v", err))
 			continue
 		}
-		msgCmd := msg["cmd"].(string)
-		logger.Infof("msgCmd:%s", msgCmd)
-
-		switch msgCmd {
-		case "create":
-			roomName := msg["roomName"].(string)
-			logger.Infof("roomName:%s", roomName)
-			if len(roomName) == 0 {
-				logger.Errorf("roomName: %v is invlaid", roomName)
-				continue
-			}
-			createdRoom, err := CreateConfRoom(roomName)
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-			answerSdp, err := HandlePubOffer(msg["sdp"].(string), createdRoom)
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-			jsonData, err := json.Marshal(map[string]string{"answer": answerSdp, "type": "answer"})
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-			err = conn.WriteMessage(websocket.TextMessage, jsonData)
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-		case "join":
-			roomName := msg["roomName"].(string)
-			logger.Info("roomName: %s", roomName)
-			if len(roomName) == 0 {
-				logger.Errorf("roomName: %s", roomName)
-				continue
-			}
-			joinRoom, exists := ConfRoomList[roomName]
-			if !exists {
-				logger.Errorf("joinRoom: %s is not existed")
-				continue
-			}
-
-			answerSdp, err := HandleSubOffer(msg["userId"].(string), msg["sdp"].(string), joinRoom)
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-			jsonData, err := json.Marshal(map[string]string{"answer": answerSdp, "type": "answer"})
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-			err = conn.WriteMessage(websocket.TextMessage, jsonData)
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-		case "control":
-			roomName := msg["roomName"].(string)
-			if len(roomName) == 0 {
-				http.Error(w, "Invalid room name", http.StatusBadRequest)
-				return
-			}
-			joinRoom, exists := ConfRoomList[roomName]
-			if !exists {
-				http.Error(w, "Room does not exist", http.StatusNotFound)
-				return
-			}
-
-			cmdDetail := msg["cmdDetail"].(string)
-			go FFmpegFileToRTPPackets(fmt.Sprintf("audio/%s.ogg", cmdDetail), joinRoom)
-
-		default:
-			logger.Errorf("invalid msgCmd: %s, msg:%v", msgCmd, msg)
+		logger.Infof("msgCmd:%s", envelope.Cmd)
 
+		if err := session.HandleMessage(envelope.Cmd, message); err != nil {
+			logger.Errorf("handle %s failed: %v", envelope.Cmd, err)
+			session.SendError(envelope.Cmd, err)
 		}
 	}
 
 }
 
-func HandleSubOffer(userName string, offer string, confRoom *ConfRoom) (string, error) {
+func HandleSubOffer(userName string, role string, offer string, confRoom *ConfRoom, onCandidate func(*webrtc.ICECandidate), signaler peerSignaler) (string, *webrtc.PeerConnection, error) {
 	logger.Info("handleSubOffer comming...")
 	recvOnlyOffer := webrtc.SessionDescription{}
 	err := decode(offer, &recvOnlyOffer)
 	if err != nil {
-		return "", err
+		return "", nil, newSignalError(errCodeBadSdp, "%v", err)
 	}
 	logger.Info("-----------Sub Recv Sdp Offer------------------")
 	logger.Info(recvOnlyOffer)
 	logger.Info("-------------------------------------------")
 
 	// Create a new PeerConnection
-	peerConnectionConfig := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-	peerConnection, err := webrtc.NewPeerConnection(peerConnectionConfig)
+	peerConnectionConfig := iceConfig.PeerConnectionConfig()
+	peerConnection, err := webrtcAPI.NewPeerConnection(peerConnectionConfig)
 	if err != nil {
 		logger.Error(err)
-		return "", err
+		return "", nil, err
 	}
 
 	today := time.Now().Format("2006-01-02")
-	os.MkdirAll(fmt.Sprintf("%s/%s", recordPath, today), os.ModePerm)
-	recordFileName := fmt.Sprintf("%s/%s/%s_sub_%v", recordPath, today, confRoom.Name, confRoom.CreatedAt.Format("15_04_05"))
+	os.MkdirAll(fmt.Sprintf("%s/%s", config.Recording.Path, today), os.ModePerm)
+	// 每个志愿者一个录制文件，同一个志愿者重新加入时用加入的时间区分
+	recordFileName := fmt.Sprintf("%s/%s/%s_sub_%s_%v", config.Recording.Path, today, confRoom.Name, recordFileSafe(userName), time.Now().Format("15_04_05"))
 
 	subRecordSaver := newWebmSaver(recordFileName)
+	// 盲人的轨道已经到达的话直接带在 answer 里，否则等 OnTrack 时再重新协商
+	sub := newSubscriber(userName, role, peerConnection, onCandidate != nil, signaler, subRecordSaver)
 	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
 			logger.Infof("sub remoteTrack codec MimeType: %v, ClockRate:%v, channels:%v ", remoteTrack.Codec().MimeType, remoteTrack.Codec().ClockRate, remoteTrack.Codec().Channels)
 
-			go func() {
+			// 算在房间的 goroutine 里，房间关闭时等它退出后才结束录制
+			confRoom.Go(func() {
 				logger.Info("Sub Audio Track")
 				defer logger.Info("Sub Audio Track end.")
 				for {
@@ -257,158 +296,94 @@ func HandleSubOffer(userName string, offer string, confRoom *ConfRoom) (string,
 					subRecordSaver.PushOpus(rtpPacket)
 					subRecordSaver.mu.Unlock()
 
-					if confRoom.PubQuit {
+					if confRoom.PubQuit() {
 						logger.Warn("pub quit,so peerConnection will be close")
 						return
 					}
-					if !confRoom.IsPlayingFile {
-						select {
-						case confRoom.PubLocalAudioChan <- rtpPacket:
-						default:
-
+					// 只有 guide 的声音给盲人，trainer 的声音只给 guide，observer 的声音只录制
+					switch sub.Role() {
+					case subRoleGuide:
+						// duck 模式下提示音期间也转发，由混音器压低音量
+						if !confRoom.IsPlayingFile() || !config.Mixer.MuteDuringPrompt(confRoom.mixer.Mixing()) {
+							confRoom.SendToPublisher(volunteerSource(sub.UserID), rtpPacket)
 						}
+					case subRoleTrainer:
+						confRoom.Whisper(remoteTrack.Codec().RTPCodecCapability, rtpPacket)
 					}
 				}
-			}()
+			})
 
 		}
 	})
 
 	peerConnection.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
-		if is == webrtc.ICEConnectionStateDisconnected || is == webrtc.ICEConnectionStateFailed {
+		if is == webrtc.ICEConnectionStateDisconnected || is == webrtc.ICEConnectionStateFailed || is == webrtc.ICEConnectionStateClosed {
 			logger.Warn("peerConnection will be close")
-			delete(confRoom.SubLocalVideoTrack, userName)
-			delete(confRoom.SublocalAudioTrack, userName)
-			subRecordSaver.Close()
-			peerConnection.Close()
+			confRoom.RemoveSubscriber(sub)
+			sub.Close()
 		}
 	})
 
-	//Video track
-	if confRoom == nil || confRoom.PubRemoteVideoTrack == nil {
-		logger.Error("PubRemoteVideoTrack is nil")
-		return "", errors.New("PubRemoteVideoTrack is nil")
-
-	}
-	localVideoTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(confRoom.PubRemoteVideoTrack.Codec().RTPCodecCapability, "video", "pion")
-	if newTrackErr != nil {
-		logger.Error(newTrackErr)
-		return "", newTrackErr
-	}
-
-	rtpVideoSender, err := peerConnection.AddTrack(localVideoTrack)
+	remoteTracks, err := confRoom.AddSubscriber(sub)
 	if err != nil {
-		logger.Error(err)
-		return "", err
-	}
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpVideoSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
-		}
-	}()
-
-	//Audio track
-	localAudioTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(confRoom.PubRemoteAudioTrack.Codec().RTPCodecCapability, "audio", "pion")
-	if newTrackErr != nil {
-		logger.Error(newTrackErr)
-		return "", newTrackErr
+		sub.Close()
+		return "", nil, err
 	}
-
-	rtpAudioSender, err := peerConnection.AddTrack(localAudioTrack)
-	if err != nil {
-		logger.Error(err)
-		return "", err
+	for _, remoteTrack := range remoteTracks {
+		confRoom.attachSubscriberTrack(sub, remoteTrack.Kind(), remoteTrack.Codec().RTPCodecCapability)
 	}
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpAudioSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
-		}
-	}()
 
 	// Set the remote SessionDescription
 	err = peerConnection.SetRemoteDescription(recvOnlyOffer)
 	if err != nil {
 		logger.Error(err)
-		return "", err
+		confRoom.RemoveSubscriber(sub)
+		sub.Close()
+		return "", nil, newSignalError(errCodeBadSdp, "%v", err)
 	}
 
 	// Create answer
+	sub.clearPending()
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
 		logger.Error(err)
-		return "", err
+		confRoom.RemoveSubscriber(sub)
+		sub.Close()
+		return "", nil, err
 	}
 
-	// Create channel that is blocked until ICE Gathering is complete
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-
-	// Sets the LocalDescription, and starts our UDP listeners
-	err = peerConnection.SetLocalDescription(answer)
+	err = setLocalAnswer(peerConnection, answer, onCandidate)
 	if err != nil {
 		logger.Error(err)
-		return "", err
+		confRoom.RemoveSubscriber(sub)
+		sub.Close()
+		return "", nil, err
 	}
-
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
-
-	confRoom.SubLocalVideoTrack[userName] = localVideoTrack
-	confRoom.SublocalAudioTrack[userName] = localAudioTrack
+	sub.startNegotiation()
 
 	logger.Info("handleSubOffer end, will return answer sdp:\n")
 	logger.Info(peerConnection.LocalDescription())
 	// Get the LocalDescription and take it to base64 so we can paste in browser
-	return encode(peerConnection.LocalDescription()), nil
+	return encode(peerConnection.LocalDescription()), peerConnection, nil
 
 }
 
-func HandlePubOffer(offer string, confRoom *ConfRoom) (string, error) {
+func HandlePubOffer(offer string, confRoom *ConfRoom, onCandidate func(*webrtc.ICECandidate)) (string, error) {
 
 	logger.Info("handlePubOffer comming...")
 
 	offerSD := webrtc.SessionDescription{}
 	err := decode(offer, &offerSD)
 	if err != nil {
-		return "", err
+		return "", newSignalError(errCodeBadSdp, "%v", err)
 	}
 	logger.Info("-----------Recv Sdp Offer------------------")
 	logger.Info(offerSD)
 	logger.Info("-------------------------------------------")
 
-	peerConnectionConfig := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-
-	m := &webrtc.MediaEngine{}
+	peerConnectionConfig := iceConfig.PeerConnectionConfig()
 
-	if err = m.RegisterDefaultCodecs(); err != nil {
-		logger.Error(err)
-		return "", err
-	}
-	i := &interceptor.Registry{}
-	if err = webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-		logger.Error(err)
-		return "", err
-	}
-	intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
-	if err != nil {
-		logger.Error(err)
-		return "", err
-	}
-	i.Add(intervalPliFactory)
-	peerConnection, err := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)).NewPeerConnection(peerConnectionConfig)
+	peerConnection, err := webrtcAPI.NewPeerConnection(peerConnectionConfig)
 	if err != nil {
 		logger.Error(err)
 		return "", err
@@ -416,17 +391,20 @@ func HandlePubOffer(offer string, confRoom *ConfRoom) (string, error) {
 
 	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
 		logger.Error(err)
+		peerConnection.Close()
 		return "", err
 	}
 
 	localAudioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
 	if err != nil {
 		logger.Error(err)
+		peerConnection.Close()
 		return "", err
 	}
 	rtpSender, err := peerConnection.AddTrack(localAudioTrack)
 	if err != nil {
 		logger.Error(err)
+		peerConnection.Close()
 		return "", err
 	}
 	go func() {
@@ -438,25 +416,29 @@ func HandlePubOffer(offer string, confRoom *ConfRoom) (string, error) {
 		}
 	}()
 
-	confRoom.PubLocalAudioTrack = localAudioTrack
-
-	today := time.Now().Format("2006-01-02")
-	os.MkdirAll(fmt.Sprintf("%s/%s", recordPath, today), os.ModePerm)
-	recordFileName := fmt.Sprintf("%s/%s/%s_pub_%v", recordPath, today, confRoom.Name, confRoom.CreatedAt.Format("15_04_05"))
-	pubRecordSaver := newWebmSaver(recordFileName)
+	// 录制文件跟着房间走，盲人重连时继续写原来的文件
+	pubRecordSaver := confRoom.pubRecordSaver
 
 	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) { //nolint: revive
 		logger.Info("OnTrack comming....", remoteTrack)
 
 		if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
 			logger.Infof("remoteTrack codec MimeType: %v, ClockRate:%v, channels:%v ", remoteTrack.Codec().MimeType, remoteTrack.Codec().ClockRate, remoteTrack.Codec().Channels)
-			go PubLocalAudioWrite(confRoom.PubLocalAudioChan, confRoom, uint8(remoteTrack.Codec().PayloadType))
-			go func() {
+			// 整个房间只有一个混音器写盲人耳机，重连后继续使用
+			confRoom.audioWriterOnce.Do(func() {
+				confRoom.Go(func() {
+					confRoom.mixer.Run(confRoom.Context(), uint8(remoteTrack.Codec().PayloadType), func(packet *rtp.Packet) error {
+						// 盲人重连后 PubLocalAudioTrack 会换成新连接上的轨道
+						return confRoom.GetPubLocalAudioTrack().WriteRTP(packet)
+					})
+				})
+			})
+			confRoom.Go(func() {
 				defer logger.Info("pub audio track quit")
 				logger.Info("pub auido track")
 				codec := remoteTrack.Codec()
 				logger.Infof("pub audio codec:%v", codec)
-				confRoom.PubRemoteAudioTrack = remoteTrack
+				confRoom.SetPublisherTrack(remoteTrack)
 
 				for {
 					rtpPacketA, _, readErr := remoteTrack.ReadRTP()
@@ -464,36 +446,35 @@ func HandlePubOffer(offer string, confRoom *ConfRoom) (string, error) {
 						logger.Error(readErr)
 						return
 					}
+					rtpPacketA = confRoom.audioContinuity.Rewrite(rtpPacketA)
 					pubRecordSaver.mu.Lock()
 					pubRecordSaver.PushOpus(rtpPacketA)
 					pubRecordSaver.mu.Unlock()
-					for _, localTrack := range confRoom.SublocalAudioTrack {
-						err := localTrack.WriteRTP(rtpPacketA)
-						if err != nil && !errors.Is(err, io.EOF) {
-							logger.Error(err)
-							continue
-						}
-					}
+					confRoom.WriteToSubscribers(webrtc.RTPCodecTypeAudio, rtpPacketA)
 
 				}
-			}()
+			})
 		}
 		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
-			go func() {
+			confRoom.Go(func() {
 				defer logger.Info("pub video track quit")
 				logger.Info("pub video track")
 				codec := remoteTrack.Codec()
 				logger.Infof("pub video codec:%v", codec)
-				confRoom.PubRemoteVideoTrack = remoteTrack
+				confRoom.SetPublisherTrack(remoteTrack)
 				errSend := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}})
 				if errSend != nil {
 					logger.Error(errSend)
 				}
-				snapShotChan := make(chan *rtp.Packet)
-				defer close(snapShotChan)
-				go func() {
-					Snapshot(snapShotChan, recordPath, confRoom.Name)
-				}()
+				// 不保存截图时 snapShotChan 为 nil，下面的 select 总是走 default
+				var snapShotChan chan *rtp.Packet
+				if config.Snapshot.Enabled {
+					snapShotChan = make(chan *rtp.Packet)
+					defer close(snapShotChan)
+					confRoom.Go(func() {
+						Snapshot(snapShotChan, config.Snapshot.Path, confRoom.Name)
+					})
+				}
 
 				// 创建或打开音频录制文件
 				for {
@@ -502,14 +483,9 @@ func HandlePubOffer(offer string, confRoom *ConfRoom) (string, error) {
 						logger.Error(readErr)
 						return
 					}
+					rtpPacketV = confRoom.videoContinuity.Rewrite(rtpPacketV)
 
-					for _, localTrack := range confRoom.SubLocalVideoTrack {
-						err := localTrack.WriteRTP(rtpPacketV)
-						if err != nil && !errors.Is(err, io.EOF) {
-							logger.Error(err)
-							break
-						}
-					}
+					confRoom.WriteToSubscribers(webrtc.RTPCodecTypeVideo, rtpPacketV)
 					switch codec.MimeType {
 					case webrtc.MimeTypeVP8:
 						pubRecordSaver.mu.Lock()
@@ -523,19 +499,23 @@ func HandlePubOffer(offer string, confRoom *ConfRoom) (string, error) {
 
 				}
 
-			}()
+			})
 		}
 
 	})
 
 	peerConnection.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
-		if is == webrtc.ICEConnectionStateFailed || is == webrtc.ICEConnectionStateDisconnected || is == webrtc.ICEConnectionStateClosed {
-			confRoom.PubQuit = true
-			time.Sleep(10*time.Microsecond)
-			peerConnection.Close()
-			pubRecordSaver.Close()
-			close(confRoom.PubLocalAudioChan)
-			delete(ConfRoomList, confRoom.Name)
+		switch is {
+		case webrtc.ICEConnectionStateConnected:
+			confRoom.PublisherConnected(peerConnection)
+		case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+			// 移动网络上经常短暂断开，先保留房间等盲人重连
+			confRoom.PublisherDisconnected(peerConnection)
+		case webrtc.ICEConnectionStateClosed:
+			// 被重连替换掉的旧连接关闭时不关房间；Close 会等待本房间的 goroutine 退出，不在 pion 的回调里同步执行
+			if confRoom.GetPubPC() == peerConnection {
+				go confRoom.Close(closeReasonPublisherLeft)
+			}
 		}
 	})
 
@@ -543,32 +523,28 @@ func HandlePubOffer(offer string, confRoom *ConfRoom) (string, error) {
 	err = peerConnection.SetRemoteDescription(offerSD)
 	if err != nil {
 		logger.Error(err)
-		return "", err
+		peerConnection.Close()
+		return "", newSignalError(errCodeBadSdp, "%v", err)
 	}
 
 	// Create answer
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
 		logger.Error(err)
+		peerConnection.Close()
 		return "", err
 	}
-	confRoom.PubPC = peerConnection
-
-	// Create channel that is blocked until ICE Gathering is complete
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if oldPC := confRoom.SetPubPC(peerConnection, localAudioTrack); oldPC != nil {
+		logger.Infof("publisher of room %s resumed, close the old peerConnection", confRoom.Name)
+		oldPC.Close()
+	}
 
-	// Sets the LocalDescription, and starts our UDP listeners
-	err = peerConnection.SetLocalDescription(answer)
+	err = setLocalAnswer(peerConnection, answer, onCandidate)
 	if err != nil {
 		logger.Error(err)
 		return "", err
 	}
 
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
-
 	logger.Info("handlePubOffer end, will return answer sdp:\n")
 	logger.Info(peerConnection.LocalDescription())
 
@@ -576,6 +552,45 @@ func HandlePubOffer(offer string, confRoom *ConfRoom) (string, error) {
 	return encode(peerConnection.LocalDescription()), nil
 }
 
+// setLocalAnswer 设置 LocalDescription 并开始 ICE 收集。
+// onCandidate 不为 nil 时走 trickle ICE，candidate 通过回调逐个发给客户端，立即返回；
+// 否则阻塞到收集完成，answer 中带上全部 candidate（老客户端只能交换一次信令）。
+// 收集中途房间关闭了 PeerConnection 时收集永远不会完成，这时返回错误，最多等 gatherTimeout
+func setLocalAnswer(peerConnection *webrtc.PeerConnection, answer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) error {
+	if onCandidate != nil {
+		peerConnection.OnICECandidate(onCandidate)
+		return peerConnection.SetLocalDescription(answer)
+	}
+
+	// Create channel that is blocked until ICE Gathering is complete
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+
+	// Sets the LocalDescription, and starts our UDP listeners
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	// Block until ICE Gathering is complete, disabling trickle ICE
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(gatherTimeout)
+	for {
+		select {
+		case <-gatherComplete:
+			return nil
+		case <-timeout:
+			return nil
+		case <-ticker.C:
+			if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				return errors.New("peer connection closed during ice gathering")
+			}
+		}
+	}
+}
+
+// gatherTimeout 是不走 trickle ICE 时等待 candidate 收集完成的最长时间
+const gatherTimeout = 5 * time.Second
+
 // JSON encode + base64 a SessionDescription
 
 func encode(obj *webrtc.SessionDescription) string {
@@ -601,41 +616,3 @@ func decode(in string, obj *webrtc.SessionDescription) error {
 	}
 	return nil
 }
-
-func CreateConfRoom(name string) (*ConfRoom, error) {
-	logger.Info("CreateConfRoom comming...")
-	newRoom := &ConfRoom{
-		Name:               name,
-		SubLocalVideoTrack: make(map[string]*webrtc.TrackLocalStaticRTP, 0),
-		SublocalAudioTrack: make(map[string]*webrtc.TrackLocalStaticRTP, 0),
-		CreatedAt:          time.Now(), // 记录创建时间
-		PubLocalAudioChan:  make(chan *rtp.Packet),
-		PubQuit:            false,
-		IsPlayingFile:      false,
-	}
-
-	ConfRoomList[name] = newRoom
-	logger.Info("CreateConfRoom end")
-	return newRoom, nil
-}
-
-func PubLocalAudioWrite(rtpChan chan *rtp.Packet, confRoom *ConfRoom, payloadType uint8) {
-	var localSeqNum uint16 = 0
-	logger.Info("PubLocalAudioWrite loop...")
-	defer logger.Info("PubLocalAudioWrite loop end.")
-	for rtpPackage := range rtpChan {
-		rtpPackage.Header.SequenceNumber = localSeqNum
-		rtpPackage.Header.PayloadType = payloadType
-		localSeqNum++
-		if localSeqNum == 0 {
-			localSeqNum = 1 // 避免序列号溢出后变为0
-		}
-		// logger.Info(rtpPackage)
-		err := confRoom.PubLocalAudioTrack.WriteRTP(rtpPackage)
-		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
-			logger.Errorf("Sub audio write error: %v", err)
-			break
-		}
-	}
-
-}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// /ws 上客户端发来的命令
+const (
+	cmdCreate          = "create"
+	cmdJoin            = "join"
+	cmdControl         = "control"
+	cmdLeave           = "leave"
+	cmdAnswer          = "answer"
+	cmdResume          = "resume"
+	cmdRestart         = "restart"
+	cmdCandidate       = "candidate"
+	cmdEndOfCandidates = "endOfCandidates"
+	cmdAvailable       = "available"
+	cmdUnavailable     = "unavailable"
+	cmdAccept          = "accept"
+	cmdDecline         = "decline"
+	cmdWatchPresence   = "watchPresence"
+	cmdHandover        = "handover"
+	cmdCancelPrompt    = "cancelPrompt"
+	cmdStopPrompts     = "stopPrompts"
+)
+
+// 返回给客户端的错误码
+const (
+	errCodeBadMessage       = "bad_message"
+	errCodeUnknownCmd       = "unknown_cmd"
+	errCodeInvalidRoomName  = "invalid_room_name"
+	errCodeRoomNotFound     = "room_not_found"
+	errCodeRoomExists       = "room_exists"
+	errCodeBadSdp           = "bad_sdp"
+	errCodeNoPeerConnection = "no_peer_connection"
+	errCodeBadCandidate     = "bad_candidate"
+	errCodeResumeFailed     = "resume_failed"
+	errCodeForbidden        = "forbidden"
+	errCodeServerShutdown   = "server_shutdown"
+	errCodeRequestTaken     = "request_taken"
+	errCodeGuideTaken       = "guide_taken"
+	errCodeUnknownPrompt    = "unknown_prompt"
+	errCodePromptQueueFull  = "prompt_queue_full"
+	errCodeTTSFailed        = "tts_failed"
+	errCodeInternal         = "internal_error"
+)
+
+// signalError 是处理信令时的错误，会以 {"type":"error","code":...,"reason":...} 回给客户端
+type signalError struct {
+	Code   string
+	Reason string
+}
+
+func (e *signalError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+func newSignalError(code string, format string, a ...interface{}) *signalError {
+	return &signalError{Code: code, Reason: fmt.Sprintf(format, a...)}
+}
+
+type errorReply struct {
+	Type   string `json:"type"`
+	Cmd    string `json:"cmd,omitempty"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// signalEnvelope 只用来取出 cmd，再按 cmd 解析成具体的消息
+type signalEnvelope struct {
+	Cmd string `json:"cmd"`
+}
+
+// createMessage 盲人创建房间。roomName 为空时由服务端生成房间 ID；
+// 同名房间已经存在时只有带上它的 resumeToken 才能接替
+type createMessage struct {
+	UserID      string `json:"userId"`
+	RoomName    string `json:"roomName"`
+	ResumeToken string `json:"resumeToken"`
+	Sdp         string `json:"sdp"`
+	Trickle     bool   `json:"trickle"`
+	// Language 是盲人想听的提示音语言，如 zh、en，为空时用 prompts.defaultLanguage
+	Language string `json:"language"`
+	// Skills 是希望志愿者有的技能，如 navigation，派单时优先呼叫有这些技能的志愿者
+	Skills []string `json:"skills"`
+}
+
+func (m *createMessage) Validate() *signalError {
+	// userId 记为房间的 owner，TURN 临时凭证也按它生成
+	if len(m.UserID) == 0 {
+		return newSignalError(errCodeBadMessage, "userId is required")
+	}
+	if len(m.Sdp) == 0 {
+		return newSignalError(errCodeBadSdp, "sdp is required")
+	}
+	if len(m.Language) > 0 && !promptIDPattern.MatchString(m.Language) {
+		return newSignalError(errCodeBadMessage, "invalid language %s", m.Language)
+	}
+	return nil
+}
+
+// resumeMessage 盲人断线后凭 create 时拿到的 resumeToken 用新的 PeerConnection 接管原来的房间
+type resumeMessage struct {
+	UserID      string `json:"userId"`
+	RoomName    string `json:"roomName"`
+	ResumeToken string `json:"resumeToken"`
+	Sdp         string `json:"sdp"`
+	Trickle     bool   `json:"trickle"`
+}
+
+func (m *resumeMessage) Validate() *signalError {
+	if len(m.RoomName) == 0 {
+		return newSignalError(errCodeInvalidRoomName, "roomName is required")
+	}
+	if len(m.ResumeToken) == 0 {
+		return newSignalError(errCodeResumeFailed, "resumeToken is required")
+	}
+	if len(m.Sdp) == 0 {
+		return newSignalError(errCodeBadSdp, "sdp is required")
+	}
+	return nil
+}
+
+// restartMessage 在同一条连接上对现有 PeerConnection 做 ICE restart，sdp 是 iceRestart 的 offer
+type restartMessage struct {
+	Sdp     string `json:"sdp"`
+	Trickle bool   `json:"trickle"`
+}
+
+func (m *restartMessage) Validate() *signalError {
+	if len(m.Sdp) == 0 {
+		return newSignalError(errCodeBadSdp, "sdp is required")
+	}
+	return nil
+}
+
+// answerReply 是 create/join/resume/restart 的应答
+type answerReply struct {
+	Type        string `json:"type"`
+	Answer      string `json:"answer"`
+	RoomName    string `json:"roomName,omitempty"`
+	ResumeToken string `json:"resumeToken,omitempty"`
+	// JoinCode 只在 create 的应答里有，盲人把它告诉志愿者
+	JoinCode string `json:"joinCode,omitempty"`
+	// Role 是 join/accept 后志愿者在房间里的角色
+	Role string `json:"role,omitempty"`
+	// ICEServers 和服务端使用同一组 ICE server，TURN 临时凭证按 userId 生成
+	ICEServers []iceServerReply `json:"iceServers,omitempty"`
+}
+
+// joinMessage 志愿者加入房间，roomName 和 joinCode 二选一。
+// role 为 guide、observer 或 trainer，不带时房间里没有 guide 就是 guide，否则是 observer
+type joinMessage struct {
+	UserID   string `json:"userId"`
+	RoomName string `json:"roomName"`
+	JoinCode string `json:"joinCode"`
+	Role     string `json:"role"`
+	Sdp      string `json:"sdp"`
+	Trickle  bool   `json:"trickle"`
+}
+
+func (m *joinMessage) Validate() *signalError {
+	if len(m.RoomName) == 0 && len(m.JoinCode) == 0 {
+		return newSignalError(errCodeInvalidRoomName, "roomName or joinCode is required")
+	}
+	if len(m.Role) > 0 && !validSubRole(m.Role) {
+		return newSignalError(errCodeBadMessage, "unknown role %s", m.Role)
+	}
+	if len(m.UserID) == 0 {
+		return newSignalError(errCodeBadMessage, "userId is required")
+	}
+	if len(m.Sdp) == 0 {
+		return newSignalError(errCodeBadSdp, "sdp is required")
+	}
+	return nil
+}
+
+// controlMessage 播放清单里的提示音 cmdDetail，或者把 text 合成语音播放（voice 为空时用默认的声音）
+type controlMessage struct {
+	UserID    string `json:"userId"`
+	RoomName  string `json:"roomName"`
+	CmdDetail string `json:"cmdDetail"`
+	Text      string `json:"text"`
+	Voice     string `json:"voice"`
+}
+
+func (m *controlMessage) Validate() *signalError {
+	if len(m.RoomName) == 0 {
+		return newSignalError(errCodeInvalidRoomName, "roomName is required")
+	}
+	if len(m.CmdDetail) == 0 && len(m.Text) == 0 {
+		return newSignalError(errCodeBadMessage, "cmdDetail or text is required")
+	}
+	if len(m.CmdDetail) > 0 && len(m.Text) > 0 {
+		return newSignalError(errCodeBadMessage, "cmdDetail and text are exclusive")
+	}
+	return nil
+}
+
+// promptMessage 是 cancelPrompt 和 stopPrompts，cancelPrompt 取消 playId 对应的提示音，stopPrompts 停止并清空房间的提示音
+type promptMessage struct {
+	UserID   string `json:"userId"`
+	RoomName string `json:"roomName"`
+	PlayID   string `json:"playId"`
+}
+
+func (m *promptMessage) Validate() *signalError {
+	if len(m.RoomName) == 0 {
+		return newSignalError(errCodeInvalidRoomName, "roomName is required")
+	}
+	return nil
+}
+
+// handoverMessage 把 guide 交给房间里的另一个志愿者 to
+type handoverMessage struct {
+	UserID   string `json:"userId"`
+	RoomName string `json:"roomName"`
+	To       string `json:"to"`
+}
+
+func (m *handoverMessage) Validate() *signalError {
+	if len(m.RoomName) == 0 {
+		return newSignalError(errCodeInvalidRoomName, "roomName is required")
+	}
+	if len(m.To) == 0 {
+		return newSignalError(errCodeBadMessage, "to is required")
+	}
+	return nil
+}
+
+type leaveMessage struct {
+	UserID   string `json:"userId"`
+	RoomName string `json:"roomName"`
+}
+
+func (m *leaveMessage) Validate() *signalError {
+	return nil
+}
+
+// availableMessage 志愿者登记为 available 或者 away（unavailable），
+// languages 和 skills 不带时保留原来的值
+type availableMessage struct {
+	UserID    string   `json:"userId"`
+	Languages []string `json:"languages"`
+	Skills    []string `json:"skills"`
+}
+
+func (m *availableMessage) Validate() *signalError {
+	if len(m.UserID) == 0 {
+		return newSignalError(errCodeBadMessage, "userId is required")
+	}
+	return nil
+}
+
+// watchPresenceMessage 订阅志愿者在线状态，unwatch 为 true 时取消
+type watchPresenceMessage struct {
+	Unwatch bool `json:"unwatch"`
+}
+
+func (m *watchPresenceMessage) Validate() *signalError {
+	return nil
+}
+
+// acceptMessage 志愿者接听 incoming 呼叫，sdp 和 join 一样是订阅的 offer
+type acceptMessage struct {
+	UserID    string `json:"userId"`
+	RequestID string `json:"requestId"`
+	Sdp       string `json:"sdp"`
+	Trickle   bool   `json:"trickle"`
+}
+
+func (m *acceptMessage) Validate() *signalError {
+	if len(m.RequestID) == 0 {
+		return newSignalError(errCodeBadMessage, "requestId is required")
+	}
+	if len(m.UserID) == 0 {
+		return newSignalError(errCodeBadMessage, "userId is required")
+	}
+	if len(m.Sdp) == 0 {
+		return newSignalError(errCodeBadSdp, "sdp is required")
+	}
+	return nil
+}
+
+type declineMessage struct {
+	UserID    string `json:"userId"`
+	RequestID string `json:"requestId"`
+}
+
+func (m *declineMessage) Validate() *signalError {
+	if len(m.RequestID) == 0 {
+		return newSignalError(errCodeBadMessage, "requestId is required")
+	}
+	return nil
+}
+
+// answerMessage 是客户端对服务端重新协商 offer 的应答
+type answerMessage struct {
+	Sdp string `json:"sdp"`
+}
+
+func (m *answerMessage) Validate() *signalError {
+	if len(m.Sdp) == 0 {
+		return newSignalError(errCodeBadSdp, "sdp is required")
+	}
+	return nil
+}
+
+type candidateMessage struct {
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+func (m *candidateMessage) Validate() *signalError {
+	if len(m.Candidate.Candidate) == 0 {
+		return newSignalError(errCodeBadCandidate, "candidate is empty, use endOfCandidates instead")
+	}
+	return nil
+}
+
+type validator interface {
+	Validate() *signalError
+}
+
+// decodeMessage 把原始消息解析到 v 并校验，字段类型不对时返回 bad_message 而不是 panic
+func decodeMessage(message []byte, v validator) *signalError {
+	if err := json.Unmarshal(message, v); err != nil {
+		return newSignalError(errCodeBadMessage, "%v", err)
+	}
+	return v.Validate()
+}
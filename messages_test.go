@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSignalingBadMessages(t *testing.T) {
+	setupTest(t)
+	c := dialSignaling(t, startSignaling(t), "", nil)
+
+	// 每条消息都在同一条连接上回 error，连接不会断开
+	tests := []struct {
+		name    string
+		message string
+		cmd     string
+		code    string
+	}{
+		{"not json", `create room1`, "", errCodeBadMessage},
+		{"cmd is not a string", `{"cmd": 5}`, "", errCodeBadMessage},
+		{"no cmd", `{"userId": "u1"}`, "", errCodeUnknownCmd},
+		{"unknown cmd", `{"cmd": "fly"}`, "fly", errCodeUnknownCmd},
+		{"create without userId", `{"cmd": "create", "roomName": "room1", "sdp": "x"}`, cmdCreate, errCodeBadMessage},
+		{"create without sdp", `{"cmd": "create", "userId": "b1", "roomName": "room1"}`, cmdCreate, errCodeBadSdp},
+		{"create with a bad field type", `{"cmd": "create", "userId": 1, "sdp": "x"}`, cmdCreate, errCodeBadMessage},
+		{"create with a bad language", `{"cmd": "create", "userId": "b1", "sdp": "x", "language": "../en"}`, cmdCreate, errCodeBadMessage},
+		{"create with a bad room name", `{"cmd": "create", "userId": "b1", "roomName": "../room", "sdp": "x"}`, cmdCreate, errCodeInvalidRoomName},
+		{"create with a bad sdp", `{"cmd": "create", "userId": "b1", "roomName": "room1", "sdp": "not base64"}`, cmdCreate, errCodeBadSdp},
+		{"join without room", `{"cmd": "join", "userId": "v1", "sdp": "x"}`, cmdJoin, errCodeInvalidRoomName},
+		{"join with a bad role", `{"cmd": "join", "userId": "v1", "roomName": "room1", "role": "boss", "sdp": "x"}`, cmdJoin, errCodeBadMessage},
+		{"join without userId", `{"cmd": "join", "roomName": "room1", "sdp": "x"}`, cmdJoin, errCodeBadMessage},
+		{"join without sdp", `{"cmd": "join", "userId": "v1", "roomName": "room1"}`, cmdJoin, errCodeBadSdp},
+		{"join a missing room", `{"cmd": "join", "userId": "v1", "roomName": "room1", "sdp": "x"}`, cmdJoin, errCodeRoomNotFound},
+		{"control without room", `{"cmd": "control", "userId": "v1", "cmdDetail": "ting"}`, cmdControl, errCodeInvalidRoomName},
+		{"control without prompt", `{"cmd": "control", "userId": "v1", "roomName": "room1"}`, cmdControl, errCodeBadMessage},
+		{"control with prompt and text", `{"cmd": "control", "userId": "v1", "roomName": "room1", "cmdDetail": "ting", "text": "停"}`, cmdControl, errCodeBadMessage},
+		{"resume without token", `{"cmd": "resume", "userId": "b1", "roomName": "room1", "sdp": "x"}`, cmdResume, errCodeResumeFailed},
+		{"restart without sdp", `{"cmd": "restart"}`, cmdRestart, errCodeBadSdp},
+		{"restart without connection", `{"cmd": "restart", "sdp": "x"}`, cmdRestart, errCodeNoPeerConnection},
+		{"leave without connection", `{"cmd": "leave"}`, cmdLeave, errCodeNoPeerConnection},
+		{"answer without sdp", `{"cmd": "answer"}`, cmdAnswer, errCodeBadSdp},
+		{"empty candidate", `{"cmd": "candidate", "candidate": {}}`, cmdCandidate, errCodeBadCandidate},
+		{"available without userId", `{"cmd": "available"}`, cmdAvailable, errCodeBadMessage},
+		{"accept without requestId", `{"cmd": "accept", "userId": "v1", "sdp": "x"}`, cmdAccept, errCodeBadMessage},
+		{"decline without requestId", `{"cmd": "decline"}`, cmdDecline, errCodeBadMessage},
+		{"handover without to", `{"cmd": "handover", "userId": "v1", "roomName": "room1"}`, cmdHandover, errCodeBadMessage},
+		{"cancelPrompt without room", `{"cmd": "cancelPrompt", "playId": "p1"}`, cmdCancelPrompt, errCodeInvalidRoomName},
+	}
+	for _, tt := range tests {
+		if err := c.conn.WriteMessage(websocket.TextMessage, []byte(tt.message)); err != nil {
+			t.Fatal(err)
+		}
+		reply := c.expect("error")
+		if reply.Cmd != tt.cmd || reply.Code != tt.code {
+			t.Errorf("%s: %s, want cmd %q code %s", tt.name, reply.raw, tt.cmd, tt.code)
+		}
+	}
+	// 创建失败的房间不会留下
+	if rooms := Rooms.List(); len(rooms) != 0 {
+		t.Fatalf("rooms %v left after failed creates", rooms)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"yanglei_blinder/logger"
+
+	"github.com/pion/rtp"
+)
+
+// 混音器的输出格式：48kHz 双声道，每 20ms 一帧
+const (
+	mixerSampleRate   = 48000
+	mixerChannels     = 2
+	mixerFrameSamples = mixerSampleRate / 50 // 每个声道 960 个采样
+	mixerFrameLen     = mixerFrameSamples * mixerChannels
+	mixerFrameTime    = 20 * time.Millisecond
+	// mixerMaxQueue 每个音源最多缓存的帧数，超过时丢掉最旧的，避免延迟越积越大
+	mixerMaxQueue = 10
+	// opusMaxPacket 是 Opus 包的最大长度
+	opusMaxPacket = 1500
+)
+
+// 音源 ID，志愿者的音源是 volunteerSource(userID)
+const (
+	audioSourcePrompt = "prompt"
+)
+
+func volunteerSource(userID string) string {
+	return "volunteer:" + userID
+}
+
+// 播放提示音时志愿者声音的处理方式
+const (
+	promptModeDuck = "duck"
+	promptModeMute = "mute"
+)
+
+// MixerConfig 是给盲人的混音配置，增益 1 为原音量
+type MixerConfig struct {
+	VolunteerGain float64 `yaml:"volunteerGain"`
+	PromptGain    float64 `yaml:"promptGain"`
+	// PromptMode 为 duck 时提示音期间志愿者的声音压低到 DuckGain，为 mute 时丢弃。
+	// 没有 Opus 编解码器（直通）时只能 mute
+	PromptMode string  `yaml:"promptMode"`
+	DuckGain   float64 `yaml:"duckGain"`
+	// DuckAttack 压低所用的时间，DuckRelease 提示音结束后恢复所用的时间
+	DuckAttack  time.Duration `yaml:"duckAttack"`
+	DuckRelease time.Duration `yaml:"duckRelease"`
+}
+
+func (c *MixerConfig) Validate() error {
+	if c.VolunteerGain < 0 || c.PromptGain < 0 {
+		return errors.New("mixer gains must not be negative")
+	}
+	if c.PromptMode != promptModeDuck && c.PromptMode != promptModeMute {
+		return fmt.Errorf("mixer.promptMode %q is invalid, use duck or mute", c.PromptMode)
+	}
+	if c.DuckGain < 0 || c.DuckGain > 1 {
+		return errors.New("mixer.duckGain must be between 0 and 1")
+	}
+	if c.DuckAttack < 0 || c.DuckRelease < 0 {
+		return errors.New("mixer.duckAttack and mixer.duckRelease must not be negative")
+	}
+	return nil
+}
+
+// MuteDuringPrompt 播放提示音时是否丢弃志愿者的声音
+func (c *MixerConfig) MuteDuringPrompt(mixing bool) bool {
+	return c.PromptMode == promptModeMute || !mixing
+}
+
+// checkOpus 启动时检查混音器能否真正混音，不能时打一次警告（而不是每个房间一次），返回 false
+func checkOpus() bool {
+	if opusAvailable() {
+		return true
+	}
+	logger.Warn("built without opus (build with -tags opus and libopus), audio mixer falls back to passthrough: " +
+		"the blind user hears either the guide or a prompt, not both")
+	return false
+}
+
+// checkDuck 启动时检查 duck 能否生效：没有 Opus 编解码器时混音器只能直通，duck 会变成 mute，
+// 这时打警告，返回 false
+func (c *MixerConfig) checkDuck() bool {
+	if c.PromptMode != promptModeDuck || opusAvailable() {
+		return true
+	}
+	logger.Warn("mixer.promptMode is duck but no opus codec is available (build with -tags opus and libopus), " +
+		"volunteers are muted during prompts instead of ducked; set mixer.promptMode: mute to silence this warning")
+	return false
+}
+
+// opusAvailable 能否创建 Opus 编解码器，也就是混音器能否真正混音
+func opusAvailable() bool {
+	if newOpusEncoder == nil || newOpusDecoder == nil {
+		return false
+	}
+	encoder, err := newOpusEncoder()
+	if err != nil {
+		return false
+	}
+	encoder.Close()
+	return true
+}
+
+// opusDecoder 把一个 Opus 包解码成交错的 int16 PCM，返回每个声道的采样数
+type opusDecoder interface {
+	Decode(data []byte, pcm []int16) (int, error)
+	Close()
+}
+
+// opusEncoder 把一帧交错的 int16 PCM 编码成 Opus 包，返回包的长度
+type opusEncoder interface {
+	Encode(pcm []int16, data []byte) (int, error)
+	Close()
+}
+
+// 用 -tags opus 编译时由 opus_cgo.go 设置（需要 libopus），否则为 nil，混音器退化为直通
+var (
+	newOpusDecoder func() (opusDecoder, error)
+	newOpusEncoder func() (opusEncoder, error)
+)
+
+// mixerSource 是一路输入，混音模式下缓存解码后的 PCM，直通模式下缓存 RTP 包
+type mixerSource struct {
+	gain     float64
+	priority int
+	decoder  opusDecoder
+	pcm      []int16
+	packets  []*rtp.Packet
+}
+
+// 直通模式下同一时间只转发优先级最高的音源
+const (
+	priorityVolunteer = iota
+	priorityPrompt
+)
+
+// audioMixer 把志愿者的声音和提示音混成一路给盲人。
+// 每 20ms 输出一帧，序列号和时间戳都由混音器自己生成，不再依赖输入包。
+// 没有 Opus 编解码器时不能真正混音，只转发优先级最高的那一路（提示音优先），仍然保证输出的序列号和时间戳连续
+type audioMixer struct {
+	mu      sync.Mutex
+	sources map[string]*mixerSource
+	encoder opusEncoder
+	// mixing 在创建时确定，之后不再改变，读不需要 mu；close 之后 encoder 为 nil，但 mixing 不变
+	mixing bool
+
+	mix    []float64
+	pcm    []int16
+	opus   []byte
+	seq    uint16
+	ts     uint32
+	silent bool
+
+	// decoded 是 Push 的解码缓冲，按最长的 120ms Opus 帧准备，所有音源共用，持有 mu 时使用
+	decoded []int16
+
+	// ducking 为 true 时志愿者的声音逐渐压低到 DuckGain，duck 是当前的系数
+	ducking bool
+	duck    float64
+}
+
+func newAudioMixer() *audioMixer {
+	m := &audioMixer{
+		sources: make(map[string]*mixerSource),
+		mix:     make([]float64, mixerFrameLen),
+		pcm:     make([]int16, mixerFrameLen),
+		decoded: make([]int16, mixerFrameLen*6),
+		opus:    make([]byte, opusMaxPacket),
+		silent:  true,
+		duck:    1,
+	}
+	// 没有 Opus 编解码器时直通，启动时 checkOpus 已经警告过
+	if newOpusEncoder == nil || newOpusDecoder == nil {
+		return m
+	}
+	encoder, err := newOpusEncoder()
+	if err != nil {
+		logger.Errorf("create opus encoder: %v, audio mixer falls back to passthrough", err)
+		return m
+	}
+	m.encoder = encoder
+	m.mixing = true
+	return m
+}
+
+// Mixing 是否真正混音，false 为直通
+func (m *audioMixer) Mixing() bool {
+	return m.mixing
+}
+
+func (m *audioMixer) sourceLocked(id string) *mixerSource {
+	src, exists := m.sources[id]
+	if exists {
+		return src
+	}
+	src = &mixerSource{gain: config.Mixer.VolunteerGain, priority: priorityVolunteer}
+	if id == audioSourcePrompt {
+		src.gain, src.priority = config.Mixer.PromptGain, priorityPrompt
+	}
+	if m.encoder != nil {
+		decoder, err := newOpusDecoder()
+		if err != nil {
+			logger.Errorf("create opus decoder for %s: %v", id, err)
+		} else {
+			src.decoder = decoder
+		}
+	}
+	m.sources[id] = src
+	return src
+}
+
+// Push 收到某一路的一个 Opus RTP 包
+func (m *audioMixer) Push(id string, packet *rtp.Packet) {
+	if len(packet.Payload) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	src := m.sourceLocked(id)
+
+	if m.encoder == nil {
+		// 志愿者的包同时还在录制用的 samplebuilder 里，先复制一份
+		src.packets = append(src.packets, packet.Clone())
+		if len(src.packets) > mixerMaxQueue {
+			src.packets = src.packets[len(src.packets)-mixerMaxQueue:]
+		}
+		return
+	}
+	if src.decoder == nil {
+		return
+	}
+	n, err := src.decoder.Decode(packet.Payload, m.decoded)
+	if err != nil {
+		logger.Errorf("decode opus from %s: %v", id, err)
+		return
+	}
+	src.pcm = append(src.pcm, m.decoded[:n*mixerChannels]...)
+	if max := mixerFrameLen * mixerMaxQueue; len(src.pcm) > max {
+		src.pcm = src.pcm[len(src.pcm)-max:]
+	}
+}
+
+// SetGain 调整某一路的增益，音源还没有数据时也会记住
+func (m *audioMixer) SetGain(id string, gain float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sourceLocked(id).gain = gain
+}
+
+// SetDucking 提示音开始和结束时调用
+func (m *audioMixer) SetDucking(ducking bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ducking = ducking
+}
+
+// nextDuckLocked 按 attack/release 把 duck 向目标移动一帧的距离，返回这一帧开始和结束时的系数
+func (m *audioMixer) nextDuckLocked() (float64, float64) {
+	c := &config.Mixer
+	start, target := m.duck, 1.0
+	ramp := c.DuckRelease
+	if m.ducking && c.PromptMode == promptModeDuck {
+		target, ramp = c.DuckGain, c.DuckAttack
+	}
+	end := target
+	if ramp > 0 {
+		step := (1 - c.DuckGain) * float64(mixerFrameTime) / float64(ramp)
+		if start > target {
+			end = math.Max(target, start-step)
+		} else {
+			end = math.Min(target, start+step)
+		}
+	}
+	m.duck = end
+	return start, end
+}
+
+// RemoveSource 某一路不再有输入，比如志愿者离开
+func (m *audioMixer) RemoveSource(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if src, exists := m.sources[id]; exists {
+		if src.decoder != nil {
+			src.decoder.Close()
+		}
+		delete(m.sources, id)
+	}
+}
+
+// nextFrame 取出下一帧的 Opus 数据，所有音源都没有数据时返回 nil
+func (m *audioMixer) nextFrame() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.encoder == nil {
+		return m.passthroughLocked()
+	}
+	return m.mixLocked()
+}
+
+func (m *audioMixer) passthroughLocked() []byte {
+	var selected *mixerSource
+	for _, src := range m.sources {
+		if len(src.packets) > 0 && (selected == nil || src.priority > selected.priority) {
+			selected = src
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+	packet := selected.packets[0]
+	selected.packets = selected.packets[1:]
+	// 直通时被压下去的音源也要消耗掉同样时长的数据，否则它会越积越多
+	for _, src := range m.sources {
+		if src != selected && len(src.packets) > 0 {
+			src.packets = src.packets[1:]
+		}
+	}
+	return packet.Payload
+}
+
+func (m *audioMixer) mixLocked() []byte {
+	for i := range m.mix {
+		m.mix[i] = 0
+	}
+	active := false
+	duckStart, duckEnd := m.nextDuckLocked()
+	for _, src := range m.sources {
+		if len(src.pcm) < mixerFrameLen {
+			continue
+		}
+		active = true
+		if src.priority != priorityVolunteer {
+			for i, sample := range src.pcm[:mixerFrameLen] {
+				m.mix[i] += float64(sample) * src.gain
+			}
+		} else {
+			// 在一帧内线性过渡，避免增益跳变产生咔嗒声
+			for i, sample := range src.pcm[:mixerFrameLen] {
+				duck := duckStart + (duckEnd-duckStart)*float64(i/mixerChannels)/mixerFrameSamples
+				m.mix[i] += float64(sample) * src.gain * duck
+			}
+		}
+		src.pcm = src.pcm[mixerFrameLen:]
+	}
+	if !active {
+		return nil
+	}
+	for i, sample := range m.mix {
+		m.pcm[i] = clampInt16(sample)
+	}
+	n, err := m.encoder.Encode(m.pcm, m.opus)
+	if err != nil {
+		logger.Errorf("encode opus: %v", err)
+		return nil
+	}
+	return m.opus[:n]
+}
+
+func clampInt16(sample float64) int16 {
+	switch {
+	case sample > 32767:
+		return 32767
+	case sample < -32768:
+		return -32768
+	}
+	return int16(sample)
+}
+
+// Run 每 20ms 输出一帧，直到 ctx 结束。write 每次拿到的包只在本次调用内有效
+func (m *audioMixer) Run(ctx context.Context, payloadType uint8, write func(*rtp.Packet) error) {
+	ticker := time.NewTicker(mixerFrameTime)
+	defer ticker.Stop()
+	defer m.close()
+
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: payloadType}}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		payload := m.nextFrame()
+		// 没有声音时不发包，时间戳照常前进
+		m.ts += mixerFrameSamples
+		if payload == nil {
+			m.silent = true
+			continue
+		}
+		m.seq++
+		packet.SequenceNumber = m.seq
+		packet.Timestamp = m.ts
+		// 一段静音之后的第一个包带 marker
+		packet.Marker = m.silent
+		packet.Payload = payload
+		m.silent = false
+		if err := write(packet); err != nil && !isClosedPipe(err) {
+			logger.Errorf("write mixed audio: %v", err)
+		}
+	}
+}
+
+func (m *audioMixer) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, src := range m.sources {
+		if src.decoder != nil {
+			src.decoder.Close()
+		}
+		delete(m.sources, id)
+	}
+	if m.encoder != nil {
+		m.encoder.Close()
+		m.encoder = nil
+	}
+}
@@ -0,0 +1,119 @@
+//go:build opus && cgo
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// sineFrames 生成 n 帧双声道的正弦波
+func sineFrames(n int, freq float64, amplitude float64) [][]int16 {
+	frames := make([][]int16, n)
+	for i := range frames {
+		frame := make([]int16, mixerFrameLen)
+		for j := 0; j < mixerFrameSamples; j++ {
+			t := float64(i*mixerFrameSamples+j) / mixerSampleRate
+			sample := int16(amplitude * math.Sin(2*math.Pi*freq*t))
+			frame[j*mixerChannels], frame[j*mixerChannels+1] = sample, sample
+		}
+		frames[i] = frame
+	}
+	return frames
+}
+
+// encodeFrames 用 libopus 把 PCM 编码成 Opus 包，像客户端发来的一样
+func encodeFrames(t *testing.T, frames [][]int16) [][]byte {
+	t.Helper()
+	encoder, err := newOpusEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	packets := make([][]byte, len(frames))
+	for i, frame := range frames {
+		data := make([]byte, opusMaxPacket)
+		n, err := encoder.Encode(frame, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets[i] = data[:n]
+	}
+	return packets
+}
+
+// toneLevel 用 Goertzel 算法求左声道里 freq 的幅度
+func toneLevel(pcm []int16, freq float64) float64 {
+	coeff := 2 * math.Cos(2*math.Pi*freq/mixerSampleRate)
+	var s1, s2 float64
+	n := 0
+	for i := 0; i < len(pcm); i += mixerChannels {
+		s1, s2 = float64(pcm[i])+coeff*s1-s2, s1
+		n++
+	}
+	return 2 * math.Sqrt(s1*s1+s2*s2-coeff*s1*s2) / float64(n)
+}
+
+// mixThroughOpus 把两路编码后的正弦波交给混音器，解码混音器输出的 Opus 包，返回去掉开头几帧后的 PCM
+func mixThroughOpus(t *testing.T, promptGain float64) []int16 {
+	t.Helper()
+	setupTest(t)
+	config.Mixer.PromptGain = promptGain
+	m := newAudioMixer()
+	if !m.Mixing() {
+		t.Fatal("mixer built with opus is not mixing")
+	}
+	defer m.close()
+	decoder, err := newOpusDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+
+	const frames = 50
+	volunteer := encodeFrames(t, sineFrames(frames, 440, 8000))
+	prompt := encodeFrames(t, sineFrames(frames, 1000, 8000))
+	var out []int16
+	pcm := make([]int16, mixerFrameLen*6)
+	for i := 0; i < frames; i++ {
+		m.Push(volunteerSource("a"), testPacket(volunteer[i]...))
+		m.Push(audioSourcePrompt, testPacket(prompt[i]...))
+		frame := m.nextFrame()
+		if frame == nil {
+			t.Fatalf("no output for frame %d", i)
+		}
+		n, err := decoder.Decode(frame, pcm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != mixerFrameSamples {
+			t.Fatalf("decoded %d samples, want %d", n, mixerFrameSamples)
+		}
+		// 跳过编解码器刚启动的几帧
+		if i >= 5 {
+			out = append(out, pcm[:n*mixerChannels]...)
+		}
+	}
+	return out
+}
+
+func TestOpusMixKnownVector(t *testing.T) {
+	out := mixThroughOpus(t, 1)
+	// 两路都在，幅度接近输入的 8000，不相关的频率上几乎没有能量
+	for _, freq := range []float64{440, 1000} {
+		if level := toneLevel(out, freq); level < 6000 || level > 10000 {
+			t.Fatalf("%vHz level %.0f, want about 8000", freq, level)
+		}
+	}
+	if level := toneLevel(out, 3000); level > 500 {
+		t.Fatalf("3000Hz level %.0f, want silence", level)
+	}
+}
+
+func TestOpusMixPromptGain(t *testing.T) {
+	out := mixThroughOpus(t, 0.25)
+	volunteer, prompt := toneLevel(out, 440), toneLevel(out, 1000)
+	if ratio := prompt / volunteer; ratio < 0.15 || ratio > 0.35 {
+		t.Fatalf("prompt/volunteer level %.2f, want about 0.25", ratio)
+	}
+}
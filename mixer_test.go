@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// fakeOpusDecoder 把 4 字节的包（左右声道各一个 int16）解码成一整帧同样的采样，不需要 libopus
+type fakeOpusDecoder struct{}
+
+func fakeOpusPacket(left, right int16) []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint16(data, uint16(left))
+	binary.LittleEndian.PutUint16(data[2:], uint16(right))
+	return data
+}
+
+func (fakeOpusDecoder) Decode(data []byte, pcm []int16) (int, error) {
+	left, right := int16(binary.LittleEndian.Uint16(data)), int16(binary.LittleEndian.Uint16(data[2:]))
+	for i := 0; i < mixerFrameLen; i += mixerChannels {
+		pcm[i], pcm[i+1] = left, right
+	}
+	return mixerFrameSamples, nil
+}
+
+func (fakeOpusDecoder) Close() {}
+
+// fakeOpusEncoder 记下每一帧混出来的 PCM
+type fakeOpusEncoder struct {
+	mu     sync.Mutex
+	frames [][]int16
+}
+
+func (e *fakeOpusEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.frames = append(e.frames, append([]int16(nil), pcm...))
+	data[0] = byte(len(e.frames))
+	return 1, nil
+}
+
+func (e *fakeOpusEncoder) Close() {}
+
+// useFakeOpus 让之后创建的混音器用假的编解码器混音，测试结束后恢复
+func useFakeOpus(t *testing.T) {
+	decoder, encoder := newOpusDecoder, newOpusEncoder
+	t.Cleanup(func() {
+		newOpusDecoder, newOpusEncoder = decoder, encoder
+	})
+	newOpusDecoder = func() (opusDecoder, error) { return fakeOpusDecoder{}, nil }
+	newOpusEncoder = func() (opusEncoder, error) { return &fakeOpusEncoder{}, nil }
+}
+
+// withoutOpus 让之后创建的混音器是直通的，和不带 -tags opus 编译时一样
+func withoutOpus(t *testing.T) {
+	decoder, encoder := newOpusDecoder, newOpusEncoder
+	t.Cleanup(func() {
+		newOpusDecoder, newOpusEncoder = decoder, encoder
+	})
+	newOpusDecoder, newOpusEncoder = nil, nil
+}
+
+func testPacket(payload ...byte) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: promptPayloadType}, Payload: payload}
+}
+
+func TestMixerPassthroughPrefersPrompt(t *testing.T) {
+	setupTest(t)
+	withoutOpus(t)
+	m := newAudioMixer()
+	if m.Mixing() {
+		t.Fatal("mixer without opus is mixing")
+	}
+	if frame := m.nextFrame(); frame != nil {
+		t.Fatalf("frame %v from an empty mixer", frame)
+	}
+
+	for i := byte(1); i <= 3; i++ {
+		m.Push(volunteerSource("a"), testPacket(i))
+	}
+	m.Push(audioSourcePrompt, testPacket(101))
+	m.Push(audioSourcePrompt, testPacket(102))
+	// 提示音期间志愿者的包按同样的时长被丢掉
+	var got []byte
+	for frame := m.nextFrame(); frame != nil; frame = m.nextFrame() {
+		got = append(got, frame...)
+	}
+	if want := []byte{101, 102, 3}; string(got) != string(want) {
+		t.Fatalf("frames %v, want %v", got, want)
+	}
+}
+
+func TestMixerPassthroughQueue(t *testing.T) {
+	setupTest(t)
+	withoutOpus(t)
+	m := newAudioMixer()
+
+	packet := testPacket(0)
+	for i := byte(1); i <= mixerMaxQueue+5; i++ {
+		packet.Payload[0] = i
+		// 同一个包被改写后再推，混音器里的必须是推入时的副本
+		m.Push(volunteerSource("a"), packet)
+	}
+	m.Push(volunteerSource("a"), testPacket())
+	var got []byte
+	for frame := m.nextFrame(); frame != nil; frame = m.nextFrame() {
+		got = append(got, frame...)
+	}
+	if len(got) != mixerMaxQueue || got[0] != 6 || got[len(got)-1] != mixerMaxQueue+5 {
+		t.Fatalf("frames %v, want the last %d packets", got, mixerMaxQueue)
+	}
+}
+
+func TestMixerRunSequence(t *testing.T) {
+	setupTest(t)
+	withoutOpus(t)
+	m := newAudioMixer()
+
+	type written struct {
+		seq    uint16
+		ts     uint32
+		marker bool
+	}
+	out := make(chan written, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx, promptPayloadType, func(packet *rtp.Packet) error {
+			out <- written{packet.SequenceNumber, packet.Timestamp, packet.Marker}
+			return nil
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// 两路交错输入、中间一段静音，输出的序列号连续，时间戳按 20ms 前进
+	m.Push(volunteerSource("a"), testPacket(1))
+	m.Push(audioSourcePrompt, testPacket(2))
+	first := <-out
+	time.Sleep(5 * mixerFrameTime)
+	m.Push(volunteerSource("a"), testPacket(3))
+	m.Push(volunteerSource("a"), testPacket(4))
+	second, third := <-out, <-out
+
+	if !first.marker || !second.marker || third.marker {
+		t.Fatalf("markers %v %v %v, want a marker after each silence", first.marker, second.marker, third.marker)
+	}
+	if second.seq != first.seq+1 || third.seq != second.seq+1 {
+		t.Fatalf("sequence numbers %d %d %d", first.seq, second.seq, third.seq)
+	}
+	if gap := second.ts - first.ts; gap < 2*mixerFrameSamples || gap%mixerFrameSamples != 0 {
+		t.Fatalf("timestamp gap %d over the silence", gap)
+	}
+	if third.ts-second.ts != mixerFrameSamples {
+		t.Fatalf("timestamp step %d, want %d", third.ts-second.ts, mixerFrameSamples)
+	}
+}
+
+func TestMixerMixesWithGains(t *testing.T) {
+	setupTest(t)
+	useFakeOpus(t)
+	config.Mixer.PromptGain = 0.5
+	m := newAudioMixer()
+	if !m.Mixing() {
+		t.Fatal("mixer with a codec is not mixing")
+	}
+	encoder := m.encoder.(*fakeOpusEncoder)
+
+	m.Push(volunteerSource("a"), testPacket(fakeOpusPacket(1000, -1000)...))
+	m.Push(audioSourcePrompt, testPacket(fakeOpusPacket(2000, 2000)...))
+	m.nextFrame()
+	// 超出 int16 的部分被截断，不会回绕
+	m.Push(volunteerSource("a"), testPacket(fakeOpusPacket(30000, -30000)...))
+	m.Push(volunteerSource("b"), testPacket(fakeOpusPacket(30000, -30000)...))
+	m.nextFrame()
+	if frame := m.nextFrame(); frame != nil {
+		t.Fatalf("frame %v after all sources are drained", frame)
+	}
+
+	want := [][2]int16{{2000, 0}, {32767, -32768}}
+	if len(encoder.frames) != len(want) {
+		t.Fatalf("%d frames, want %d", len(encoder.frames), len(want))
+	}
+	for i, frame := range encoder.frames {
+		for j := 0; j < mixerFrameLen; j += mixerChannels {
+			if frame[j] != want[i][0] || frame[j+1] != want[i][1] {
+				t.Fatalf("frame %d sample %d is %d/%d, want %v", i, j/mixerChannels, frame[j], frame[j+1], want[i])
+			}
+		}
+	}
+}
+
+func TestMixerDuckRamp(t *testing.T) {
+	setupTest(t)
+	useFakeOpus(t)
+	config.Mixer.DuckGain = 0.25
+	config.Mixer.DuckAttack = 3 * mixerFrameTime
+	config.Mixer.DuckRelease = 15 * mixerFrameTime
+	m := newAudioMixer()
+
+	// steps 走 n 帧，每一帧从上一帧结束的位置开始，返回每帧结束时的系数
+	previous := 1.0
+	steps := func(n int) []float64 {
+		var ends []float64
+		for i := 0; i < n; i++ {
+			start, end := m.nextDuckLocked()
+			if start != previous {
+				t.Fatalf("frame starts at %v, previous frame ended at %v", start, previous)
+			}
+			previous = end
+			ends = append(ends, math.Round(end*1000)/1000)
+		}
+		return ends
+	}
+	if got := steps(2); fmt.Sprint(got) != "[1 1]" {
+		t.Fatalf("without prompt %v", got)
+	}
+	// attack：3 帧内降到 duckGain，之后保持
+	m.SetDucking(true)
+	if got := steps(5); fmt.Sprint(got) != "[0.75 0.5 0.25 0.25 0.25]" {
+		t.Fatalf("attack %v", got)
+	}
+	// release：15 帧内恢复到 1
+	m.SetDucking(false)
+	got := steps(16)
+	if got[0] != 0.3 || got[13] != 0.95 || got[14] != 1 || got[15] != 1 {
+		t.Fatalf("release %v", got)
+	}
+
+	// 提示音在 release 途中又开始时从当前位置压下去，不会跳变
+	steps(5)
+	m.SetDucking(true)
+	steps(1)
+	m.SetDucking(false)
+	if got := steps(1); got[0] != 0.8 {
+		t.Fatalf("release after a short prompt %v", got)
+	}
+
+	// attack 为 0 时立即压低；mute 模式下混音器不 duck（志愿者的包在进混音器之前就被丢掉）
+	config.Mixer.DuckAttack = 0
+	m.SetDucking(true)
+	if got := steps(1); got[0] != 0.25 {
+		t.Fatalf("zero attack %v", got)
+	}
+	config.Mixer.PromptMode = promptModeMute
+	config.Mixer.DuckRelease = 0
+	if got := steps(1); got[0] != 1 {
+		t.Fatalf("mute mode %v", got)
+	}
+}
+
+func TestMixerDuckWithinFrame(t *testing.T) {
+	setupTest(t)
+	useFakeOpus(t)
+	config.Mixer.DuckGain = 0
+	config.Mixer.DuckAttack = mixerFrameTime
+	m := newAudioMixer()
+	encoder := m.encoder.(*fakeOpusEncoder)
+
+	// 一帧内从 1 线性降到 0，提示音本身不受影响
+	m.SetDucking(true)
+	m.Push(volunteerSource("a"), testPacket(fakeOpusPacket(1000, 1000)...))
+	m.Push(audioSourcePrompt, testPacket(fakeOpusPacket(100, 100)...))
+	m.nextFrame()
+	frame := encoder.frames[0]
+	first, middle, last := frame[0], frame[mixerFrameLen/2], frame[mixerFrameLen-mixerChannels]
+	if first != 1100 || middle != 600 || last > 102 {
+		t.Fatalf("ducked frame starts at %d, is %d in the middle and ends at %d", first, middle, last)
+	}
+}
+
+func TestMixerCheckDuck(t *testing.T) {
+	setupTest(t)
+	withoutOpus(t)
+	if checkOpus() {
+		t.Fatal("mixing is usable without opus")
+	}
+	if config.Mixer.checkDuck() {
+		t.Fatal("duck is usable without opus")
+	}
+	config.Mixer.PromptMode = promptModeMute
+	if !config.Mixer.checkDuck() {
+		t.Fatal("mute is reported as unusable")
+	}
+
+	useFakeOpus(t)
+	config.Mixer.PromptMode = promptModeDuck
+	if !checkOpus() || !config.Mixer.checkDuck() {
+		t.Fatal("duck is unusable with opus")
+	}
+}
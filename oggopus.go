@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Ogg/Opus 解封装（RFC 3533、RFC 7845），只取出 Opus 包，不解码
+
+var (
+	errNotOggOpus = errors.New("not an Ogg/Opus stream")
+	errBadOggPage = errors.New("bad Ogg page")
+)
+
+const (
+	oggPageHeaderLen = 27
+	oggContinued     = 0x01
+)
+
+// oggCRCTable 是 Ogg page 校验和的查找表：多项式 0x04c11db7，不反转，初值和结果都不异或
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+func oggCRC(crc uint32, b []byte) uint32 {
+	for _, v := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// opusHead 是 OpusHead 里播放需要的字段
+type opusHead struct {
+	Channels   uint8
+	PreSkip    uint16
+	SampleRate uint32
+}
+
+// oggOpusStream 是解封装后的 Opus 包，每个包是 RTP 的一个 payload
+type oggOpusStream struct {
+	Head    opusHead
+	Packets [][]byte
+	// Durations 是每个包的时长，单位是 48kHz 采样
+	Durations []int
+}
+
+// Duration 返回整段音频的时长
+func (s *oggOpusStream) Duration() time.Duration {
+	samples := 0
+	for _, d := range s.Durations {
+		samples += d
+	}
+	return time.Duration(samples) * time.Second / 48000
+}
+
+// oggPacketReader 按 segment table 把 Ogg page 拼回完整的包，跨 page 的包也会拼起来
+type oggPacketReader struct {
+	r       *bufio.Reader
+	serial  uint32
+	started bool
+	segs    []byte
+	payload []byte
+	pending []byte
+}
+
+func newOggPacketReader(r io.Reader) *oggPacketReader {
+	return &oggPacketReader{r: bufio.NewReader(r)}
+}
+
+func (o *oggPacketReader) readPage() error {
+	header := make([]byte, oggPageHeaderLen)
+	if _, err := io.ReadFull(o.r, header); err != nil {
+		return err
+	}
+	if string(header[:4]) != "OggS" || header[4] != 0 {
+		return errBadOggPage
+	}
+	serial := binary.LittleEndian.Uint32(header[14:18])
+	if !o.started {
+		o.serial, o.started = serial, true
+	} else if serial != o.serial {
+		return fmt.Errorf("%w: multiplexed streams are not supported", errBadOggPage)
+	}
+	if header[5]&oggContinued == 0 && len(o.pending) > 0 {
+		// 上一个包没有结束就开始了新的包，丢掉残缺的部分
+		o.pending = nil
+	}
+
+	o.segs = make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, o.segs); err != nil {
+		return err
+	}
+	size := 0
+	for _, s := range o.segs {
+		size += int(s)
+	}
+	o.payload = make([]byte, size)
+	if _, err := io.ReadFull(o.r, o.payload); err != nil {
+		return err
+	}
+
+	// 校验和按 CRC 字段为 0 计算
+	want := binary.LittleEndian.Uint32(header[22:26])
+	binary.LittleEndian.PutUint32(header[22:26], 0)
+	crc := oggCRC(oggCRC(oggCRC(0, header), o.segs), o.payload)
+	if crc != want {
+		return fmt.Errorf("%w: crc %08x, want %08x", errBadOggPage, crc, want)
+	}
+	return nil
+}
+
+// Next 返回下一个完整的包，读完时返回 io.EOF
+func (o *oggPacketReader) Next() ([]byte, error) {
+	for {
+		for len(o.segs) > 0 {
+			n := int(o.segs[0])
+			o.segs = o.segs[1:]
+			o.pending = append(o.pending, o.payload[:n]...)
+			o.payload = o.payload[n:]
+			// lacing 值小于 255 表示包结束
+			if n < 255 {
+				packet := o.pending
+				o.pending = nil
+				return packet, nil
+			}
+		}
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readOggOpus 读出整个 Ogg/Opus 文件的 Opus 包，不是 Opus 编码时返回 errNotOggOpus
+func readOggOpus(r io.Reader) (*oggOpusStream, error) {
+	reader := newOggPacketReader(r)
+
+	head, err := reader.Next()
+	if err != nil {
+		if errors.Is(err, errBadOggPage) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, errNotOggOpus
+		}
+		return nil, err
+	}
+	if len(head) < 19 || !bytes.HasPrefix(head, []byte("OpusHead")) {
+		return nil, errNotOggOpus
+	}
+	// 主版本号（高 4 位）不是 0 的格式不兼容
+	if head[8]>>4 != 0 || head[9] == 0 {
+		return nil, fmt.Errorf("%w: OpusHead version %d, %d channels", errNotOggOpus, head[8], head[9])
+	}
+	stream := &oggOpusStream{Head: opusHead{
+		Channels:   head[9],
+		PreSkip:    binary.LittleEndian.Uint16(head[10:12]),
+		SampleRate: binary.LittleEndian.Uint32(head[12:16]),
+	}}
+
+	tags, err := reader.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(tags, []byte("OpusTags")) {
+		return nil, fmt.Errorf("%w: missing OpusTags", errBadOggPage)
+	}
+
+	for {
+		packet, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(packet) == 0 {
+			continue
+		}
+		samples, err := opusPacketSamples(packet)
+		if err != nil {
+			return nil, err
+		}
+		stream.Packets = append(stream.Packets, packet)
+		stream.Durations = append(stream.Durations, samples)
+	}
+	if len(stream.Packets) == 0 {
+		return nil, fmt.Errorf("%w: no audio packets", errBadOggPage)
+	}
+	return stream, nil
+}
+
+// opusFrameSamples 按 TOC 的 config（RFC 6716 3.1）返回每帧 48kHz 的采样数
+func opusFrameSamples(config byte) int {
+	switch {
+	case config < 12: // SILK 10/20/40/60ms
+		return []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid 10/20ms
+		return []int{480, 960}[config%2]
+	default: // CELT 2.5/5/10/20ms
+		return []int{120, 240, 480, 960}[config%4]
+	}
+}
+
+// opusPacketSamples 返回一个 Opus 包的时长（48kHz 采样数）
+func opusPacketSamples(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, errors.New("empty opus packet")
+	}
+	toc := packet[0]
+	frameSamples := opusFrameSamples(toc >> 3)
+	frames := 0
+	switch toc & 0x03 {
+	case 0:
+		frames = 1
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errors.New("opus packet is too short")
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	samples := frames * frameSamples
+	if frames == 0 || samples > 5760 { // 最长 120ms
+		return 0, fmt.Errorf("invalid opus packet, %d frames", frames)
+	}
+	return samples, nil
+}
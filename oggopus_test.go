@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// oggTestStream 把包按 lacing 拼成 Ogg page，每个 page 最多 maxSegs 个 segment，长包会跨 page
+func oggTestStream(maxSegs int, packets ...[]byte) []byte {
+	var out bytes.Buffer
+	var segs []byte
+	var payload []byte
+	seq := uint32(0)
+	continued := false
+	flush := func(nextContinued bool) {
+		header := make([]byte, oggPageHeaderLen)
+		copy(header, "OggS")
+		if continued {
+			header[5] = oggContinued
+		}
+		if seq == 0 {
+			header[5] |= 0x02
+		}
+		binary.LittleEndian.PutUint32(header[14:18], 0x1234)
+		binary.LittleEndian.PutUint32(header[18:22], seq)
+		header[26] = byte(len(segs))
+		crc := oggCRC(oggCRC(oggCRC(0, header), segs), payload)
+		binary.LittleEndian.PutUint32(header[22:26], crc)
+		out.Write(header)
+		out.Write(segs)
+		out.Write(payload)
+		segs, payload = nil, nil
+		seq++
+		continued = nextContinued
+	}
+	for _, packet := range packets {
+		rest := packet
+		for {
+			n := len(rest)
+			if n > 255 {
+				n = 255
+			}
+			if len(segs) == maxSegs {
+				flush(true)
+			}
+			segs = append(segs, byte(n))
+			payload = append(payload, rest[:n]...)
+			rest = rest[n:]
+			// 长度正好是 255 的倍数时用一个 0 结束
+			if n < 255 {
+				break
+			}
+		}
+		if len(segs) == maxSegs {
+			flush(false)
+		}
+	}
+	if len(segs) > 0 {
+		flush(false)
+	}
+	return out.Bytes()
+}
+
+func testOpusHead(version, channels byte) []byte {
+	head := []byte("OpusHead")
+	head = append(head, version, channels)
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	return append(head, 0, 0, 0)
+}
+
+func testOpusTags() []byte {
+	tags := []byte("OpusTags")
+	tags = binary.LittleEndian.AppendUint32(tags, 4)
+	tags = append(tags, "test"...)
+	return binary.LittleEndian.AppendUint32(tags, 0)
+}
+
+// testOpusPacket 是一帧 CELT 的 Opus 包，config 31 是 20ms，30 是 10ms
+func testOpusPacket(config byte, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = config << 3
+	for i := 1; i < size; i++ {
+		packet[i] = byte(i)
+	}
+	return packet
+}
+
+func TestReadOggOpusFiles(t *testing.T) {
+	files, _ := filepath.Glob("audio/zh/*.ogg")
+	if len(files) == 0 {
+		t.Fatal("no prompt recordings in audio/zh")
+	}
+	for _, file := range files {
+		clip, err := loadPromptClip(filepath.Base(file), file)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if len(clip.Packets) == 0 || clip.Duration <= 0 {
+			t.Errorf("%s: %d packets, %v", file, len(clip.Packets), clip.Duration)
+		}
+	}
+}
+
+func TestOggPacketsAcrossPages(t *testing.T) {
+	packets := [][]byte{
+		testOpusPacket(31, 10),
+		testOpusPacket(31, 600), // 255+255+90，跨三个 page
+		testOpusPacket(31, 255), // 255+0
+		testOpusPacket(31, 3),
+	}
+	data := oggTestStream(2, append([][]byte{testOpusHead(1, 2), testOpusTags()}, packets...)...)
+	stream, err := readOggOpus(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Head.Channels != 2 || stream.Head.PreSkip != 312 || stream.Head.SampleRate != 48000 {
+		t.Fatalf("head %+v", stream.Head)
+	}
+	if len(stream.Packets) != len(packets) {
+		t.Fatalf("%d packets, want %d", len(stream.Packets), len(packets))
+	}
+	for i, packet := range packets {
+		if !bytes.Equal(stream.Packets[i], packet) {
+			t.Fatalf("packet %d is %d bytes, want %d", i, len(stream.Packets[i]), len(packet))
+		}
+		if stream.Durations[i] != mixerFrameSamples {
+			t.Fatalf("packet %d is %d samples", i, stream.Durations[i])
+		}
+	}
+}
+
+func TestReadOggOpusCorrupt(t *testing.T) {
+	real, err := os.ReadFile("audio/zh/ting.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(offset int) []byte {
+		data := bytes.Clone(real)
+		data[offset] ^= 0xff
+		return data
+	}
+	valid := func(packets ...[]byte) []byte {
+		return oggTestStream(255, append([][]byte{testOpusHead(1, 2), testOpusTags()}, packets...)...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, errNotOggOpus},
+		{"truncated header", real[:10], errNotOggOpus},
+		{"truncated page", real[:len(real)-10], nil},
+		{"bad crc in head", corrupt(oggPageHeaderLen + 2), errNotOggOpus},
+		{"bad crc in audio", corrupt(len(real) - 1), errBadOggPage},
+		{"not opus", oggTestStream(255, []byte("\x01vorbis-head-packet-")), errNotOggOpus},
+		{"zero channels", oggTestStream(255, testOpusHead(1, 0), testOpusTags(), testOpusPacket(31, 10)), errNotOggOpus},
+		{"unknown version", oggTestStream(255, testOpusHead(0x10, 2), testOpusTags(), testOpusPacket(31, 10)), errNotOggOpus},
+		{"missing tags", oggTestStream(255, testOpusHead(1, 2), testOpusPacket(31, 10)), errBadOggPage},
+		{"no audio", valid(), errBadOggPage},
+		{"zero frames", valid([]byte{31<<3 | 3, 0}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readOggOpus(bytes.NewReader(tt.data))
+			if err == nil {
+				t.Fatal("corrupt stream is accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPromptClipFormat(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"mono", oggTestStream(255, testOpusHead(1, 1), testOpusTags(), testOpusPacket(31, 10)), "channels"},
+		{"10ms frames", oggTestStream(255, testOpusHead(1, 2), testOpusTags(), testOpusPacket(30, 10)), "opus frame"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "clip.ogg")
+			if err := os.WriteFile(file, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadPromptClip("clip", file); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+//go:build opus && cgo
+
+package main
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+static int blinder_opus_set_bitrate(OpusEncoder *enc, opus_int32 bitrate) {
+	return opus_encoder_ctl(enc, OPUS_SET_BITRATE(bitrate));
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// 用 go build -tags opus 编译时通过 libopus 真正混音，需要先安装 libopus-dev（pkg-config 能找到 opus）
+
+func init() {
+	newOpusDecoder = func() (opusDecoder, error) {
+		var e C.int
+		dec := C.opus_decoder_create(mixerSampleRate, mixerChannels, &e)
+		if e != C.OPUS_OK {
+			return nil, opusError(e)
+		}
+		return &cgoOpusDecoder{dec: dec}, nil
+	}
+	newOpusEncoder = func() (opusEncoder, error) {
+		var e C.int
+		enc := C.opus_encoder_create(mixerSampleRate, mixerChannels, C.OPUS_APPLICATION_VOIP, &e)
+		if e != C.OPUS_OK {
+			return nil, opusError(e)
+		}
+		if e = C.blinder_opus_set_bitrate(enc, 64000); e != C.OPUS_OK {
+			C.opus_encoder_destroy(enc)
+			return nil, opusError(e)
+		}
+		return &cgoOpusEncoder{enc: enc}, nil
+	}
+}
+
+func opusError(code C.int) error {
+	return fmt.Errorf("opus: %s", C.GoString(C.opus_strerror(code)))
+}
+
+type cgoOpusDecoder struct {
+	dec *C.OpusDecoder
+}
+
+func (d *cgoOpusDecoder) Decode(data []byte, pcm []int16) (int, error) {
+	if len(data) == 0 || len(pcm) < mixerChannels {
+		return 0, errors.New("opus: empty buffer")
+	}
+	n := C.opus_decode(d.dec, (*C.uchar)(unsafe.Pointer(&data[0])), C.opus_int32(len(data)),
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/mixerChannels), 0)
+	if n < 0 {
+		return 0, opusError(n)
+	}
+	return int(n), nil
+}
+
+func (d *cgoOpusDecoder) Close() {
+	C.opus_decoder_destroy(d.dec)
+}
+
+type cgoOpusEncoder struct {
+	enc *C.OpusEncoder
+}
+
+func (e *cgoOpusEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	if len(pcm) != mixerFrameLen || len(data) == 0 {
+		return 0, errors.New("opus: bad frame size")
+	}
+	n := C.opus_encode(e.enc, (*C.opus_int16)(unsafe.Pointer(&pcm[0])), mixerFrameSamples,
+		(*C.uchar)(unsafe.Pointer(&data[0])), C.opus_int32(len(data)))
+	if n < 0 {
+		return 0, opusError(n)
+	}
+	return int(n), nil
+}
+
+func (e *cgoOpusEncoder) Close() {
+	C.opus_encoder_destroy(e.enc)
+}
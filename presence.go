@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"yanglei_blinder/logger"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// 志愿者的在线状态，断开连接后推一次 offline 然后不再出现
+const (
+	presenceAvailable = "available"
+	presenceBusy      = "busy"
+	presenceAway      = "away"
+	presenceOffline   = "offline"
+)
+
+// VolunteerInfo 是志愿者的在线状态，/api/volunteers 和 presence 事件里都是它
+type VolunteerInfo struct {
+	UserID string `json:"userId"`
+	State  string `json:"state"`
+	// Since 进入当前状态的时间，派单时空闲最久的优先
+	Since     time.Time `json:"since"`
+	Languages []string  `json:"languages"`
+	Skills    []string  `json:"skills"`
+	// RoomName 是 busy 时所在的房间
+	RoomName    string    `json:"roomName,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+}
+
+// presenceEvent 推给订阅了在线状态的连接
+type presenceEvent struct {
+	Type      string        `json:"type"`
+	Volunteer VolunteerInfo `json:"volunteer"`
+}
+
+// presenceSnapshot 是订阅时的全量状态
+type presenceSnapshot struct {
+	Type       string          `json:"type"`
+	Volunteers []VolunteerInfo `json:"volunteers"`
+}
+
+// volunteersReply 是 /api/volunteers 的应答
+type volunteersReply struct {
+	Available  int             `json:"available"`
+	Busy       int             `json:"busy"`
+	Away       int             `json:"away"`
+	Volunteers []VolunteerInfo `json:"volunteers"`
+}
+
+type volunteerPresence struct {
+	session *wsSession
+	info    VolunteerInfo
+
+	// callPC 是 busy 时志愿者的 PeerConnection，它关闭后回到 stateBeforeCall
+	callPC          *webrtc.PeerConnection
+	stateBeforeCall string
+}
+
+// PresenceService 记录在线志愿者的状态（available、busy、away）、语言和技能，
+// 状态变化时推给订阅者，有志愿者变成 available 时交给 Dispatch 呼叫等待中的求助
+type PresenceService struct {
+	mu         sync.Mutex
+	volunteers map[*wsSession]*volunteerPresence
+	watchers   map[*wsSession]struct{}
+	// deliverMu 在释放 mu 之前拿到，消息在锁外发送，但仍然按状态变化的顺序
+	deliverMu sync.Mutex
+}
+
+func NewPresenceService() *PresenceService {
+	return &PresenceService{
+		volunteers: make(map[*wsSession]*volunteerPresence),
+		watchers:   make(map[*wsSession]struct{}),
+	}
+}
+
+// unlockAndDeliver 释放 mu 后发送消息，订阅者收到的顺序和状态变化的顺序一致
+func (p *PresenceService) unlockAndDeliver(messages []outgoing) {
+	p.deliverMu.Lock()
+	p.mu.Unlock()
+	deliver(messages)
+	p.deliverMu.Unlock()
+}
+
+// eventLocked 生成推给所有订阅者的消息
+func (p *PresenceService) eventLocked(info VolunteerInfo) []outgoing {
+	messages := make([]outgoing, 0, len(p.watchers))
+	for watcher := range p.watchers {
+		messages = append(messages, outgoing{watcher, presenceEvent{Type: "presence", Volunteer: info}})
+	}
+	return messages
+}
+
+func (v *volunteerPresence) setState(state string, roomName string) {
+	v.info.State = state
+	v.info.RoomName = roomName
+	v.info.Since = time.Now()
+}
+
+// SetAvailability 志愿者登记为 available 或 away，并更新语言和技能，busy 时只更新通话结束后回到的状态
+func (p *PresenceService) SetAvailability(session *wsSession, userID string, state string, languages []string, skills []string) {
+	p.mu.Lock()
+	v, exists := p.volunteers[session]
+	if !exists {
+		v = &volunteerPresence{session: session, info: VolunteerInfo{UserID: userID, ConnectedAt: time.Now(), Languages: []string{}, Skills: []string{}}}
+		p.volunteers[session] = v
+	}
+	v.info.UserID = userID
+	if languages != nil {
+		v.info.Languages = languages
+	}
+	if skills != nil {
+		v.info.Skills = skills
+	}
+	becameAvailable := false
+	if v.info.State == presenceBusy {
+		v.stateBeforeCall = state
+	} else if v.info.State != state {
+		becameAvailable = state == presenceAvailable
+		v.setState(state, "")
+	}
+	messages := p.eventLocked(v.info)
+	logger.Infof("volunteer %s is %s", userID, state)
+	p.unlockAndDeliver(messages)
+
+	if becameAvailable {
+		Dispatch.VolunteerAvailable(session)
+	}
+}
+
+// JoinedCall 志愿者加入了房间，pc 关闭后恢复原来的状态
+func (p *PresenceService) JoinedCall(session *wsSession, userID string, roomName string, pc *webrtc.PeerConnection) {
+	p.mu.Lock()
+	v, exists := p.volunteers[session]
+	if !exists {
+		// 没有登记过的志愿者直接 join，通话结束后不再出现在列表里
+		v = &volunteerPresence{session: session, info: VolunteerInfo{UserID: userID, ConnectedAt: time.Now(), Languages: []string{}, Skills: []string{}}}
+		p.volunteers[session] = v
+	} else if v.info.State != presenceBusy {
+		v.stateBeforeCall = v.info.State
+	}
+	v.callPC = pc
+	v.setState(presenceBusy, roomName)
+	messages := p.eventLocked(v.info)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			p.leftCall(session, pc)
+		}
+	})
+	p.unlockAndDeliver(messages)
+}
+
+// leftCall 志愿者的 PeerConnection 关闭，如果它还是当前的通话就恢复原来的状态
+func (p *PresenceService) leftCall(session *wsSession, pc *webrtc.PeerConnection) {
+	p.mu.Lock()
+	v, exists := p.volunteers[session]
+	if !exists || v.callPC != pc {
+		p.mu.Unlock()
+		return
+	}
+	v.callPC = nil
+	var info VolunteerInfo
+	if len(v.stateBeforeCall) == 0 {
+		delete(p.volunteers, session)
+		info = v.info
+		info.State = presenceOffline
+		info.RoomName = ""
+	} else {
+		v.setState(v.stateBeforeCall, "")
+		info = v.info
+	}
+	messages := p.eventLocked(info)
+	p.unlockAndDeliver(messages)
+
+	if info.State == presenceAvailable {
+		Dispatch.VolunteerAvailable(session)
+	}
+}
+
+// Remove 连接断开
+func (p *PresenceService) Remove(session *wsSession) {
+	p.mu.Lock()
+	delete(p.watchers, session)
+	v, exists := p.volunteers[session]
+	if !exists {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.volunteers, session)
+	info := v.info
+	info.State = presenceOffline
+	info.RoomName = ""
+	messages := p.eventLocked(info)
+	logger.Infof("volunteer %s is offline", info.UserID)
+	p.unlockAndDeliver(messages)
+}
+
+// availableVolunteer 是一个 available 的志愿者和它登记的语言、技能
+type availableVolunteer struct {
+	session *wsSession
+	info    VolunteerInfo
+}
+
+// Available 返回 available 的志愿者，空闲最久的在前
+func (p *PresenceService) Available() []availableVolunteer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	available := make([]availableVolunteer, 0, len(p.volunteers))
+	for _, v := range p.volunteers {
+		if v.info.State == presenceAvailable {
+			available = append(available, availableVolunteer{session: v.session, info: v.info})
+		}
+	}
+	sort.Slice(available, func(i, j int) bool { return available[i].info.Since.Before(available[j].info.Since) })
+	return available
+}
+
+// List 按用户 ID 排序返回所有在线志愿者
+func (p *PresenceService) List() []VolunteerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.listLocked()
+}
+
+func (p *PresenceService) listLocked() []VolunteerInfo {
+	list := make([]VolunteerInfo, 0, len(p.volunteers))
+	for _, v := range p.volunteers {
+		list = append(list, v.info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UserID < list[j].UserID })
+	return list
+}
+
+// Watch 订阅在线状态，先推一次全量，之后推每次变化，连接断开时自动取消
+func (p *PresenceService) Watch(session *wsSession) error {
+	p.mu.Lock()
+	p.watchers[session] = struct{}{}
+	snapshot := presenceSnapshot{Type: "presenceSnapshot", Volunteers: p.listLocked()}
+	// 全量在锁内生成、锁外发送，deliverMu 保证它在后续的变化事件之前
+	p.deliverMu.Lock()
+	p.mu.Unlock()
+	defer p.deliverMu.Unlock()
+	return session.WriteJSON(snapshot)
+}
+
+func (p *PresenceService) Unwatch(session *wsSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.watchers, session)
+}
+
+var Presence = NewPresenceService()
+
+// HandleGetVolunteers 返回在线志愿者和各状态的人数，只给志愿者和管理员看
+func HandleGetVolunteers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims != nil && !claims.HasRole(roleVolunteer) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	reply := volunteersReply{Volunteers: Presence.List()}
+	for _, v := range reply.Volunteers {
+		switch v.State {
+		case presenceAvailable:
+			reply.Available++
+		case presenceBusy:
+			reply.Busy++
+		case presenceAway:
+			reply.Away++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
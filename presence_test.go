@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestWatchPresenceSnapshotComesFirst(t *testing.T) {
+	setupTest(t)
+	server := startSignaling(t)
+	const volunteers = 5
+	clients := make([]*testClient, volunteers)
+	for i := range clients {
+		clients[i] = dialSignaling(t, server, "", nil)
+	}
+	watcher := dialSignaling(t, server, "", nil)
+
+	// 订阅和志愿者登记同时进行，全量之后的事件只能是全量里没有的变化
+	for i, c := range clients {
+		go c.send(cmdAvailable, map[string]interface{}{"userId": fmt.Sprintf("v%d", i)})
+	}
+	watcher.send(cmdWatchPresence, nil)
+	first, err := watcher.await("presenceSnapshot", "presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Type != "presenceSnapshot" {
+		t.Fatalf("first message %s", first.raw)
+	}
+	var snapshot presenceSnapshot
+	if err := json.Unmarshal(first.raw, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, info := range snapshot.Volunteers {
+		seen[info.UserID] = true
+	}
+	for len(seen) < volunteers {
+		reply := watcher.expect("presence")
+		var event presenceEvent
+		if err := json.Unmarshal(reply.raw, &event); err != nil {
+			t.Fatal(err)
+		}
+		if seen[event.Volunteer.UserID] {
+			t.Fatalf("%s is in the snapshot and has an event after it", event.Volunteer.UserID)
+		}
+		seen[event.Volunteer.UserID] = true
+	}
+}
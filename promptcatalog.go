@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"yanglei_blinder/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+// promptCategorySystem 是服务端自己播放的提示音（比如派单），不能通过 control 发送，也不出现在 /api/prompts 里
+const promptCategorySystem = "system"
+
+var promptIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// PromptInfo 是清单里的一条提示音，control 的 cmdDetail 就是 ID。
+// 同一个 ID 可以有多种语言，播放时按盲人的语言选择
+type PromptInfo struct {
+	ID string `yaml:"id" json:"id"`
+	// File 是相对 prompts.dir 的路径，为空时是 <language>/<id>.ogg，没有写 language 时是 <id>.ogg
+	File     string `yaml:"file" json:"-"`
+	Text     string `yaml:"text" json:"text"`
+	Category string `yaml:"category" json:"category"`
+	// Priority 越大越紧急
+	Priority int `yaml:"priority" json:"priority"`
+	// Language 为空时是 prompts.defaultLanguage
+	Language string `yaml:"language" json:"language"`
+
+	path string
+	// transient 的提示音（文字合成的）不常驻内存，每次播放时从文件读
+	transient bool
+}
+
+// Path 返回提示音文件的路径
+func (p *PromptInfo) Path() string {
+	return p.path
+}
+
+// Sendable 志愿者能否通过 control 发送
+func (p *PromptInfo) Sendable() bool {
+	return p.Category != promptCategorySystem
+}
+
+type promptManifest struct {
+	Prompts []*PromptInfo `yaml:"prompts"`
+}
+
+// promptsReply 是 /api/prompts 的应答
+type promptsReply struct {
+	Language  string        `json:"language"`
+	Languages []string      `json:"languages"`
+	Prompts   []*PromptInfo `json:"prompts"`
+}
+
+// PromptCatalog 是所有可以播放的提示音，只有清单里登记过并且文件存在的才能播放，
+// control 发来的 ID 不会直接拼成文件路径
+type PromptCatalog struct {
+	mu sync.RWMutex
+	// prompts 按 ID、语言索引
+	prompts map[string]map[string]*PromptInfo
+	// missing 是清单里登记了但文件不存在的，不能播放，只用来取它的文字合成语音
+	missing         map[string]map[string]*PromptInfo
+	defaultLanguage string
+}
+
+func NewPromptCatalog() *PromptCatalog {
+	return &PromptCatalog{prompts: make(map[string]map[string]*PromptInfo), missing: make(map[string]map[string]*PromptInfo)}
+}
+
+// validate 检查 ID、语言和文件路径，文件必须在 dir 里面
+func (p *PromptInfo) validate(dir string, defaultLanguage string) error {
+	if !promptIDPattern.MatchString(p.ID) {
+		return fmt.Errorf("invalid prompt id %q", p.ID)
+	}
+	if len(p.File) == 0 {
+		p.File = p.ID + ".ogg"
+		if len(p.Language) > 0 {
+			p.File = filepath.Join(p.Language, p.File)
+		}
+	}
+	if len(p.Language) == 0 {
+		p.Language = defaultLanguage
+	}
+	if !promptIDPattern.MatchString(p.Language) {
+		return fmt.Errorf("prompt %s: invalid language %q", p.ID, p.Language)
+	}
+	p.Language = strings.ToLower(p.Language)
+	if !filepath.IsLocal(p.File) {
+		return fmt.Errorf("prompt %s: file %q must be a relative path inside the prompt dir", p.ID, p.File)
+	}
+	p.path = filepath.Join(dir, p.File)
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return fmt.Errorf("prompt %s: %w", p.ID, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("prompt %s: %s is a directory", p.ID, p.path)
+	}
+	return nil
+}
+
+// Load 读取清单 manifest，文件不存在的提示音打警告后跳过。
+// 没有清单时把 dir 下的 *.ogg 登记为默认语言的提示音，dir/<language>/*.ogg 登记为对应语言的，兼容原来的部署
+func (c *PromptCatalog) Load(manifest string, dir string, defaultLanguage string) (int, error) {
+	var prompts []*PromptInfo
+	data, err := os.ReadFile(manifest)
+	switch {
+	case err == nil:
+		var m promptManifest
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return 0, fmt.Errorf("parse %s: %w", manifest, err)
+		}
+		prompts = m.Prompts
+	case errors.Is(err, os.ErrNotExist):
+		logger.Warnf("prompt manifest %s does not exist, using every .ogg in %s", manifest, dir)
+		for _, pattern := range []string{"*.ogg", "*/*.ogg"} {
+			files, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return 0, err
+			}
+			for _, file := range files {
+				file, _ = filepath.Rel(dir, file)
+				language := filepath.Dir(file)
+				if language == "." {
+					language = ""
+				}
+				prompts = append(prompts, &PromptInfo{ID: strings.TrimSuffix(filepath.Base(file), ".ogg"), File: file, Language: language})
+			}
+		}
+	default:
+		return 0, err
+	}
+
+	defaultLanguage = strings.ToLower(defaultLanguage)
+	catalog := make(map[string]map[string]*PromptInfo, len(prompts))
+	missing := make(map[string]map[string]*PromptInfo)
+	n := 0
+	for _, prompt := range prompts {
+		if err := prompt.validate(dir, defaultLanguage); err != nil {
+			logger.Warnf("skip %v", err)
+			if errors.Is(err, os.ErrNotExist) {
+				if missing[prompt.ID] == nil {
+					missing[prompt.ID] = make(map[string]*PromptInfo)
+				}
+				missing[prompt.ID][prompt.Language] = prompt
+			}
+			continue
+		}
+		languages, exists := catalog[prompt.ID]
+		if !exists {
+			languages = make(map[string]*PromptInfo)
+			catalog[prompt.ID] = languages
+		}
+		if _, exists := languages[prompt.Language]; exists {
+			return 0, fmt.Errorf("%s: duplicate prompt %s in %s", manifest, prompt.ID, prompt.Language)
+		}
+		languages[prompt.Language] = prompt
+		n++
+	}
+
+	c.mu.Lock()
+	c.prompts = catalog
+	c.missing = missing
+	c.defaultLanguage = defaultLanguage
+	c.mu.Unlock()
+	return n, nil
+}
+
+// Get 返回默认语言的提示音
+func (c *PromptCatalog) Get(id string) (*PromptInfo, bool) {
+	return c.Resolve(id, "")
+}
+
+// Resolve 按语言选择提示音：先找 language（zh-CN 这样的也会再找 zh），没有时用默认语言的
+func (c *PromptCatalog) Resolve(id string, language string) (*PromptInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.resolveLocked(c.prompts, id, language)
+}
+
+// Missing 按同样的规则返回清单里登记了但文件不存在的提示音，没有录音时用它的文字合成
+func (c *PromptCatalog) Missing(id string, language string) (*PromptInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.resolveLocked(c.missing, id, language)
+}
+
+func (c *PromptCatalog) resolveLocked(prompts map[string]map[string]*PromptInfo, id string, language string) (*PromptInfo, bool) {
+	languages, exists := prompts[id]
+	if !exists {
+		return nil, false
+	}
+	language = strings.ToLower(language)
+	base, _, _ := strings.Cut(language, "-")
+	for _, candidate := range []string{language, base, c.defaultLanguage} {
+		if prompt, exists := languages[candidate]; exists {
+			return prompt, true
+		}
+	}
+	return nil, false
+}
+
+// All 按 ID、语言排序返回所有提示音
+func (c *PromptCatalog) All() []*PromptInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	list := make([]*PromptInfo, 0, len(c.prompts))
+	for _, languages := range c.prompts {
+		for _, prompt := range languages {
+			list = append(list, prompt)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ID != list[j].ID {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Language < list[j].Language
+	})
+	return list
+}
+
+// Languages 返回清单里出现过的语言
+func (c *PromptCatalog) Languages() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	seen := make(map[string]bool)
+	languages := make([]string, 0)
+	for _, prompts := range c.prompts {
+		for language := range prompts {
+			if !seen[language] {
+				seen[language] = true
+				languages = append(languages, language)
+			}
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Sendable 返回志愿者可以发送的提示音，每个 ID 按 language 选择一种语言，按分类、优先级（高的在前）、ID 排序
+func (c *PromptCatalog) Sendable(language string) []*PromptInfo {
+	c.mu.RLock()
+	ids := make([]string, 0, len(c.prompts))
+	for id := range c.prompts {
+		ids = append(ids, id)
+	}
+	c.mu.RUnlock()
+	sort.Strings(ids)
+
+	list := make([]*PromptInfo, 0, len(ids))
+	for _, id := range ids {
+		if prompt, exists := c.Resolve(id, language); exists && prompt.Sendable() {
+			list = append(list, prompt)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Category != list[j].Category {
+			return list[i].Category < list[j].Category
+		}
+		return list[i].Priority > list[j].Priority
+	})
+	return list
+}
+
+var Catalog = NewPromptCatalog()
+
+// HandleGetPrompts 返回志愿者可以通过 control 发送的提示音，?language= 指定语言（一般是盲人的语言），只给志愿者和管理员看
+func HandleGetPrompts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims != nil && !claims.HasRole(roleVolunteer) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	language := r.URL.Query().Get("language")
+	json.NewEncoder(w).Encode(promptsReply{Language: language, Languages: Catalog.Languages(), Prompts: Catalog.Sendable(language)})
+}
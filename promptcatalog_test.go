@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePromptFiles 在 dir 下建空的提示音文件，Catalog.Load 只检查文件是否存在
+func writePromptFiles(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("OggS"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// loadCatalogFixture 在临时目录里按 manifest 加载 Catalog，返回提示音目录
+func loadCatalogFixture(t *testing.T, manifest string) string {
+	t.Helper()
+	root := t.TempDir()
+	dir := filepath.Join(root, "audio")
+	// 清单里用 ../ 和绝对路径指向的文件都存在，只能靠路径检查拒绝
+	writePromptFiles(t, root, "outside.ogg")
+	writePromptFiles(t, dir, "zh/zuo.ogg", "en/zuo.ogg", "zh/you.ogg", "ting.ogg", "zh/deng_dai.ogg")
+	file := filepath.Join(dir, "prompts.yaml")
+	manifest = strings.ReplaceAll(manifest, "$ROOT", root)
+	if err := os.WriteFile(file, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Catalog.Load(file, dir, "zh"); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+const testCatalogManifest = `prompts:
+  - {id: zuo, text: 左, category: direction, priority: 1, language: zh}
+  - {id: zuo, text: left, category: direction, priority: 1, language: en}
+  - {id: you, text: 右, category: direction, language: zh}
+  - {id: ting, text: 停, category: warning, priority: 9}
+  - {id: deng_dai, text: 请稍等, category: system, language: zh}
+  - {id: wu_ren, text: 暂时没有志愿者, category: system, language: zh}
+  - {id: escape, file: ../outside.ogg}
+  - {id: absolute, file: $ROOT/outside.ogg}
+  - {id: ../zuo, file: zh/zuo.ogg}
+`
+
+func TestPromptCatalogResolve(t *testing.T) {
+	setupTest(t)
+	loadCatalogFixture(t, testCatalogManifest)
+
+	tests := []struct {
+		id, language string
+		want         string
+	}{
+		{"zuo", "zh", "zh"},
+		{"zuo", "zh-CN", "zh"},
+		{"zuo", "en-US", "en"},
+		{"zuo", "EN", "en"},
+		{"zuo", "fr", "zh"},
+		{"zuo", "", "zh"},
+		{"you", "en", "zh"},
+		{"ting", "en-GB", "zh"},
+		{"bu_cun_zai", "zh", ""},
+		{"wu_ren", "zh", ""},
+		{"escape", "zh", ""},
+		{"absolute", "zh", ""},
+		{"../zuo", "zh", ""},
+	}
+	for _, tt := range tests {
+		prompt, exists := Catalog.Resolve(tt.id, tt.language)
+		switch {
+		case len(tt.want) == 0 && exists:
+			t.Errorf("%s in %s resolves to %s", tt.id, tt.language, prompt.Path())
+		case len(tt.want) > 0 && (!exists || prompt.Language != tt.want):
+			t.Errorf("%s in %s resolves to %+v, want %s", tt.id, tt.language, prompt, tt.want)
+		}
+	}
+
+	// 文件不存在的只能用来合成文字，路径不合法的连文字也不用
+	if prompt, exists := Catalog.Missing("wu_ren", "zh-CN"); !exists || prompt.Text != "暂时没有志愿者" {
+		t.Fatalf("missing wu_ren %+v", prompt)
+	}
+	for _, id := range []string{"escape", "absolute", "zuo"} {
+		if _, exists := Catalog.Missing(id, "zh"); exists {
+			t.Errorf("%s is listed as missing", id)
+		}
+	}
+	if prompt, _ := Catalog.Resolve("deng_dai", "zh"); prompt == nil || prompt.Sendable() {
+		t.Fatalf("system prompt deng_dai %+v", prompt)
+	}
+}
+
+func TestPromptCatalogLoad(t *testing.T) {
+	setupTest(t)
+	dir := t.TempDir()
+	writePromptFiles(t, dir, "ting.ogg", "zh/zuo.ogg", "en/zuo.ogg")
+
+	// 没有清单时 dir 下的 .ogg 是默认语言的，<language>/*.ogg 是对应语言的
+	n, err := Catalog.Load(filepath.Join(dir, "prompts.yaml"), dir, "ZH")
+	if err != nil || n != 3 {
+		t.Fatalf("loaded %d prompts: %v", n, err)
+	}
+	if languages := Catalog.Languages(); strings.Join(languages, ",") != "en,zh" {
+		t.Fatalf("languages %v", languages)
+	}
+	if prompt, _ := Catalog.Resolve("zuo", "en"); prompt == nil || prompt.Path() != filepath.Join(dir, "en", "zuo.ogg") {
+		t.Fatalf("zuo in en %+v", prompt)
+	}
+
+	manifest := filepath.Join(dir, "prompts.yaml")
+	os.WriteFile(manifest, []byte("prompts:\n  - {id: zuo, language: zh}\n  - {id: zuo, file: zh/zuo.ogg}\n"), 0644)
+	if _, err := Catalog.Load(manifest, dir, "zh"); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("duplicate prompt: %v", err)
+	}
+	os.WriteFile(manifest, []byte("prompts: [\n"), 0644)
+	if _, err := Catalog.Load(manifest, dir, "zh"); err == nil || !strings.Contains(err.Error(), "parse") {
+		t.Fatalf("bad manifest: %v", err)
+	}
+}
+
+func TestHandleGetPrompts(t *testing.T) {
+	setupTest(t)
+	loadCatalogFixture(t, testCatalogManifest)
+
+	get := func(target string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if len(token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		HandleGetPrompts(w, r)
+		return w
+	}
+	w := get("/api/prompts?language=en-US", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var reply struct {
+		Language  string                   `json:"language"`
+		Languages []string                 `json:"languages"`
+		Prompts   []map[string]interface{} `json:"prompts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Language != "en-US" || strings.Join(reply.Languages, ",") != "en,zh" {
+		t.Fatalf("reply %s", w.Body.Bytes())
+	}
+	// 系统提示音不列出，按分类、优先级排序，每个 ID 一种语言，不带文件路径
+	var got []string
+	for _, prompt := range reply.Prompts {
+		got = append(got, prompt["id"].(string)+":"+prompt["language"].(string))
+		if _, exists := prompt["file"]; exists {
+			t.Fatalf("prompt exposes its file %v", prompt)
+		}
+	}
+	if want := "zuo:en,you:zh,ting:zh"; strings.Join(got, ",") != want {
+		t.Fatalf("prompts %v, want %s", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	HandleGetPrompts(w, httptest.NewRequest(http.MethodPost, "/api/prompts", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status %d", w.Code)
+	}
+	config.Auth.Enabled = true
+	config.Auth.Secret = testSecret
+	for _, test := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{signTestToken(testSecret, "HS256", testClaims("blind1", roleBlind, nil)), http.StatusForbidden},
+		{signTestToken(testSecret, "HS256", testClaims("v1", roleVolunteer, nil)), http.StatusOK},
+	} {
+		if w := get("/api/prompts", test.token); w.Code != test.want {
+			t.Errorf("status %d, want %d", w.Code, test.want)
+		}
+	}
+}
+
+func TestControlRejectsUnknownAndSystemPrompts(t *testing.T) {
+	setupTest(t)
+	loadTestPrompts(t)
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer confRoom.Close(closeReasonPublisherLeft)
+	runMixer(confRoom)
+	if _, err := confRoom.AddSubscriber(newTestSubscriber("guide1", "")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialSignaling(t, startSignaling(t), "", nil)
+	// 不在清单里的、系统的（派单提示音）和像路径的 ID 都不能发送
+	for _, id := range []string{"bu_cun_zai", config.Dispatch.EscalatePrompt, "../zh/ting", "zh/ting"} {
+		c.send(cmdControl, map[string]interface{}{"roomName": "room1", "userId": "guide1", "cmdDetail": id})
+		c.expectError(cmdControl, errCodeUnknownPrompt)
+	}
+	c.send(cmdControl, map[string]interface{}{"roomName": "room1", "userId": "guide1", "cmdDetail": "ting"})
+	c.expect("promptQueued")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"yanglei_blinder/logger"
+)
+
+// promptMaxQueue 每个房间最多排队的提示音数，避免连点积压出一串过时的指令。
+// 队列满时优先级更高的提示音挤掉排在最后的低优先级提示音，没有可以挤掉的才拒绝
+const promptMaxQueue = 8
+
+// 提示音结束的原因，带在 promptFinished 里
+const (
+	promptCompleted   = "completed"
+	promptInterrupted = "interrupted"
+	promptDropped     = "dropped"
+	promptCancelled   = "cancelled"
+	promptStopped     = "stopped"
+	promptFailed      = "failed"
+	promptRoomClosed  = "room_closed"
+)
+
+// promptEvent 推给发送 control 的志愿者：promptQueued、promptStarted、promptFinished
+type promptEvent struct {
+	Type     string `json:"type"`
+	RoomName string `json:"roomName"`
+	PlayID   string `json:"playId"`
+	PromptID string `json:"promptId"`
+	Language string `json:"language,omitempty"`
+	// Position 是排队时前面还有几个（不算正在播放的）
+	Position int    `json:"position,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// promptPlay 是一次播放，requester 为空时是服务端自己播放的（派单提示），不推事件
+type promptPlay struct {
+	id        string
+	prompt    *PromptInfo
+	requester peerSignaler
+	cancel    context.CancelFunc
+	// reason 是被打断、取消或停止的原因，正常播完时为空
+	reason string
+}
+
+// promptPlayer 是房间的提示音播放器：同一时间只播放一个，其余按优先级排队，
+// 优先级更高的提示音（比如 ting、zhu_yi）会打断正在播放的并丢掉排队中优先级更低的，避免盲人在“停”之后还听到过时的方向
+type promptPlayer struct {
+	room *ConfRoom
+
+	mu      sync.Mutex
+	queue   []*promptPlay
+	current *promptPlay
+	running bool
+	nextID  uint64
+
+	// sendMu 保证同一个播放器的事件按顺序送达，又不用在发送时持有 mu
+	sendMu sync.Mutex
+}
+
+func newPromptPlayer(room *ConfRoom) *promptPlayer {
+	return &promptPlayer{room: room}
+}
+
+func (p *promptPlayer) event(play *promptPlay, eventType string, reason string) []outgoing {
+	if play.requester == nil {
+		return nil
+	}
+	return []outgoing{{play.requester, promptEvent{
+		Type:     eventType,
+		RoomName: p.room.Name,
+		PlayID:   play.id,
+		PromptID: play.prompt.ID,
+		Language: play.prompt.Language,
+		Reason:   reason,
+	}}}
+}
+
+// unlockAndDeliver 释放 mu 后按顺序发送事件
+func (p *promptPlayer) unlockAndDeliver(messages []outgoing) {
+	p.sendMu.Lock()
+	p.mu.Unlock()
+	deliver(messages)
+	p.sendMu.Unlock()
+}
+
+// interruptLocked 停止正在播放的提示音，播放的 goroutine 会发出 promptFinished
+func (p *promptPlayer) interruptLocked(reason string) {
+	if p.current != nil && len(p.current.reason) == 0 {
+		p.current.reason = reason
+		p.current.cancel()
+	}
+}
+
+// dropLocked 从队列里移除 drop 返回 true 的提示音
+func (p *promptPlayer) dropLocked(reason string, drop func(*promptPlay) bool) []outgoing {
+	var messages []outgoing
+	queue := p.queue[:0]
+	for _, play := range p.queue {
+		if drop(play) {
+			messages = append(messages, p.event(play, "promptFinished", reason)...)
+		} else {
+			queue = append(queue, play)
+		}
+	}
+	p.queue = queue
+	return messages
+}
+
+// Play 把提示音放进队列，返回播放 ID
+func (p *promptPlayer) Play(prompt *PromptInfo, requester peerSignaler) (string, error) {
+	p.mu.Lock()
+	// 先打断和清理优先级更低的，再检查队列是否已满，避免“停”因为排满了方向指令被拒绝
+	var messages []outgoing
+	if p.current != nil && prompt.Priority > p.current.prompt.Priority {
+		p.interruptLocked(promptInterrupted)
+		messages = p.dropLocked(promptInterrupted, func(queued *promptPlay) bool {
+			return queued.prompt.Priority < prompt.Priority
+		})
+	}
+	if len(p.queue) >= promptMaxQueue {
+		// 队列按优先级排序，最后一个优先级最低
+		last := p.queue[len(p.queue)-1]
+		if last.prompt.Priority >= prompt.Priority {
+			p.unlockAndDeliver(messages)
+			return "", newSignalError(errCodePromptQueueFull, "%d prompts are waiting in room %s", len(p.queue), p.room.Name)
+		}
+		p.queue = p.queue[:len(p.queue)-1]
+		messages = append(messages, p.event(last, "promptFinished", promptDropped)...)
+	}
+	p.nextID++
+	play := &promptPlay{id: strconv.FormatUint(p.nextID, 10), prompt: prompt, requester: requester}
+	// 同优先级按先后顺序
+	position := len(p.queue)
+	for i, queued := range p.queue {
+		if queued.prompt.Priority < prompt.Priority {
+			position = i
+			break
+		}
+	}
+	p.queue = append(p.queue, nil)
+	copy(p.queue[position+1:], p.queue[position:])
+	p.queue[position] = play
+
+	if !p.running {
+		if !p.room.Go(p.run) {
+			p.queue = append(p.queue[:position], p.queue[position+1:]...)
+			p.mu.Unlock()
+			return "", newSignalError(errCodeRoomNotFound, "room %s is closing", p.room.Name)
+		}
+		p.running = true
+		p.room.SetPlayingFile(true)
+	}
+	if requester != nil {
+		messages = append(messages, outgoing{requester, promptEvent{
+			Type:     "promptQueued",
+			RoomName: p.room.Name,
+			PlayID:   play.id,
+			PromptID: prompt.ID,
+			Language: prompt.Language,
+			Position: position,
+		}})
+	}
+	p.unlockAndDeliver(messages)
+	return play.id, nil
+}
+
+// Cancel 取消一个排队中或正在播放的提示音，返回是否找到
+func (p *promptPlayer) Cancel(playID string) bool {
+	p.mu.Lock()
+	if p.current != nil && p.current.id == playID {
+		p.interruptLocked(promptCancelled)
+		p.mu.Unlock()
+		return true
+	}
+	found := false
+	messages := p.dropLocked(promptCancelled, func(queued *promptPlay) bool {
+		if queued.id == playID {
+			found = true
+		}
+		return queued.id == playID
+	})
+	p.unlockAndDeliver(messages)
+	return found
+}
+
+// Stop 停止正在播放的提示音并清空队列
+func (p *promptPlayer) Stop() {
+	p.mu.Lock()
+	p.interruptLocked(promptStopped)
+	messages := p.dropLocked(promptStopped, func(*promptPlay) bool { return true })
+	p.unlockAndDeliver(messages)
+}
+
+// run 依次播放队列里的提示音，队列空了就退出，下次 Play 时再启动
+func (p *promptPlayer) run() {
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			p.running = false
+			p.room.SetPlayingFile(false)
+			p.mu.Unlock()
+			return
+		}
+		play := p.queue[0]
+		p.queue = p.queue[1:]
+		ctx, cancel := context.WithCancel(p.room.Context())
+		play.cancel = cancel
+		p.current = play
+		p.unlockAndDeliver(p.event(play, "promptStarted", ""))
+
+		err := play.play(ctx, p.room)
+		cancel()
+
+		p.mu.Lock()
+		p.current = nil
+		reason := play.reason
+		var messages []outgoing
+		switch {
+		case p.room.Context().Err() != nil:
+			reason = promptRoomClosed
+			messages = p.dropLocked(promptRoomClosed, func(*promptPlay) bool { return true })
+		case len(reason) > 0:
+		case err != nil:
+			reason = promptFailed
+		default:
+			reason = promptCompleted
+		}
+		if reason != promptCompleted {
+			// 混音器里还没播出去的包也不要了
+			p.room.mixer.RemoveSource(audioSourcePrompt)
+		}
+		messages = append(p.event(play, "promptFinished", reason), messages...)
+		p.unlockAndDeliver(messages)
+	}
+}
+
+// play 缓存里有的直接按时长发送 Opus 包，否则用 ffmpeg 转码，ctx 取消时停止
+func (play *promptPlay) play(ctx context.Context, confRoom *ConfRoom) error {
+	logger.Infof("room %s plays prompt %s", confRoom.Name, play.prompt.ID)
+	if clip, exists := PromptClips.Get(play.prompt); exists {
+		playPromptClip(ctx, confRoom, clip)
+		return nil
+	}
+	_, err := FFmpegFileToRTPPackets(ctx, play.prompt.Path(), confRoom)
+	return err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loadTestPrompts 载入仓库里的 audio 提示音
+func loadTestPrompts(t *testing.T) []*PromptInfo {
+	t.Helper()
+	if _, err := Catalog.Load("audio/prompts.yaml", "audio", "zh"); err != nil {
+		t.Fatal(err)
+	}
+	prompts := Catalog.Sendable("zh")
+	if len(prompts) == 0 {
+		t.Fatal("no sendable prompts in audio/prompts.yaml")
+	}
+	return prompts
+}
+
+func TestPromptPlayerConcurrent(t *testing.T) {
+	setupTest(t)
+	prompts := loadTestPrompts(t)
+
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runMixer(confRoom)
+
+	// 几个志愿者同时发 control、取消和停止，最后盲人挂断
+	const volunteers = 4
+	signalers := make([]*fakeSignaler, volunteers)
+	played := make([][]string, volunteers)
+	var wg sync.WaitGroup
+	for i := range signalers {
+		signalers[i] = &fakeSignaler{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < 20; j++ {
+				playID, err := confRoom.prompts.Play(prompts[random.Intn(len(prompts))], signalers[i])
+				if err != nil {
+					if code := signalCode(err); code != errCodePromptQueueFull && code != errCodeRoomNotFound {
+						t.Errorf("play: %v", err)
+					}
+					continue
+				}
+				played[i] = append(played[i], playID)
+				switch random.Intn(4) {
+				case 0:
+					confRoom.prompts.Cancel(playID)
+				case 1:
+					confRoom.prompts.Stop()
+				}
+				time.Sleep(time.Duration(random.Intn(20)) * time.Millisecond)
+			}
+		}(i)
+	}
+	time.Sleep(200 * time.Millisecond)
+	confRoom.Close(closeReasonPublisherLeft)
+	wg.Wait()
+
+	if confRoom.IsPlayingFile() {
+		t.Fatal("room is still playing after close")
+	}
+	if _, err := confRoom.prompts.Play(prompts[0], nil); signalCode(err) != errCodeRoomNotFound {
+		t.Fatalf("play after close: %v", err)
+	}
+	// 每个排进队列的提示音都正好结束一次
+	for i, signaler := range signalers {
+		finished := make(map[string]int)
+		for _, event := range signaler.promptEvents("promptFinished") {
+			finished[event.PlayID]++
+		}
+		for _, playID := range played[i] {
+			if finished[playID] != 1 {
+				t.Errorf("volunteer %d: prompt %s finished %d times", i, playID, finished[playID])
+			}
+		}
+		if len(finished) != len(played[i]) {
+			t.Errorf("volunteer %d: %d prompts finished, %d played", i, len(finished), len(played[i]))
+		}
+	}
+}
+
+func TestPromptPlayerCancelAndStop(t *testing.T) {
+	setupTest(t)
+	prompts := loadTestPrompts(t)
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer confRoom.Close(closeReasonPublisherLeft)
+	runMixer(confRoom)
+
+	signaler := &fakeSignaler{}
+	prompt := prompts[len(prompts)-1]
+	var ids []string
+	for i := 0; i < 3; i++ {
+		playID, err := confRoom.prompts.Play(prompt, signaler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, playID)
+	}
+	if !confRoom.IsPlayingFile() {
+		t.Fatal("room is not playing")
+	}
+	if !confRoom.prompts.Cancel(ids[2]) {
+		t.Fatalf("cancel %s", ids[2])
+	}
+	if confRoom.prompts.Cancel(ids[2]) {
+		t.Fatalf("%s cancelled twice", ids[2])
+	}
+	confRoom.prompts.Stop()
+	if !waitFor(2*time.Second, func() bool { return !confRoom.IsPlayingFile() }) {
+		t.Fatal("room is still playing after stop")
+	}
+
+	reasons := make(map[string]string)
+	for _, event := range signaler.promptEvents("promptFinished") {
+		reasons[event.PlayID] = event.Reason
+	}
+	want := map[string]string{ids[0]: promptStopped, ids[1]: promptStopped, ids[2]: promptCancelled}
+	if fmt.Sprint(reasons) != fmt.Sprint(want) {
+		t.Fatalf("finished %v, want %v", reasons, want)
+	}
+}
+
+func TestPromptPlayerFullQueue(t *testing.T) {
+	setupTest(t)
+	loadTestPrompts(t)
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer confRoom.Close(closeReasonPublisherLeft)
+	runMixer(confRoom)
+
+	direction, _ := Catalog.Get("zuo")
+	speed, _ := Catalog.Get("man")
+	safety, _ := Catalog.Get("ting")
+	if !(direction.Priority < speed.Priority && speed.Priority < safety.Priority) {
+		t.Fatalf("priorities %d %d %d", direction.Priority, speed.Priority, safety.Priority)
+	}
+
+	// 先让一个更紧急的提示音正在播放，方向指令不会打断它，只能排队
+	signaler := &fakeSignaler{}
+	if _, err := confRoom.prompts.Play(speed, signaler); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(time.Second, func() bool { return len(signaler.promptEvents("promptStarted")) == 1 })
+	var queued []string
+	for i := 0; i < promptMaxQueue; i++ {
+		playID, err := confRoom.prompts.Play(direction, signaler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queued = append(queued, playID)
+	}
+	if _, err := confRoom.prompts.Play(direction, signaler); signalCode(err) != errCodePromptQueueFull {
+		t.Fatalf("direction prompt on a full queue: %v", err)
+	}
+
+	// 优先级更高的“慢”挤掉最后一个方向指令
+	if _, err := confRoom.prompts.Play(speed, signaler); err != nil {
+		t.Fatalf("speed prompt on a full queue: %v", err)
+	}
+	dropped := signaler.promptEvents("promptFinished")
+	if len(dropped) != 1 || dropped[0].PlayID != queued[promptMaxQueue-1] || dropped[0].Reason != promptDropped {
+		t.Fatalf("finished %+v, want the last direction prompt dropped", dropped)
+	}
+
+	// “停”打断正在播放的并清掉所有更低的
+	if _, err := confRoom.prompts.Play(safety, signaler); err != nil {
+		t.Fatalf("safety prompt on a full queue: %v", err)
+	}
+	// 正在播放的“慢”、剩下的方向指令和排队的“慢”都被打断
+	var reasons map[string]int
+	if !waitFor(time.Second, func() bool {
+		reasons = make(map[string]int)
+		for _, event := range signaler.promptEvents("promptFinished") {
+			reasons[event.Reason]++
+		}
+		return reasons[promptInterrupted] == promptMaxQueue+1
+	}) {
+		t.Fatalf("finished reasons %v", reasons)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+	"yanglei_blinder/logger"
+
+	"github.com/pion/rtp"
+)
+
+// promptPayloadType 是提示音 RTP 包的 payload type，写入盲人轨道时会被换成协商出来的值
+const promptPayloadType = 111
+
+// promptClip 是启动时解封装好的提示音，播放时不再读文件也不再启动 ffmpeg
+type promptClip struct {
+	ID       string
+	Packets  [][]byte
+	Samples  []int
+	Duration time.Duration
+}
+
+// PromptCache 缓存清单里的 Ogg/Opus 提示音。
+// 不是 Opus 编码（或者帧长不是 20ms，直通混音时无法按 20ms 一帧输出）的文件不缓存，播放时仍然交给 ffmpeg 转码
+type PromptCache struct {
+	mu    sync.RWMutex
+	clips map[string]*promptClip
+}
+
+func NewPromptCache() *PromptCache {
+	return &PromptCache{clips: make(map[string]*promptClip)}
+}
+
+// Load 解封装清单里所有的提示音，返回缓存的个数
+func (c *PromptCache) Load(catalog *PromptCatalog) int {
+	clips := make(map[string]*promptClip)
+	for _, prompt := range catalog.All() {
+		clip, err := loadPromptClip(prompt.ID, prompt.Path())
+		if err != nil {
+			logger.Warnf("prompt %s will be played by ffmpeg: %v", prompt.Path(), err)
+			continue
+		}
+		clips[prompt.Path()] = clip
+	}
+
+	c.mu.Lock()
+	c.clips = clips
+	c.mu.Unlock()
+	return len(clips)
+}
+
+func loadPromptClip(id string, file string) (*promptClip, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stream, err := readOggOpus(f)
+	if err != nil {
+		return nil, err
+	}
+	if stream.Head.Channels != mixerChannels {
+		return nil, fmt.Errorf("%d channels, want %d", stream.Head.Channels, mixerChannels)
+	}
+	for _, samples := range stream.Durations {
+		if samples != mixerFrameSamples {
+			return nil, fmt.Errorf("opus frame of %d samples, want %d", samples, mixerFrameSamples)
+		}
+	}
+	// pre-skip 是编码器开头的 6.5ms 左右的填充，作为 RTP 直接发送时由解码端照常解码播放，这里不处理
+	return &promptClip{ID: id, Packets: stream.Packets, Samples: stream.Durations, Duration: stream.Duration()}, nil
+}
+
+// Get 返回缓存的提示音，启动时没有缓存的（比如文件被替换过）第一次播放时再尝试加载
+func (c *PromptCache) Get(prompt *PromptInfo) (*promptClip, bool) {
+	c.mu.RLock()
+	clip, exists := c.clips[prompt.Path()]
+	c.mu.RUnlock()
+	if exists {
+		return clip, true
+	}
+
+	clip, err := loadPromptClip(prompt.ID, prompt.Path())
+	if err != nil {
+		return nil, false
+	}
+	if prompt.transient {
+		return clip, true
+	}
+	c.mu.Lock()
+	c.clips[prompt.Path()] = clip
+	c.mu.Unlock()
+	return clip, true
+}
+
+var PromptClips = NewPromptCache()
+
+// PlayPrompt 服务端自己给盲人播放提示音（比如派单提示），promptID 为空、不在清单里或房间已经在关闭时什么也不做，返回是否放进了队列
+func PlayPrompt(confRoom *ConfRoom, promptID string) bool {
+	if len(promptID) == 0 {
+		return false
+	}
+	prompt, exists := Catalog.Resolve(promptID, confRoom.Language)
+	if !exists {
+		return playPromptText(confRoom, promptID)
+	}
+	if _, err := confRoom.prompts.Play(prompt, nil); err != nil {
+		logger.Warnf("play prompt %s in room %s: %v", promptID, confRoom.Name, err)
+		return false
+	}
+	return true
+}
+
+// playPromptText 清单里登记了但还没有录音的提示音，启用了 TTS 时在后台合成它的文字再播放
+func playPromptText(confRoom *ConfRoom, promptID string) bool {
+	missing, exists := Catalog.Missing(promptID, confRoom.Language)
+	if !exists || len(missing.Text) == 0 || !config.TTS.Enabled() {
+		logger.Warnf("prompt %s is not in the catalog", promptID)
+		return false
+	}
+	// 文字是清单里那种语言的，按它的语言选择声音
+	req, err := Speech.NewRequest(missing.Text, "", missing.Language)
+	if err != nil {
+		logger.Warnf("synthesize prompt %s: %v", promptID, err)
+		return false
+	}
+	return confRoom.Go(func() {
+		prompt, err := Speech.Prompt(confRoom.Context(), req)
+		if err != nil {
+			if confRoom.Context().Err() == nil {
+				logger.Warnf("synthesize prompt %s in room %s: %v", promptID, confRoom.Name, err)
+			}
+			return
+		}
+		if _, err := confRoom.prompts.Play(prompt, nil); err != nil {
+			logger.Warnf("play prompt %s in room %s: %v", promptID, confRoom.Name, err)
+		}
+	})
+}
+
+// playPromptClip 按每个包的时长依次把提示音交给混音器，ctx 取消时停止
+func playPromptClip(ctx context.Context, confRoom *ConfRoom, clip *promptClip) {
+	header := rtp.Header{
+		Version:        2,
+		PayloadType:    promptPayloadType,
+		SequenceNumber: uint16(rand.Uint32()),
+		Timestamp:      rand.Uint32(),
+		SSRC:           rand.Uint32(),
+		Marker:         true,
+	}
+	// 按开始时间累计计算每个包的发送时间，sleep 的误差不会累积
+	start := time.Now()
+	elapsed := 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for i, payload := range clip.Packets {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		packet := &rtp.Packet{Header: header, Payload: payload}
+		if !confRoom.SendToPublisher(audioSourcePrompt, packet) {
+			return
+		}
+		header.SequenceNumber++
+		header.Timestamp += uint32(clip.Samples[i])
+		header.Marker = false
+		elapsed += clip.Samples[i]
+		timer.Reset(time.Until(start.Add(time.Duration(elapsed) * time.Second / mixerSampleRate)))
+	}
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+	"yanglei_blinder/logger"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// RoomState 房间的生命周期：created → live → draining → closed，
+// 盲人短暂断网时 live → reconnecting，宽限期内重连回到 live，超时进入 draining
+type RoomState int32
+
+const (
+	// RoomCreated 盲人已经发起 create，还没有连上
+	RoomCreated RoomState = iota
+	// RoomLive 盲人 ICE 已连接
+	RoomLive
+	// RoomReconnecting 盲人断开，在宽限期内等待重连
+	RoomReconnecting
+	// RoomDraining 盲人已断开，正在清理
+	RoomDraining
+	// RoomClosed 清理完成，已从 RoomManager 中移除
+	RoomClosed
+)
+
+func (s RoomState) String() string {
+	switch s {
+	case RoomCreated:
+		return "created"
+	case RoomLive:
+		return "live"
+	case RoomReconnecting:
+		return "reconnecting"
+	case RoomDraining:
+		return "draining"
+	case RoomClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type ConfRoom struct {
+	Name string
+	// Owner 是创建房间的盲人的 userId
+	Owner string
+	// JoinCode 是给志愿者口头转达用的短加入码
+	JoinCode string
+	// Language 是盲人的提示音语言，为空时用 prompts.defaultLanguage
+	Language string
+	// Skills 是盲人 create 时要求的志愿者技能，派单时有这些技能的优先
+	Skills              []string
+	PubPC               *webrtc.PeerConnection
+	PubRemoteVideoTrack *webrtc.TrackRemote
+	PubRemoteAudioTrack *webrtc.TrackRemote
+	PubLocalAudioTrack  *webrtc.TrackLocalStaticRTP
+	SubLocalVideoTrack  map[string]*webrtc.TrackLocalStaticRTP
+	SublocalAudioTrack  map[string]*webrtc.TrackLocalStaticRTP
+	Subscribers         map[string]*Subscriber
+	CreatedAt           time.Time
+
+	pubSignaler    peerSignaler
+	pubRecordSaver *webmSaver
+
+	// resumeToken 在 create 时发给盲人，重连时凭它接管原来的房间
+	resumeToken     string
+	graceTimer      *time.Timer
+	audioWriterOnce sync.Once
+	audioContinuity *rtpContinuity
+	videoContinuity *rtpContinuity
+
+	state         atomic.Int32
+	pubQuit       atomic.Bool
+	isPlayingFile atomic.Bool
+
+	// mixer 把志愿者的声音和提示音混成一路写到 PubLocalAudioTrack
+	mixer *audioMixer
+	// prompts 排队播放提示音
+	prompts *promptPlayer
+
+	// ctx 在房间关闭时取消，用来通知混音器、读写音频的 goroutine 以及 ffmpeg 退出
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wg 跟踪本房间启动的 goroutine，Close 时等待它们全部退出再结束录制
+	wg      sync.WaitGroup
+	closing bool
+	// closed 在 Close 全部完成（录制已结束）后关闭
+	closed chan struct{}
+
+	// 保护 PubPC、PubLocalAudioTrack、PubRemote*Track、Subscribers、Sub*Track、graceTimer 以及 closing
+	mu sync.Mutex
+}
+
+// 房间关闭的原因，会带在 roomClosed 消息里
+const (
+	closeReasonPublisherLeft    = "publisher_left"
+	closeReasonPublisherTimeout = "publisher_timeout"
+	closeReasonServerShutdown   = "server_shutdown"
+	closeReasonRoomReplaced     = "room_replaced"
+	// closeReasonCreateFailed create 没能回 answer，盲人收到的是 error，不再推 roomClosed
+	closeReasonCreateFailed = "create_failed"
+)
+
+// subscriberRolesMessage 志愿者加入、离开或者 guide 交接后推给房间里的所有志愿者
+type subscriberRolesMessage struct {
+	Type     string            `json:"type"`
+	RoomName string            `json:"roomName"`
+	Guide    string            `json:"guide,omitempty"`
+	Roles    map[string]string `json:"roles"`
+}
+
+// publisherStateMessage 盲人断线/恢复时推给志愿者
+type publisherStateMessage struct {
+	Type     string `json:"type"`
+	RoomName string `json:"roomName"`
+	State    string `json:"state"`
+}
+
+type roomClosedMessage struct {
+	Type     string `json:"type"`
+	RoomName string `json:"roomName"`
+	Reason   string `json:"reason"`
+}
+
+type ConfInfo struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"createdAt"`
+	Language  string    `json:"language,omitempty"`
+}
+
+func newConfRoom(name, owner, joinCode, language string) *ConfRoom {
+	ctx, cancel := context.WithCancel(context.Background())
+	createdAt := time.Now() // 记录创建时间
+
+	today := createdAt.Format("2006-01-02")
+	os.MkdirAll(fmt.Sprintf("%s/%s", config.Recording.Path, today), os.ModePerm)
+	recordFileName := fmt.Sprintf("%s/%s/%s_pub_%v", config.Recording.Path, today, name, createdAt.Format("15_04_05"))
+
+	confRoom := &ConfRoom{
+		Name:               name,
+		Owner:              owner,
+		JoinCode:           joinCode,
+		Language:           language,
+		SubLocalVideoTrack: make(map[string]*webrtc.TrackLocalStaticRTP, 0),
+		SublocalAudioTrack: make(map[string]*webrtc.TrackLocalStaticRTP, 0),
+		Subscribers:        make(map[string]*Subscriber, 0),
+		CreatedAt:          createdAt,
+		mixer:              newAudioMixer(),
+		pubRecordSaver:     newWebmSaver(recordFileName),
+		resumeToken:        newToken(),
+		audioContinuity:    newRTPContinuity(960),
+		videoContinuity:    newRTPContinuity(3000),
+		ctx:                ctx,
+		cancel:             cancel,
+		closed:             make(chan struct{}),
+	}
+	confRoom.prompts = newPromptPlayer(confRoom)
+	return confRoom
+}
+
+func (confRoom *ConfRoom) State() RoomState {
+	return RoomState(confRoom.state.Load())
+}
+
+// transition 只有当前状态是 from 时才切换到 to，返回是否切换成功
+func (confRoom *ConfRoom) transition(from, to RoomState) bool {
+	if !confRoom.state.CompareAndSwap(int32(from), int32(to)) {
+		return false
+	}
+	logger.Infof("room %s: %v -> %v", confRoom.Name, from, to)
+	return true
+}
+
+// Joinable 房间还没开始清理时志愿者都可以加入，盲人重连期间也可以
+func (confRoom *ConfRoom) Joinable() bool {
+	state := confRoom.State()
+	return state == RoomCreated || state == RoomLive || state == RoomReconnecting
+}
+
+func (confRoom *ConfRoom) PubQuit() bool {
+	return confRoom.pubQuit.Load()
+}
+
+func (confRoom *ConfRoom) IsPlayingFile() bool {
+	return confRoom.isPlayingFile.Load()
+}
+
+// SetPlayingFile 提示音开始和结束时调用，duck 模式下混音器据此压低志愿者的声音
+func (confRoom *ConfRoom) SetPlayingFile(playing bool) {
+	confRoom.isPlayingFile.Store(playing)
+	confRoom.mixer.SetDucking(playing)
+}
+
+// Done 在房间关闭后关闭
+func (confRoom *ConfRoom) Done() <-chan struct{} {
+	return confRoom.ctx.Done()
+}
+
+// Context 在房间关闭时取消
+func (confRoom *ConfRoom) Context() context.Context {
+	return confRoom.ctx
+}
+
+// markPubQuit 标记盲人已退出并通知相关 goroutine
+func (confRoom *ConfRoom) markPubQuit() {
+	confRoom.pubQuit.Store(true)
+	confRoom.cancel()
+}
+
+// Go 启动一个属于本房间的 goroutine，房间已经在关闭时不再启动，返回是否启动
+func (confRoom *ConfRoom) Go(fn func()) bool {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+	if confRoom.closing {
+		return false
+	}
+	confRoom.wg.Add(1)
+	go func() {
+		defer confRoom.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// Close 关闭房间：通知所有志愿者 roomClosed，关闭所有 PeerConnection，
+// 等待本房间的 goroutine 退出后结束录制，最后从 Rooms 中移除。可以重复调用
+func (confRoom *ConfRoom) Close(reason string) {
+	if !confRoom.transition(RoomCreated, RoomDraining) && !confRoom.transition(RoomLive, RoomDraining) &&
+		!confRoom.transition(RoomReconnecting, RoomDraining) {
+		return
+	}
+	logger.Infof("close room %s, reason: %s", confRoom.Name, reason)
+	confRoom.markPubQuit()
+
+	confRoom.mu.Lock()
+	confRoom.closing = true
+	if confRoom.graceTimer != nil {
+		confRoom.graceTimer.Stop()
+		confRoom.graceTimer = nil
+	}
+	pubPC := confRoom.PubPC
+	pubSignaler := confRoom.pubSignaler
+	subs := make([]*Subscriber, 0, len(confRoom.Subscribers))
+	for _, sub := range confRoom.Subscribers {
+		subs = append(subs, sub)
+	}
+	confRoom.Subscribers = make(map[string]*Subscriber, 0)
+	confRoom.SubLocalVideoTrack = make(map[string]*webrtc.TrackLocalStaticRTP, 0)
+	confRoom.SublocalAudioTrack = make(map[string]*webrtc.TrackLocalStaticRTP, 0)
+	confRoom.mu.Unlock()
+
+	closedMsg := roomClosedMessage{Type: "roomClosed", RoomName: confRoom.Name, Reason: reason}
+	for _, sub := range subs {
+		sub.Notify(closedMsg)
+		sub.Close()
+	}
+	if pubSignaler != nil && reason != closeReasonPublisherLeft && reason != closeReasonCreateFailed {
+		if err := pubSignaler.WriteJSON(closedMsg); err != nil {
+			logger.Error(err)
+		}
+	}
+	if pubPC != nil {
+		if err := pubPC.Close(); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	confRoom.wg.Wait()
+	confRoom.pubRecordSaver.mu.Lock()
+	confRoom.pubRecordSaver.Close()
+	confRoom.pubRecordSaver.mu.Unlock()
+
+	Rooms.Remove(confRoom)
+	confRoom.transition(RoomDraining, RoomClosed)
+	close(confRoom.closed)
+}
+
+// SetPubPC 换上盲人新的 PeerConnection，返回被替换掉的旧连接
+func (confRoom *ConfRoom) SetPubPC(pc *webrtc.PeerConnection, localAudioTrack *webrtc.TrackLocalStaticRTP) *webrtc.PeerConnection {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+	old := confRoom.PubPC
+	confRoom.PubPC = pc
+	confRoom.PubLocalAudioTrack = localAudioTrack
+	return old
+}
+
+// SetPubSignaler 盲人的信令连接，create 和 resume 时设置
+func (confRoom *ConfRoom) SetPubSignaler(signaler peerSignaler) {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+	confRoom.pubSignaler = signaler
+}
+
+// NotifyPublisher 给盲人推一条消息，盲人的信令连接不在时丢弃
+func (confRoom *ConfRoom) NotifyPublisher(v interface{}) {
+	confRoom.mu.Lock()
+	signaler := confRoom.pubSignaler
+	confRoom.mu.Unlock()
+	if signaler == nil {
+		return
+	}
+	if err := signaler.WriteJSON(v); err != nil {
+		logger.Error(err)
+	}
+}
+
+func (confRoom *ConfRoom) GetPubLocalAudioTrack() *webrtc.TrackLocalStaticRTP {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+	return confRoom.PubLocalAudioTrack
+}
+
+// ResumeTokenMatches 校验盲人重连时带上来的 token
+func (confRoom *ConfRoom) ResumeTokenMatches(token string) bool {
+	return len(token) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(confRoom.resumeToken)) == 1
+}
+
+// PublisherConnected 盲人的 ICE 连上（或在宽限期内恢复）
+func (confRoom *ConfRoom) PublisherConnected(pc *webrtc.PeerConnection) {
+	confRoom.mu.Lock()
+	if confRoom.PubPC != pc {
+		confRoom.mu.Unlock()
+		return
+	}
+	if confRoom.graceTimer != nil {
+		confRoom.graceTimer.Stop()
+		confRoom.graceTimer = nil
+	}
+	confRoom.mu.Unlock()
+
+	if confRoom.transition(RoomCreated, RoomLive) {
+		return
+	}
+	if confRoom.transition(RoomReconnecting, RoomLive) {
+		confRoom.notifySubscribers(publisherStateMessage{Type: "publisherState", RoomName: confRoom.Name, State: RoomLive.String()})
+	}
+}
+
+// PublisherDisconnected 盲人的 ICE 断开或失败，房间保留 room.reconnectGrace 配置的时间，
+// 期间盲人可以凭 resumeToken 重连，超时后关闭房间。
+// 被替换掉的旧连接断开时不做处理
+func (confRoom *ConfRoom) PublisherDisconnected(pc *webrtc.PeerConnection) {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+	if confRoom.PubPC != pc || confRoom.closing || confRoom.graceTimer != nil {
+		return
+	}
+
+	if !confRoom.transition(RoomLive, RoomReconnecting) && !confRoom.transition(RoomCreated, RoomReconnecting) {
+		return
+	}
+	logger.Warnf("publisher of room %s disconnected, wait %v for reconnect", confRoom.Name, config.Room.ReconnectGrace)
+	confRoom.graceTimer = time.AfterFunc(config.Room.ReconnectGrace, func() {
+		confRoom.Close(closeReasonPublisherTimeout)
+	})
+	go confRoom.notifySubscribers(publisherStateMessage{Type: "publisherState", RoomName: confRoom.Name, State: RoomReconnecting.String()})
+}
+
+// notifySubscribers 给房间里所有志愿者推送一条消息
+func (confRoom *ConfRoom) notifySubscribers(v interface{}) {
+	confRoom.mu.Lock()
+	subs := make([]*Subscriber, 0, len(confRoom.Subscribers))
+	for _, sub := range confRoom.Subscribers {
+		subs = append(subs, sub)
+	}
+	confRoom.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Notify(v)
+	}
+}
+
+func (confRoom *ConfRoom) GetPubPC() *webrtc.PeerConnection {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+	return confRoom.PubPC
+}
+
+// AddSubscriber 登记志愿者并分配角色，返回盲人当前已有的远端轨道。
+// 同一个 userId 重复加入时旧的连接会被关闭，没有指定角色时沿用旧连接的角色
+func (confRoom *ConfRoom) AddSubscriber(sub *Subscriber) ([]*webrtc.TrackRemote, error) {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+
+	if confRoom.closing {
+		return nil, newSignalError(errCodeRoomNotFound, "room %s is closing", confRoom.Name)
+	}
+	old, exists := confRoom.Subscribers[sub.UserID]
+	role := sub.Role()
+	if len(role) == 0 && exists {
+		role = old.Role()
+	}
+	guide := confRoom.guideLocked()
+	switch {
+	case len(role) == 0 && (guide == nil || guide == old):
+		role = subRoleGuide
+	case len(role) == 0:
+		role = subRoleObserver
+	case role == subRoleGuide && guide != nil && guide != old:
+		return nil, newSignalError(errCodeGuideTaken, "%s is the guide of room %s, ask for a handover", guide.UserID, confRoom.Name)
+	}
+	sub.setRole(role)
+
+	if exists && old != sub {
+		go old.Close()
+	}
+	confRoom.Subscribers[sub.UserID] = sub
+	var remoteTracks []*webrtc.TrackRemote
+	for _, remoteTrack := range []*webrtc.TrackRemote{confRoom.PubRemoteVideoTrack, confRoom.PubRemoteAudioTrack} {
+		if remoteTrack != nil {
+			remoteTracks = append(remoteTracks, remoteTrack)
+		}
+	}
+	return remoteTracks, nil
+}
+
+// RemoveSubscriber 只在登记的仍是这个志愿者时才移除，避免误删同一 userId 重新加入的连接
+func (confRoom *ConfRoom) RemoveSubscriber(sub *Subscriber) {
+	confRoom.mu.Lock()
+	if confRoom.Subscribers[sub.UserID] != sub {
+		confRoom.mu.Unlock()
+		return
+	}
+	delete(confRoom.Subscribers, sub.UserID)
+	delete(confRoom.SubLocalVideoTrack, sub.UserID)
+	delete(confRoom.SublocalAudioTrack, sub.UserID)
+	confRoom.mu.Unlock()
+
+	confRoom.mixer.RemoveSource(volunteerSource(sub.UserID))
+	confRoom.NotifyRoles()
+}
+
+// guideLocked 返回当前的 guide，没有时返回 nil
+func (confRoom *ConfRoom) guideLocked() *Subscriber {
+	for _, sub := range confRoom.Subscribers {
+		if sub.Role() == subRoleGuide {
+			return sub
+		}
+	}
+	return nil
+}
+
+// SubscriberRole 返回志愿者在房间里的角色，不在房间里时返回空字符串
+func (confRoom *ConfRoom) SubscriberRole(userID string) string {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+	if sub, exists := confRoom.Subscribers[userID]; exists {
+		return sub.Role()
+	}
+	return ""
+}
+
+// Handover 把 guide 交给房间里的另一个志愿者 to，原来的 guide 变成 observer。
+// 只有当前的 guide、trainer 或者管理员（force）可以交接，房间里没有 guide 时任何志愿者都可以接手
+func (confRoom *ConfRoom) Handover(from string, to string, force bool) error {
+	confRoom.mu.Lock()
+	target, exists := confRoom.Subscribers[to]
+	if !exists {
+		confRoom.mu.Unlock()
+		return newSignalError(errCodeBadMessage, "%s is not in room %s", to, confRoom.Name)
+	}
+	guide := confRoom.guideLocked()
+	if !force {
+		requester, exists := confRoom.Subscribers[from]
+		if !exists || (guide != nil && guide != requester && requester.Role() != subRoleTrainer) {
+			confRoom.mu.Unlock()
+			return newSignalError(errCodeForbidden, "only the guide or a trainer can hand over room %s", confRoom.Name)
+		}
+	}
+	if guide != nil && guide != target {
+		guide.setRole(subRoleObserver)
+	}
+	target.setRole(subRoleGuide)
+	confRoom.mu.Unlock()
+
+	logger.Infof("room %s guide handed over to %s by %s", confRoom.Name, to, from)
+	confRoom.NotifyRoles()
+	return nil
+}
+
+// NotifyRoles 把每个志愿者的角色推给房间里的所有志愿者
+func (confRoom *ConfRoom) NotifyRoles() {
+	confRoom.mu.Lock()
+	msg := subscriberRolesMessage{Type: "roles", RoomName: confRoom.Name, Roles: make(map[string]string, len(confRoom.Subscribers))}
+	subs := make([]*Subscriber, 0, len(confRoom.Subscribers))
+	for userID, sub := range confRoom.Subscribers {
+		role := sub.Role()
+		msg.Roles[userID] = role
+		if role == subRoleGuide {
+			msg.Guide = userID
+		}
+		subs = append(subs, sub)
+	}
+	confRoom.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Notify(msg)
+	}
+}
+
+// Whisper 把 trainer 的声音转发给 guide，没有 guide 时丢弃
+func (confRoom *ConfRoom) Whisper(capability webrtc.RTPCodecCapability, rtpPacket *rtp.Packet) {
+	confRoom.mu.Lock()
+	guide := confRoom.guideLocked()
+	confRoom.mu.Unlock()
+	if guide == nil {
+		return
+	}
+	whisperTrack, err := guide.attachWhisperTrack(capability)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if err := whisperTrack.WriteRTP(rtpPacket); err != nil && !isClosedPipe(err) {
+		logger.Errorf("whisper to %s failed: %v", guide.UserID, err)
+	}
+}
+
+// SetPublisherTrack 盲人的轨道到达（或重新到达、换了编码）时调用，把它挂到每个志愿者上
+func (confRoom *ConfRoom) SetPublisherTrack(remoteTrack *webrtc.TrackRemote) {
+	confRoom.mu.Lock()
+	if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+		confRoom.PubRemoteVideoTrack = remoteTrack
+	} else {
+		confRoom.PubRemoteAudioTrack = remoteTrack
+	}
+	subs := make([]*Subscriber, 0, len(confRoom.Subscribers))
+	for _, sub := range confRoom.Subscribers {
+		subs = append(subs, sub)
+	}
+	confRoom.mu.Unlock()
+
+	for _, sub := range subs {
+		confRoom.attachSubscriberTrack(sub, remoteTrack.Kind(), remoteTrack.Codec().RTPCodecCapability)
+	}
+}
+
+func (confRoom *ConfRoom) attachSubscriberTrack(sub *Subscriber, kind webrtc.RTPCodecType, capability webrtc.RTPCodecCapability) {
+	localTrack, err := sub.attachTrack(kind, capability)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+	if confRoom.Subscribers[sub.UserID] != sub {
+		return
+	}
+	if kind == webrtc.RTPCodecTypeVideo {
+		confRoom.SubLocalVideoTrack[sub.UserID] = localTrack
+	} else {
+		confRoom.SublocalAudioTrack[sub.UserID] = localTrack
+	}
+}
+
+// WriteToSubscribers 把盲人的 RTP 包转发给每个志愿者
+func (confRoom *ConfRoom) WriteToSubscribers(kind webrtc.RTPCodecType, rtpPacket *rtp.Packet) {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+
+	localTracks := confRoom.SubLocalVideoTrack
+	if kind == webrtc.RTPCodecTypeAudio {
+		localTracks = confRoom.SublocalAudioTrack
+	}
+	for userName, localTrack := range localTracks {
+		if err := localTrack.WriteRTP(rtpPacket); err != nil && !isClosedPipe(err) {
+			logger.Errorf("write %v to %s failed: %v", kind, userName, err)
+		}
+	}
+}
+
+// SendToPublisher 把 source 的一个音频包交给混音器，房间已经关闭时返回 false
+func (confRoom *ConfRoom) SendToPublisher(source string, rtpPacket *rtp.Packet) bool {
+	select {
+	case <-confRoom.Done():
+		return false
+	default:
+	}
+	confRoom.mixer.Push(source, rtpPacket)
+	return true
+}
+
+func (confRoom *ConfRoom) Info() ConfInfo {
+	return ConfInfo{
+		Name:      confRoom.Name,
+		Owner:     confRoom.Owner,
+		State:     confRoom.State().String(),
+		CreatedAt: confRoom.CreatedAt,
+		Language:  confRoom.Language,
+	}
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func isClosedPipe(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// RoomManager 是所有房间的注册表，WebSocket、OnTrack 和 ICE 回调都会并发访问
+type RoomManager struct {
+	mu    sync.RWMutex
+	rooms map[string]*ConfRoom
+	// codes 是加入码到房间的索引
+	codes map[string]*ConfRoom
+	// shuttingDown 之后不再创建新房间
+	shuttingDown bool
+}
+
+func NewRoomManager() *RoomManager {
+	return &RoomManager{
+		rooms: make(map[string]*ConfRoom),
+		codes: make(map[string]*ConfRoom),
+	}
+}
+
+// 房间名会出现在录制文件路径里，只允许字母（包括汉字）、数字、下划线和减号
+var roomNamePattern = regexp.MustCompile(`^[\p{L}\p{N}_-]{1,64}$`)
+
+// joinCodeDigits 加入码的位数
+const joinCodeDigits = 6
+
+// newJoinCodeLocked 生成一个没有被占用的加入码，调用时持有 m.mu
+func (m *RoomManager) newJoinCodeLocked() string {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil {
+			panic(err)
+		}
+		code := fmt.Sprintf("%0*d", joinCodeDigits, n.Int64())
+		if _, exists := m.codes[code]; !exists {
+			return code
+		}
+	}
+}
+
+// newRoomIDLocked 生成一个没有被占用的房间 ID，调用时持有 m.mu
+func (m *RoomManager) newRoomIDLocked() string {
+	for {
+		id := "room-" + newToken()[:12]
+		if _, exists := m.rooms[id]; !exists {
+			return id
+		}
+	}
+}
+
+// Create 新建一个房间，name 为空时由服务端生成房间 ID，language 是盲人的提示音语言。
+// 同名房间还在使用时拒绝创建，除非带上原房间的 resumeToken，此时原房间被关闭、由新房间接替
+func (m *RoomManager) Create(name, owner, resumeToken, language string) (*ConfRoom, error) {
+	logger.Info("CreateConfRoom comming...")
+	if len(name) > 0 && !roomNamePattern.MatchString(name) {
+		return nil, newSignalError(errCodeInvalidRoomName, "roomName may only contain letters, digits, '_' and '-'")
+	}
+
+	m.mu.Lock()
+	if m.shuttingDown {
+		m.mu.Unlock()
+		return nil, newSignalError(errCodeServerShutdown, "server is shutting down")
+	}
+	if len(name) == 0 {
+		name = m.newRoomIDLocked()
+	}
+	old, exists := m.rooms[name]
+	if exists && old.Joinable() && !old.ResumeTokenMatches(resumeToken) {
+		m.mu.Unlock()
+		return nil, newSignalError(errCodeRoomExists, "room %s already exists", name)
+	}
+	newRoom := newConfRoom(name, owner, m.newJoinCodeLocked(), language)
+	m.rooms[name] = newRoom
+	m.codes[newRoom.JoinCode] = newRoom
+	m.mu.Unlock()
+
+	if exists {
+		// 等旧房间关完再回 answer，盲人先收到旧房间的 roomClosed
+		logger.Warnf("room %s (%v) is replaced by its owner", name, old.State())
+		old.Close(closeReasonRoomReplaced)
+	}
+	logger.Info("CreateConfRoom end")
+	return newRoom, nil
+}
+
+// GetByCode 按加入码查找房间
+func (m *RoomManager) GetByCode(code string) (*ConfRoom, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	confRoom, exists := m.codes[code]
+	return confRoom, exists
+}
+
+func (m *RoomManager) Get(name string) (*ConfRoom, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	confRoom, exists := m.rooms[name]
+	return confRoom, exists
+}
+
+// Remove 只在注册表中仍是这个房间时才删除，避免误删同名的新房间
+func (m *RoomManager) Remove(confRoom *ConfRoom) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rooms[confRoom.Name] == confRoom {
+		delete(m.rooms, confRoom.Name)
+	}
+	if m.codes[confRoom.JoinCode] == confRoom {
+		delete(m.codes, confRoom.JoinCode)
+	}
+}
+
+func (m *RoomManager) List() []*ConfRoom {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	confRooms := make([]*ConfRoom, 0, len(m.rooms))
+	for _, confRoom := range m.rooms {
+		confRooms = append(confRooms, confRoom)
+	}
+	return confRooms
+}
+
+// Shutdown 停止创建新房间并关闭所有房间，等所有房间结束录制或者 ctx 到期后返回
+func (m *RoomManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.shuttingDown = true
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, confRoom := range m.List() {
+		wg.Add(1)
+		go func(confRoom *ConfRoom) {
+			defer wg.Done()
+			// 房间可能已经在别处关闭中，等它真正结束
+			confRoom.Close(closeReasonServerShutdown)
+			<-confRoom.closed
+		}(confRoom)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var Rooms = NewRoomManager()
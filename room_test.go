@@ -0,0 +1,817 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var testAPIOnce sync.Once
+
+// setupTest 用默认配置，录制写到临时目录，每个测试一个新的 Rooms，清空在线志愿者、求助和提示音清单，结束后恢复清单
+func setupTest(t *testing.T) {
+	t.Helper()
+	resetServices(t)
+	config = defaultConfig()
+	config.Recording.Path = t.TempDir()
+	config.Snapshot.Enabled = false
+	testAPIOnce.Do(func() {
+		api, err := newWebRTCAPI(&ICEConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		webrtcAPI = api
+	})
+	Rooms = NewRoomManager()
+}
+
+// resetServices 在锁里清空 Presence、Dispatch 和 Catalog，而不是换掉这些全局变量：
+// 上一个测试的 PeerConnection 回调可能还在读它们
+func resetServices(t *testing.T) {
+	Presence.mu.Lock()
+	Presence.volunteers = make(map[*wsSession]*volunteerPresence)
+	Presence.watchers = make(map[*wsSession]struct{})
+	Presence.mu.Unlock()
+
+	// 上一个测试剩下的求助直接结束，它们的定时器不会再呼叫这个测试的志愿者
+	Dispatch.mu.Lock()
+	for _, req := range Dispatch.requests {
+		req.done = true
+		req.ringTimer.Stop()
+		req.timeoutTimer.Stop()
+		close(req.finished)
+	}
+	Dispatch.requests = make(map[string]*helpRequest)
+	Dispatch.mu.Unlock()
+
+	Catalog.mu.Lock()
+	prompts, missing, defaultLanguage := Catalog.prompts, Catalog.missing, Catalog.defaultLanguage
+	Catalog.prompts, Catalog.missing = make(map[string]map[string]*PromptInfo), make(map[string]map[string]*PromptInfo)
+	Catalog.mu.Unlock()
+	t.Cleanup(func() {
+		Catalog.mu.Lock()
+		Catalog.prompts, Catalog.missing, Catalog.defaultLanguage = prompts, missing, defaultLanguage
+		Catalog.mu.Unlock()
+	})
+}
+
+// fakeSignaler 记录发给它的消息，代替 WebSocket 连接
+type fakeSignaler struct {
+	mu       sync.Mutex
+	messages []interface{}
+}
+
+func (f *fakeSignaler) SendOffer(offerSdp string) error {
+	return nil
+}
+
+func (f *fakeSignaler) WriteJSON(v interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, v)
+	return nil
+}
+
+// promptEvents 返回收到的 eventType 类型的提示音事件
+func (f *fakeSignaler) promptEvents(eventType string) []promptEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var events []promptEvent
+	for _, v := range f.messages {
+		if event, ok := v.(promptEvent); ok && event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// newTestSubscriber 会在测试启动的 goroutine 里调用，出错时 panic 而不是 t.Fatal
+func newTestSubscriber(userID string, role string) *Subscriber {
+	pc, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		panic(err)
+	}
+	saver := newWebmSaver(filepath.Join(config.Recording.Path, recordFileSafe(userID)))
+	return newSubscriber(userID, role, pc, true, &fakeSignaler{}, saver)
+}
+
+// runMixer 像盲人的音频轨道一样驱动房间的混音器，返回写出的包数
+func runMixer(confRoom *ConfRoom) *atomic.Int64 {
+	var written atomic.Int64
+	confRoom.Go(func() {
+		confRoom.mixer.Run(confRoom.Context(), promptPayloadType, func(*rtp.Packet) error {
+			written.Add(1)
+			return nil
+		})
+	})
+	return &written
+}
+
+func subscriberCount(confRoom *ConfRoom) int {
+	confRoom.mu.Lock()
+	defer confRoom.mu.Unlock()
+	return len(confRoom.Subscribers)
+}
+
+// waitFor 等 cond 成立，超时返回 false
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// testReply 是 /ws 推给客户端的消息，只解出测试关心的字段
+type testReply struct {
+	Type      string `json:"type"`
+	Cmd       string `json:"cmd"`
+	Code      string `json:"code"`
+	Reason    string `json:"reason"`
+	RequestID string `json:"requestId"`
+	RoomName  string `json:"roomName"`
+	State     string `json:"state"`
+	PromptID  string `json:"promptId"`
+	Answer    string `json:"answer"`
+
+	raw []byte
+}
+
+// testClient 是连到 /ws 的客户端，收到的消息由后台 goroutine 读进 replies
+type testClient struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	replies chan testReply
+}
+
+// startSignaling 启动 /ws，测试结束时等所有连接的处理结束，它们不会再碰下一个测试的全局变量
+func startSignaling(t *testing.T) *httptest.Server {
+	var handlers sync.WaitGroup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		HandleWebSocket(w, r)
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		handlers.Wait()
+	})
+	return server
+}
+
+// dialSignaling 连接 /ws，query 是 URL 里 ? 后面的部分，测试结束时断开
+func dialSignaling(t *testing.T, server *httptest.Server, query string, header http.Header) *testClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	if len(query) > 0 {
+		url += "?" + query
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, conn: conn, replies: make(chan testReply, 100)}
+	go func() {
+		defer close(c.replies)
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			reply := testReply{raw: message}
+			json.Unmarshal(message, &reply)
+			c.replies <- reply
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// send 发一条命令，fields 里不用写 cmd。失败时只记录错误，可以在测试启动的 goroutine 里用
+func (c *testClient) send(cmd string, fields map[string]interface{}) {
+	c.t.Helper()
+	message := map[string]interface{}{"cmd": cmd}
+	for k, v := range fields {
+		message[k] = v
+	}
+	if err := c.conn.WriteJSON(message); err != nil {
+		c.t.Error(err)
+	}
+}
+
+// await 等下一条 msgTypes 之一的消息，跳过其它类型的。不调用 t.Fatal，可以在测试启动的 goroutine 里用
+func (c *testClient) await(msgTypes ...string) (testReply, error) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case reply, ok := <-c.replies:
+			if !ok {
+				return reply, fmt.Errorf("connection closed while waiting for %v", msgTypes)
+			}
+			for _, msgType := range msgTypes {
+				if reply.Type == msgType {
+					return reply, nil
+				}
+			}
+		case <-timeout:
+			return testReply{}, fmt.Errorf("no %v in 5s", msgTypes)
+		}
+	}
+}
+
+// expect 等下一条 msgType 类型的消息，跳过其它类型的
+func (c *testClient) expect(msgType string) testReply {
+	c.t.Helper()
+	reply, err := c.await(msgType)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return reply
+}
+
+// expectError 等下一条 error，检查 cmd 和错误码
+func (c *testClient) expectError(cmd string, code string) testReply {
+	c.t.Helper()
+	reply := c.expect("error")
+	if reply.Cmd != cmd || reply.Code != code {
+		c.t.Fatalf("error %s", reply.raw)
+	}
+	return reply
+}
+
+// quiet 在 d 内没有收到 msgType 类型的消息
+func (c *testClient) quiet(msgType string, d time.Duration) bool {
+	timeout := time.After(d)
+	for {
+		select {
+		case reply, ok := <-c.replies:
+			if !ok {
+				return true
+			}
+			if reply.Type == msgType {
+				return false
+			}
+		case <-timeout:
+			return true
+		}
+	}
+}
+
+// testOffer 生成一个只接收的订阅 offer，和志愿者 join/accept 带的一样
+func testOffer(t *testing.T) string {
+	t.Helper()
+	return newTestOffer(t, func(pc *webrtc.PeerConnection) error {
+		_, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		return err
+	})
+}
+
+// testPublisherOffer 生成一个发送音频的 offer，和盲人 create 带的一样
+func testPublisherOffer(t *testing.T) string {
+	t.Helper()
+	return newTestOffer(t, func(pc *webrtc.PeerConnection) error {
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "blind")
+		if err != nil {
+			return err
+		}
+		_, err = pc.AddTrack(track)
+		return err
+	})
+}
+
+// newTestOffer 用 addTracks 准备好的 PeerConnection 生成收集完 candidate 的 offer，测试结束时关闭它
+func newTestOffer(t *testing.T, addTracks func(pc *webrtc.PeerConnection) error) string {
+	t.Helper()
+	pc, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if err := addTracks(pc); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return encode(pc.LocalDescription())
+}
+
+func signalCode(err error) string {
+	var sErr *signalError
+	if errors.As(err, &sErr) {
+		return sErr.Code
+	}
+	return ""
+}
+
+func TestRoomManagerConcurrentCreate(t *testing.T) {
+	setupTest(t)
+
+	const n = 20
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := Rooms.Create("room1", "blind", "", "zh")
+			switch {
+			case err == nil:
+				created.Add(1)
+			case signalCode(err) != errCodeRoomExists:
+				t.Errorf("create room1: %v", err)
+			}
+		}()
+	}
+	// 服务端生成的房间 ID 和加入码不能重复
+	rooms := make(chan *ConfRoom, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			confRoom, err := Rooms.Create("", "blind", "", "")
+			if err != nil {
+				t.Errorf("create: %v", err)
+				return
+			}
+			rooms <- confRoom
+		}()
+	}
+	wg.Wait()
+	close(rooms)
+
+	if created.Load() != 1 {
+		t.Fatalf("room1 created %d times", created.Load())
+	}
+	names, codes := make(map[string]bool), make(map[string]bool)
+	for confRoom := range rooms {
+		if names[confRoom.Name] || codes[confRoom.JoinCode] {
+			t.Fatalf("duplicate room %s / join code %s", confRoom.Name, confRoom.JoinCode)
+		}
+		names[confRoom.Name], codes[confRoom.JoinCode] = true, true
+		if found, exists := Rooms.GetByCode(confRoom.JoinCode); !exists || found != confRoom {
+			t.Fatalf("join code %s does not find room %s", confRoom.JoinCode, confRoom.Name)
+		}
+	}
+	if len(Rooms.List()) != n+1 {
+		t.Fatalf("%d rooms, want %d", len(Rooms.List()), n+1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Rooms.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(Rooms.List()) != 0 {
+		t.Fatalf("%d rooms left after shutdown", len(Rooms.List()))
+	}
+	if _, err := Rooms.Create("room2", "blind", "", ""); signalCode(err) != errCodeServerShutdown {
+		t.Fatalf("create after shutdown: %v", err)
+	}
+}
+
+func TestRoomManagerReplaceAndClose(t *testing.T) {
+	setupTest(t)
+
+	old, err := Rooms.Create("room1", "blind", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rooms.Create("room1", "blind", "wrong", ""); signalCode(err) != errCodeRoomExists {
+		t.Fatalf("create with wrong resume token: %v", err)
+	}
+	replaced, err := Rooms.Create("room1", "blind", old.resumeToken, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.State() != RoomClosed {
+		t.Fatalf("replaced room is %v", old.State())
+	}
+	// 旧房间晚到的 Close 不能把新房间从注册表里删掉
+	old.Close(closeReasonPublisherLeft)
+	if found, exists := Rooms.Get("room1"); !exists || found != replaced {
+		t.Fatal("replacing room is missing")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replaced.Close(closeReasonPublisherLeft)
+		}()
+	}
+	wg.Wait()
+	if replaced.State() != RoomClosed {
+		t.Fatalf("room is %v after close", replaced.State())
+	}
+	if _, exists := Rooms.Get("room1"); exists {
+		t.Fatal("closed room is still registered")
+	}
+}
+
+func TestConfRoomConcurrentSubscribers(t *testing.T) {
+	setupTest(t)
+	useFakeOpus(t)
+
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runMixer(confRoom)
+
+	// 同时加入的志愿者只能有一个 guide
+	const n = 10
+	subs := make([]*Subscriber, n)
+	var wg sync.WaitGroup
+	for i := range subs {
+		subs[i] = newTestSubscriber(fmt.Sprintf("user%d", i), "")
+		wg.Add(1)
+		go func(sub *Subscriber) {
+			defer wg.Done()
+			if _, err := confRoom.AddSubscriber(sub); err != nil {
+				t.Errorf("add %s: %v", sub.UserID, err)
+			}
+		}(subs[i])
+	}
+	wg.Wait()
+	guides := 0
+	for _, sub := range subs {
+		if confRoom.SubscriberRole(sub.UserID) == subRoleGuide {
+			guides++
+		}
+	}
+	if guides != 1 {
+		t.Fatalf("%d guides", guides)
+	}
+
+	// 志愿者反复重连、离开，同时盲人挂断
+	stop := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				sub := newTestSubscriber(userID, subRoleObserver)
+				if _, err := confRoom.AddSubscriber(sub); err != nil {
+					if signalCode(err) != errCodeRoomNotFound {
+						t.Errorf("add %s: %v", userID, err)
+					}
+					sub.Close()
+					return
+				}
+				confRoom.mixer.Push(volunteerSource(userID), &rtp.Packet{Payload: fakeOpusPacket(1000, -1000)})
+				confRoom.RemoveSubscriber(sub)
+				sub.Close()
+			}
+		}(fmt.Sprintf("user%d", i))
+	}
+	// 志愿者的音频 goroutine 在房间关闭期间还会问混音器是否在混音
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			confRoom.mixer.Mixing()
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	confRoom.Close(closeReasonPublisherLeft)
+	close(stop)
+	wg.Wait()
+
+	if confRoom.State() != RoomClosed {
+		t.Fatalf("room is %v after close", confRoom.State())
+	}
+	if count := subscriberCount(confRoom); count != 0 {
+		t.Fatalf("%d subscribers left after close", count)
+	}
+	late := newTestSubscriber("late", "")
+	defer late.Close()
+	if _, err := confRoom.AddSubscriber(late); signalCode(err) != errCodeRoomNotFound {
+		t.Fatalf("add after close: %v", err)
+	}
+	// 被同一 userId 顶替的连接是异步关闭的
+	for _, sub := range subs {
+		if !waitFor(2*time.Second, func() bool { return sub.PC.ConnectionState() == webrtc.PeerConnectionStateClosed }) {
+			t.Fatalf("%s is not closed", sub.UserID)
+		}
+	}
+}
+
+func TestSignalingConcurrentCommands(t *testing.T) {
+	setupTest(t)
+	loadTestPrompts(t)
+	config.Dispatch.RingTimeout = time.Minute
+	server := startSignaling(t)
+
+	// 几个盲人同时 create，每个房间几个志愿者反复 join、control、leave，最后盲人 leave
+	const rooms, volunteers, rounds = 3, 3, 5
+	blinds := make([]*testClient, rooms)
+	offers := make([][]string, rooms)
+	var wg sync.WaitGroup
+	for i := range blinds {
+		blinds[i] = dialSignaling(t, server, "", nil)
+		offer := testPublisherOffer(t)
+		offers[i] = make([]string, volunteers)
+		for j := range offers[i] {
+			offers[i][j] = testOffer(t)
+		}
+		wg.Add(1)
+		go func(blind *testClient, roomName string) {
+			defer wg.Done()
+			blind.send(cmdCreate, map[string]interface{}{"roomName": roomName, "userId": "blind-" + roomName, "sdp": offer})
+			if reply, err := blind.await("answer", "error"); err != nil || reply.Type != "answer" {
+				t.Errorf("create %s: %v %s", roomName, err, reply.raw)
+			}
+		}(blinds[i], fmt.Sprintf("room%d", i))
+	}
+	wg.Wait()
+
+	var controls atomic.Int32
+	for i := 0; i < rooms; i++ {
+		for j := 0; j < volunteers; j++ {
+			c := dialSignaling(t, server, "", nil)
+			wg.Add(1)
+			go func(roomName string, userID string, offer string) {
+				defer wg.Done()
+				for round := 0; round < rounds; round++ {
+					c.send(cmdJoin, map[string]interface{}{"roomName": roomName, "userId": userID, "sdp": offer})
+					reply, err := c.await("answer", "error")
+					if err != nil {
+						t.Errorf("join %s: %v", userID, err)
+						return
+					}
+					if reply.Type == "error" {
+						if reply.Code != errCodeRoomNotFound {
+							t.Errorf("join %s: %s", userID, reply.raw)
+						}
+						return
+					}
+					// 只有 guide 能 control，其他人收到 forbidden
+					c.send(cmdControl, map[string]interface{}{"roomName": roomName, "userId": userID, "cmdDetail": "ting"})
+					reply, err = c.await("promptQueued", "error")
+					switch {
+					case err != nil:
+						t.Errorf("control %s: %v", userID, err)
+						return
+					case reply.Type == "promptQueued":
+						controls.Add(1)
+					case reply.Code != errCodeForbidden && reply.Code != errCodeRoomNotFound && reply.Code != errCodePromptQueueFull:
+						t.Errorf("control %s: %s", userID, reply.raw)
+					}
+					c.send(cmdLeave, map[string]interface{}{"roomName": roomName, "userId": userID})
+				}
+			}(fmt.Sprintf("room%d", i), fmt.Sprintf("v%d-%d", i, j), offers[i][j])
+		}
+	}
+	// 房间 0 的盲人在志愿者进出的同时离开
+	time.Sleep(50 * time.Millisecond)
+	blinds[0].send(cmdLeave, map[string]interface{}{"roomName": "room0", "userId": "blind-room0"})
+	wg.Wait()
+	if controls.Load() == 0 {
+		t.Fatal("no control was accepted")
+	}
+
+	for i := 1; i < rooms; i++ {
+		blinds[i].send(cmdLeave, map[string]interface{}{"roomName": fmt.Sprintf("room%d", i), "userId": fmt.Sprintf("blind-room%d", i)})
+	}
+	if !waitFor(5*time.Second, func() bool { return len(Rooms.List()) == 0 }) {
+		t.Fatalf("%d rooms left after every blind user left", len(Rooms.List()))
+	}
+}
+
+// awaitGuide 等到房间的角色推送里 guide 是 want
+func (c *testClient) awaitGuide(want string) {
+	c.t.Helper()
+	for {
+		reply := c.expect("roles")
+		var roles subscriberRolesMessage
+		if err := json.Unmarshal(reply.raw, &roles); err != nil {
+			c.t.Fatal(err)
+		}
+		if roles.Guide == want {
+			return
+		}
+	}
+}
+
+func TestGuideTakenAndHandover(t *testing.T) {
+	setupTest(t)
+	loadTestPrompts(t)
+	server := startSignaling(t)
+	blind := dialSignaling(t, server, "", nil)
+	blind.send(cmdCreate, map[string]interface{}{"roomName": "room1", "userId": "blind1", "sdp": testPublisherOffer(t)})
+	blind.expect("answer")
+	defer func() {
+		if confRoom, exists := Rooms.Get("room1"); exists {
+			confRoom.Close(closeReasonPublisherLeft)
+		}
+	}()
+
+	role := func(reply testReply) string {
+		var answer answerReply
+		json.Unmarshal(reply.raw, &answer)
+		return answer.Role
+	}
+	g1, v2 := dialSignaling(t, server, "", nil), dialSignaling(t, server, "", nil)
+	g1.send(cmdJoin, map[string]interface{}{"roomName": "room1", "userId": "g1", "sdp": testOffer(t)})
+	if r := g1.expect("answer"); role(r) != subRoleGuide {
+		t.Fatalf("first volunteer joins as %s", r.raw)
+	}
+	// 已经有 guide 时不能以 guide 加入，不带角色时是 observer
+	v2.send(cmdJoin, map[string]interface{}{"roomName": "room1", "userId": "v2", "role": subRoleGuide, "sdp": testOffer(t)})
+	v2.expectError(cmdJoin, errCodeGuideTaken)
+	v2.send(cmdJoin, map[string]interface{}{"roomName": "room1", "userId": "v2", "sdp": testOffer(t)})
+	if r := v2.expect("answer"); role(r) != subRoleObserver {
+		t.Fatalf("second volunteer joins as %s", r.raw)
+	}
+
+	// observer 不能把 guide 交给自己，guide 可以交给房间里的人
+	v2.send(cmdHandover, map[string]interface{}{"roomName": "room1", "userId": "v2", "to": "v2"})
+	v2.expectError(cmdHandover, errCodeForbidden)
+	g1.send(cmdHandover, map[string]interface{}{"roomName": "room1", "userId": "g1", "to": "nobody"})
+	g1.expectError(cmdHandover, errCodeBadMessage)
+	g1.send(cmdHandover, map[string]interface{}{"roomName": "room1", "userId": "g1", "to": "v2"})
+	g1.awaitGuide("v2")
+	v2.awaitGuide("v2")
+	confRoom, _ := Rooms.Get("room1")
+	if confRoom.SubscriberRole("g1") != subRoleObserver || confRoom.SubscriberRole("v2") != subRoleGuide {
+		t.Fatalf("roles after handover: g1 %s, v2 %s", confRoom.SubscriberRole("g1"), confRoom.SubscriberRole("v2"))
+	}
+
+	// 只有新的 guide 能发提示音
+	g1.send(cmdControl, map[string]interface{}{"roomName": "room1", "userId": "g1", "cmdDetail": "ting"})
+	g1.expectError(cmdControl, errCodeForbidden)
+	v2.send(cmdControl, map[string]interface{}{"roomName": "room1", "userId": "v2", "cmdDetail": "ting"})
+	v2.expect("promptQueued")
+}
+
+func TestWhisperFollowsGuide(t *testing.T) {
+	setupTest(t)
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer confRoom.Close(closeReasonPublisherLeft)
+	whisperTrack := func(sub *Subscriber) *webrtc.TrackLocalStaticRTP {
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		return sub.whisperTrack
+	}
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111}, Payload: []byte{0xf8, 0xff, 0xfe}}
+
+	// 没有 guide 时悄悄话丢弃
+	observer := newTestSubscriber("o1", subRoleObserver)
+	trainer := newTestSubscriber("t1", subRoleTrainer)
+	for _, sub := range []*Subscriber{observer, trainer} {
+		if _, err := confRoom.AddSubscriber(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	confRoom.Whisper(capability, packet)
+	if whisperTrack(observer) != nil || whisperTrack(trainer) != nil {
+		t.Fatal("whisper reached a volunteer without a guide in the room")
+	}
+
+	guide := newTestSubscriber("g1", "")
+	if _, err := confRoom.AddSubscriber(guide); err != nil || guide.Role() != subRoleGuide {
+		t.Fatalf("guide joins as %s: %v", guide.Role(), err)
+	}
+	confRoom.Whisper(capability, packet)
+	if whisperTrack(guide) == nil || whisperTrack(observer) != nil {
+		t.Fatal("whisper is not routed to the guide only")
+	}
+
+	// trainer 把 guide 交给 observer 后悄悄话跟着新的 guide
+	if err := confRoom.Handover("t1", "o1", false); err != nil {
+		t.Fatal(err)
+	}
+	confRoom.Whisper(capability, packet)
+	if whisperTrack(observer) == nil {
+		t.Fatal("whisper does not follow the new guide")
+	}
+}
+
+// createTestRoom 盲人通过 /ws 创建房间，一个志愿者加入，返回盲人、志愿者和 resumeToken
+func createTestRoom(t *testing.T, server *httptest.Server, roomName string) (*testClient, *testClient, string) {
+	t.Helper()
+	blind, guide := dialSignaling(t, server, "", nil), dialSignaling(t, server, "", nil)
+	blind.send(cmdCreate, map[string]interface{}{"roomName": roomName, "userId": "blind1", "sdp": testPublisherOffer(t)})
+	var answer answerReply
+	if err := json.Unmarshal(blind.expect("answer").raw, &answer); err != nil || len(answer.ResumeToken) == 0 {
+		t.Fatalf("create answer %+v: %v", answer, err)
+	}
+	guide.send(cmdJoin, map[string]interface{}{"roomName": roomName, "userId": "g1", "sdp": testOffer(t)})
+	guide.expect("answer")
+	return blind, guide, answer.ResumeToken
+}
+
+func TestResumeWithinReconnectGrace(t *testing.T) {
+	setupTest(t)
+	config.Room.ReconnectGrace = 500 * time.Millisecond
+	server := startSignaling(t)
+	_, guide, resumeToken := createTestRoom(t, server, "room1")
+	confRoom, _ := Rooms.Get("room1")
+	defer confRoom.Close(closeReasonPublisherLeft)
+
+	// 测试里的 PeerConnection 连不上 ICE，直接模拟盲人断线和重连后连上
+	oldPC := confRoom.GetPubPC()
+	confRoom.PublisherDisconnected(oldPC)
+	if s := guide.expect("publisherState"); s.State != RoomReconnecting.String() {
+		t.Fatalf("publisherState %s", s.raw)
+	}
+
+	blind := dialSignaling(t, server, "", nil)
+	for _, token := range []string{"wrong", resumeToken[1:]} {
+		blind.send(cmdResume, map[string]interface{}{"roomName": "room1", "userId": "blind1", "resumeToken": token, "sdp": testPublisherOffer(t)})
+		blind.expectError(cmdResume, errCodeResumeFailed)
+	}
+	blind.send(cmdResume, map[string]interface{}{"roomName": "room2", "userId": "blind1", "resumeToken": resumeToken, "sdp": testPublisherOffer(t)})
+	blind.expectError(cmdResume, errCodeResumeFailed)
+	if confRoom.GetPubPC() != oldPC || confRoom.State() != RoomReconnecting {
+		t.Fatal("failed resume replaced the publisher")
+	}
+
+	blind.send(cmdResume, map[string]interface{}{"roomName": "room1", "userId": "blind1", "resumeToken": resumeToken, "sdp": testPublisherOffer(t)})
+	var answer answerReply
+	if err := json.Unmarshal(blind.expect("answer").raw, &answer); err != nil || answer.ResumeToken != resumeToken {
+		t.Fatalf("resume answer %+v: %v", answer, err)
+	}
+	newPC := confRoom.GetPubPC()
+	if newPC == oldPC {
+		t.Fatal("resume kept the old publisher connection")
+	}
+	confRoom.PublisherConnected(newPC)
+	if s := guide.expect("publisherState"); s.State != RoomLive.String() {
+		t.Fatalf("publisherState %s", s.raw)
+	}
+
+	// 宽限期过了房间还在，旧连接关闭也不会关房间
+	oldPC.Close()
+	time.Sleep(config.Room.ReconnectGrace + 200*time.Millisecond)
+	if current, exists := Rooms.Get("room1"); !exists || current != confRoom || confRoom.State() != RoomLive {
+		t.Fatalf("room is %v after a resume inside the grace period", confRoom.State())
+	}
+	if !guide.quiet("roomClosed", 50*time.Millisecond) {
+		t.Fatal("guide is told the room closed")
+	}
+}
+
+func TestReconnectGraceClosesRoom(t *testing.T) {
+	setupTest(t)
+	config.Room.ReconnectGrace = 200 * time.Millisecond
+	server := startSignaling(t)
+	_, guide, resumeToken := createTestRoom(t, server, "room1")
+	confRoom, _ := Rooms.Get("room1")
+	defer confRoom.Close(closeReasonPublisherLeft)
+
+	start := time.Now()
+	confRoom.PublisherDisconnected(confRoom.GetPubPC())
+	if closed := guide.expect("roomClosed"); closed.Reason != closeReasonPublisherTimeout {
+		t.Fatalf("roomClosed %s", closed.raw)
+	}
+	if elapsed := time.Since(start); elapsed < config.Room.ReconnectGrace {
+		t.Fatalf("room closed after %v", elapsed)
+	}
+	if !waitFor(time.Second, func() bool { _, exists := Rooms.Get("room1"); return !exists }) {
+		t.Fatal("room is still listed after the grace period")
+	}
+
+	// 宽限期过后 token 不再有效
+	blind := dialSignaling(t, server, "", nil)
+	blind.send(cmdResume, map[string]interface{}{"roomName": "room1", "userId": "blind1", "resumeToken": resumeToken, "sdp": testPublisherOffer(t)})
+	blind.expectError(cmdResume, errCodeResumeFailed)
+}
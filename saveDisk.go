@@ -10,8 +10,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 	"yanglei_blinder/logger"
 
 	"github.com/at-wat/ebml-go/webm"
@@ -30,6 +32,16 @@ type webmSaver struct {
 	mu            sync.Mutex
 }
 
+// recordFileSafe 把 userId 里不能放进文件名的字符换成 _，避免 / 之类的字符跳出录制目录
+func recordFileSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
 func newWebmSaver(fileName string) *webmSaver {
 	return &webmSaver{
 		filenName:    fileName,
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+	"yanglei_blinder/logger"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// peerSignaler 是服务端主动给某个参与者发消息用的信令通道
+type peerSignaler interface {
+	SendOffer(offerSdp string) error
+	WriteJSON(v interface{}) error
+}
+
+// wsSession 对应一条 /ws 连接。
+// gorilla/websocket 不允许并发写，而 OnICECandidate 等回调运行在 pion 的 goroutine 中，
+// 所以所有写操作都要经过 mu。
+type wsSession struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+
+	// claims 是连接时带上的 token，未启用鉴权时为 nil
+	claims *authClaims
+
+	// 当前连接上协商出来的 PeerConnection，用于 AddICECandidate
+	pc *webrtc.PeerConnection
+
+	// trickle 模式下，answer 发出之前收集到的 candidate 先缓存，避免客户端在没有
+	// remote description 时收到 candidate
+	answerSent        bool
+	pendingCandidates []*webrtc.ICECandidate
+}
+
+func newWsSession(conn *websocket.Conn, claims *authClaims) *wsSession {
+	return &wsSession{conn: conn, claims: claims}
+}
+
+// authorize 检查连接的 token 是否允许以 roles 之一操作 roomName。
+// 启用鉴权时 userID 以 token 里的用户为准，客户端自己填的会被覆盖
+func (s *wsSession) authorize(roomName string, userID *string, roles ...string) error {
+	if s.claims == nil {
+		return nil
+	}
+	if !s.claims.HasRole(roles...) {
+		return newSignalError(errCodeForbidden, "role %s is not allowed", s.claims.Role)
+	}
+	if !s.claims.CanAccessRoom(roomName) {
+		return newSignalError(errCodeForbidden, "token is not for room %s", roomName)
+	}
+	*userID = s.claims.Subject
+	return nil
+}
+
+// authorizeRole 和 authorize 一样，但不针对某个房间，用于派单这类还没有确定房间的命令
+func (s *wsSession) authorizeRole(userID *string, roles ...string) error {
+	if s.claims == nil {
+		return nil
+	}
+	if !s.claims.HasRole(roles...) {
+		return newSignalError(errCodeForbidden, "role %s is not allowed", s.claims.Role)
+	}
+	*userID = s.claims.Subject
+	return nil
+}
+
+// canAccessRoom token 限定了房间时只能进入这个房间
+func (s *wsSession) canAccessRoom(roomName string) bool {
+	return s.claims == nil || s.claims.CanAccessRoom(roomName)
+}
+
+// isAdmin 连接的 token 是管理员
+func (s *wsSession) isAdmin() bool {
+	return s.claims != nil && s.claims.Role == roleAdmin
+}
+
+// serverShutdownMessage 在服务关闭前推给所有连接
+type serverShutdownMessage struct {
+	Type string `json:"type"`
+}
+
+// sessionRegistry 记录所有 /ws 连接，服务关闭时通知并断开它们
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*wsSession]struct{}
+	closed   bool
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[*wsSession]struct{})}
+}
+
+// Add 登记一条连接，服务已经在关闭时返回 false
+func (r *sessionRegistry) Add(s *wsSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.sessions[s] = struct{}{}
+	return true
+}
+
+func (r *sessionRegistry) Remove(s *wsSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s)
+}
+
+func (r *sessionRegistry) list() []*wsSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := make([]*wsSession, 0, len(r.sessions))
+	for s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// NotifyShutdown 不再接受新连接，并告诉现有连接服务即将关闭
+func (r *sessionRegistry) NotifyShutdown() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+
+	for _, s := range r.list() {
+		if err := s.WriteJSON(serverShutdownMessage{Type: "serverShutdown"}); err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// CloseAll 发送 going away 的 close 帧并断开所有连接
+func (r *sessionRegistry) CloseAll() {
+	for _, s := range r.list() {
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+		s.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		s.conn.Close()
+	}
+}
+
+var Sessions = newSessionRegistry()
+
+func (s *wsSession) writeJSONLocked(v interface{}) error {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(websocket.TextMessage, jsonData)
+}
+
+func (s *wsSession) WriteJSON(v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeJSONLocked(v)
+}
+
+// resetNegotiation 在处理新的 offer 之前调用，丢弃上一次协商残留的状态
+func (s *wsSession) resetNegotiation() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.answerSent = false
+	s.pendingCandidates = nil
+}
+
+// SendAnswer 发送 answer，并把之前缓存的 candidate 依次发出
+func (s *wsSession) SendAnswer(reply answerReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reply.Type = "answer"
+	if err := s.writeJSONLocked(reply); err != nil {
+		return err
+	}
+	s.answerSent = true
+
+	pending := s.pendingCandidates
+	s.pendingCandidates = nil
+	for _, c := range pending {
+		if err := s.writeCandidateLocked(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendOffer 发送服务端发起的重新协商 offer，客户端用 {"cmd":"answer","sdp":...} 应答
+func (s *wsSession) SendOffer(offerSdp string) error {
+	return s.WriteJSON(map[string]string{"offer": offerSdp, "type": "offer"})
+}
+
+// OnLocalCandidate 作为 PeerConnection.OnICECandidate 的回调，c 为 nil 表示收集完成
+func (s *wsSession) OnLocalCandidate(c *webrtc.ICECandidate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.answerSent {
+		s.pendingCandidates = append(s.pendingCandidates, c)
+		return
+	}
+	if err := s.writeCandidateLocked(c); err != nil {
+		logger.Error(err)
+	}
+}
+
+func (s *wsSession) writeCandidateLocked(c *webrtc.ICECandidate) error {
+	if c == nil {
+		return s.writeJSONLocked(map[string]string{"type": "endOfCandidates"})
+	}
+	return s.writeJSONLocked(map[string]interface{}{"type": "candidate", "candidate": c.ToJSON()})
+}
+
+// AddRemoteCandidate 把客户端 trickle 过来的 candidate 交给 PeerConnection，
+// 空的 candidate 表示对端收集完成
+func (s *wsSession) AddRemoteCandidate(candidate webrtc.ICECandidateInit) error {
+	s.mu.Lock()
+	pc := s.pc
+	s.mu.Unlock()
+
+	if pc == nil {
+		logger.Warn("recv candidate before offer, ignore it")
+		return nil
+	}
+	return pc.AddICECandidate(candidate)
+}
+
+func (s *wsSession) SetPeerConnection(pc *webrtc.PeerConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pc = pc
+}
+
+// SendError 把处理失败的原因回给客户端，非 signalError 的错误统一当作 internal_error
+func (s *wsSession) SendError(cmd string, err error) {
+	var sErr *signalError
+	if !errors.As(err, &sErr) {
+		sErr = newSignalError(errCodeInternal, "%v", err)
+	}
+	if writeErr := s.WriteJSON(errorReply{Type: "error", Cmd: cmd, Code: sErr.Code, Reason: sErr.Reason}); writeErr != nil {
+		logger.Error(writeErr)
+	}
+}
+
+// HandleMessage 按 cmd 分发一条客户端消息
+func (s *wsSession) HandleMessage(cmd string, message []byte) error {
+	switch cmd {
+	case cmdCreate:
+		return s.handleCreate(message)
+	case cmdJoin:
+		return s.handleJoin(message)
+	case cmdControl:
+		return s.handleControl(message)
+	case cmdLeave:
+		return s.handleLeave(message)
+	case cmdAnswer:
+		return s.handleAnswer(message)
+	case cmdResume:
+		return s.handleResume(message)
+	case cmdRestart:
+		return s.handleRestart(message)
+	case cmdCandidate:
+		return s.handleCandidate(message)
+	case cmdEndOfCandidates:
+		return s.AddRemoteCandidate(webrtc.ICECandidateInit{})
+	case cmdAvailable:
+		return s.handleAvailable(message)
+	case cmdUnavailable:
+		return s.handleUnavailable(message)
+	case cmdAccept:
+		return s.handleAccept(message)
+	case cmdDecline:
+		return s.handleDecline(message)
+	case cmdWatchPresence:
+		return s.handleWatchPresence(message)
+	case cmdHandover:
+		return s.handleHandover(message)
+	case cmdCancelPrompt, cmdStopPrompts:
+		return s.handlePrompt(cmd, message)
+	default:
+		return newSignalError(errCodeUnknownCmd, "invalid msgCmd: %s", cmd)
+	}
+}
+
+// candidateHandler 客户端在 create/join 中带上 "trickle": true 时返回 OnICECandidate 回调，
+// 否则返回 nil，此时仍然等待 ICE 收集完成后再回 answer，兼容老客户端
+func (s *wsSession) candidateHandler(trickle bool) func(*webrtc.ICECandidate) {
+	if trickle {
+		return s.OnLocalCandidate
+	}
+	return nil
+}
+
+func (s *wsSession) handleCreate(message []byte) error {
+	var msg createMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	if err := s.authorize(msg.RoomName, &msg.UserID, roleBlind); err != nil {
+		return err
+	}
+	logger.Infof("roomName:%s", msg.RoomName)
+
+	createdRoom, err := Rooms.Create(msg.RoomName, msg.UserID, msg.ResumeToken, msg.Language)
+	if err != nil {
+		return err
+	}
+	createdRoom.Skills = msg.Skills
+	createdRoom.SetPubSignaler(s)
+	s.resetNegotiation()
+	answerSdp, err := HandlePubOffer(msg.Sdp, createdRoom, s.candidateHandler(msg.Trickle))
+	if err != nil {
+		// 盲人没有拿到 resumeToken，房间留着只会占住房间名和加入码
+		createdRoom.Close(closeReasonCreateFailed)
+		return err
+	}
+	s.SetPeerConnection(createdRoom.GetPubPC())
+	if err := s.SendAnswer(answerReply{Answer: answerSdp, RoomName: createdRoom.Name, ResumeToken: createdRoom.resumeToken, JoinCode: createdRoom.JoinCode, ICEServers: iceConfig.ReplyFor(msg.UserID)}); err != nil {
+		createdRoom.Close(closeReasonCreateFailed)
+		return err
+	}
+	Dispatch.Enqueue(createdRoom)
+	return nil
+}
+
+// handleResume 盲人在宽限期内用新的 PeerConnection 接管原来的房间，
+// 志愿者的轨道继续使用，录制文件也继续写
+func (s *wsSession) handleResume(message []byte) error {
+	var msg resumeMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	if err := s.authorize(msg.RoomName, &msg.UserID, roleBlind); err != nil {
+		return err
+	}
+
+	resumeRoom, exists := Rooms.Get(msg.RoomName)
+	if !exists || !resumeRoom.Joinable() {
+		return newSignalError(errCodeResumeFailed, "room %s does not exist", msg.RoomName)
+	}
+	if !resumeRoom.ResumeTokenMatches(msg.ResumeToken) {
+		return newSignalError(errCodeResumeFailed, "resumeToken of room %s mismatch", msg.RoomName)
+	}
+	logger.Infof("publisher resume room %s", msg.RoomName)
+
+	resumeRoom.SetPubSignaler(s)
+
+	s.resetNegotiation()
+	answerSdp, err := HandlePubOffer(msg.Sdp, resumeRoom, s.candidateHandler(msg.Trickle))
+	if err != nil {
+		return err
+	}
+	s.SetPeerConnection(resumeRoom.GetPubPC())
+	return s.SendAnswer(answerReply{Answer: answerSdp, RoomName: resumeRoom.Name, ResumeToken: resumeRoom.resumeToken, ICEServers: iceConfig.ReplyFor(msg.UserID)})
+}
+
+// handleRestart 信令连接还在时，客户端对现有 PeerConnection 发起 ICE restart
+func (s *wsSession) handleRestart(message []byte) error {
+	var msg restartMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+
+	s.mu.Lock()
+	pc := s.pc
+	s.mu.Unlock()
+	if pc == nil {
+		return newSignalError(errCodeNoPeerConnection, "nothing to restart")
+	}
+
+	offer := webrtc.SessionDescription{}
+	if err := decode(msg.Sdp, &offer); err != nil {
+		return newSignalError(errCodeBadSdp, "%v", err)
+	}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return newSignalError(errCodeBadSdp, "%v", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+
+	s.resetNegotiation()
+	if err := setLocalAnswer(pc, answer, s.candidateHandler(msg.Trickle)); err != nil {
+		return err
+	}
+	return s.SendAnswer(answerReply{Answer: encode(pc.LocalDescription())})
+}
+
+func (s *wsSession) handleJoin(message []byte) error {
+	var msg joinMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	logger.Infof("roomName: %s, joinCode: %s", msg.RoomName, msg.JoinCode)
+
+	var joinRoom *ConfRoom
+	var exists bool
+	if len(msg.JoinCode) > 0 {
+		if joinRoom, exists = Rooms.GetByCode(msg.JoinCode); !exists || !joinRoom.Joinable() {
+			return newSignalError(errCodeRoomNotFound, "join code %s does not exist", msg.JoinCode)
+		}
+	} else if joinRoom, exists = Rooms.Get(msg.RoomName); !exists || !joinRoom.Joinable() {
+		return newSignalError(errCodeRoomNotFound, "room %s does not exist", msg.RoomName)
+	}
+	if err := s.authorize(joinRoom.Name, &msg.UserID, roleVolunteer); err != nil {
+		return err
+	}
+
+	s.resetNegotiation()
+	answerSdp, subPC, err := HandleSubOffer(msg.UserID, msg.Role, msg.Sdp, joinRoom, s.candidateHandler(msg.Trickle), s)
+	if err != nil {
+		return joinFailed(joinRoom, err)
+	}
+	s.SetPeerConnection(subPC)
+	Presence.JoinedCall(s, msg.UserID, joinRoom.Name, subPC)
+	role := joinRoom.SubscriberRole(msg.UserID)
+	if role == subRoleGuide {
+		// 志愿者通过房间名或加入码直接加入，不用再派单
+		Dispatch.Fulfilled(joinRoom)
+	}
+	if err := s.SendAnswer(answerReply{Answer: answerSdp, RoomName: joinRoom.Name, Role: role, ICEServers: iceConfig.ReplyFor(msg.UserID)}); err != nil {
+		return err
+	}
+	joinRoom.NotifyRoles()
+	return nil
+}
+
+// handleAvailable 志愿者登记为 available，之后有求助时会收到 incoming
+func (s *wsSession) handleAvailable(message []byte) error {
+	var msg availableMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	if err := s.authorizeRole(&msg.UserID, roleVolunteer); err != nil {
+		return err
+	}
+	Presence.SetAvailability(s, msg.UserID, presenceAvailable, msg.Languages, msg.Skills)
+	return nil
+}
+
+// handleUnavailable 志愿者暂时离开（away），仍然在线但不再接到呼叫
+func (s *wsSession) handleUnavailable(message []byte) error {
+	var msg availableMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	if err := s.authorizeRole(&msg.UserID, roleVolunteer); err != nil {
+		return err
+	}
+	Presence.SetAvailability(s, msg.UserID, presenceAway, msg.Languages, msg.Skills)
+	return nil
+}
+
+// handleWatchPresence 订阅志愿者在线状态，给调度和看板用
+func (s *wsSession) handleWatchPresence(message []byte) error {
+	var msg watchPresenceMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	if s.claims != nil && !s.claims.HasRole(roleVolunteer) {
+		return newSignalError(errCodeForbidden, "role %s is not allowed", s.claims.Role)
+	}
+	if msg.Unwatch {
+		Presence.Unwatch(s)
+		return nil
+	}
+	return Presence.Watch(s)
+}
+
+// joinFailed 加入过程中房间开始清理时 PeerConnection 已经被关闭，各种出错都按房间不存在回复
+func joinFailed(joinRoom *ConfRoom, err error) error {
+	if !joinRoom.Joinable() {
+		return newSignalError(errCodeRoomNotFound, "room %s is closing", joinRoom.Name)
+	}
+	return err
+}
+
+// handleAccept 志愿者接听呼叫，第一个接听的加入房间，其他人收到 incomingCancelled
+func (s *wsSession) handleAccept(message []byte) error {
+	var msg acceptMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	if err := s.authorizeRole(&msg.UserID, roleVolunteer); err != nil {
+		return err
+	}
+
+	joinRoom, err := Dispatch.Accept(s, msg.RequestID, msg.UserID)
+	if err != nil {
+		return err
+	}
+	if !joinRoom.Joinable() {
+		return newSignalError(errCodeRoomNotFound, "room %s does not exist", joinRoom.Name)
+	}
+
+	s.resetNegotiation()
+	answerSdp, subPC, err := HandleSubOffer(msg.UserID, "", msg.Sdp, joinRoom, s.candidateHandler(msg.Trickle), s)
+	if err != nil {
+		// 没有加入成功，重新派单
+		Dispatch.Enqueue(joinRoom)
+		return joinFailed(joinRoom, err)
+	}
+	s.SetPeerConnection(subPC)
+	Presence.JoinedCall(s, msg.UserID, joinRoom.Name, subPC)
+	if err := s.SendAnswer(answerReply{Answer: answerSdp, RoomName: joinRoom.Name, Role: joinRoom.SubscriberRole(msg.UserID), ICEServers: iceConfig.ReplyFor(msg.UserID)}); err != nil {
+		return err
+	}
+	joinRoom.NotifyRoles()
+	return nil
+}
+
+func (s *wsSession) handleDecline(message []byte) error {
+	var msg declineMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	if err := s.authorizeRole(&msg.UserID, roleVolunteer); err != nil {
+		return err
+	}
+	Dispatch.Decline(s, msg.RequestID)
+	return nil
+}
+
+func (s *wsSession) handleControl(message []byte) error {
+	var msg controlMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	joinRoom, err := s.guideRoom(msg.RoomName, &msg.UserID)
+	if err != nil {
+		return err
+	}
+	if len(msg.Text) > 0 {
+		req, err := Speech.NewRequest(msg.Text, msg.Voice, joinRoom.Language)
+		if err != nil {
+			return newSignalError(errCodeTTSFailed, "synthesize text: %v", err)
+		}
+		// 合成可能要几秒，不能阻塞读消息的循环，失败时再异步回 error
+		if !joinRoom.Go(func() { s.playText(joinRoom, req) }) {
+			return newSignalError(errCodeRoomNotFound, "room %s is closing", joinRoom.Name)
+		}
+		return nil
+	}
+	// 志愿者发的是和语言无关的 ID，按盲人的语言选择
+	prompt, exists := Catalog.Resolve(msg.CmdDetail, joinRoom.Language)
+	if !exists || !prompt.Sendable() {
+		return newSignalError(errCodeUnknownPrompt, "unknown prompt %s", msg.CmdDetail)
+	}
+
+	_, err = joinRoom.prompts.Play(prompt, s)
+	return err
+}
+
+// playText 合成文字后放进房间的提示音队列，房间关闭时放弃
+func (s *wsSession) playText(joinRoom *ConfRoom, req *ttsRequest) {
+	prompt, err := Speech.Prompt(joinRoom.Context(), req)
+	if err != nil {
+		if joinRoom.Context().Err() == nil {
+			s.SendError(cmdControl, newSignalError(errCodeTTSFailed, "synthesize text: %v", err))
+		}
+		return
+	}
+	if _, err := joinRoom.prompts.Play(prompt, s); err != nil {
+		s.SendError(cmdControl, err)
+	}
+}
+
+// handlePrompt 处理 cancelPrompt 和 stopPrompts
+func (s *wsSession) handlePrompt(cmd string, message []byte) error {
+	var msg promptMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	promptRoom, err := s.guideRoom(msg.RoomName, &msg.UserID)
+	if err != nil {
+		return err
+	}
+	if cmd == cmdStopPrompts {
+		promptRoom.prompts.Stop()
+		return nil
+	}
+	if !promptRoom.prompts.Cancel(msg.PlayID) {
+		return newSignalError(errCodeUnknownPrompt, "prompt %s is not queued or playing in room %s", msg.PlayID, msg.RoomName)
+	}
+	return nil
+}
+
+// guideRoom 返回 userID 作为 guide 所在的房间，只有 guide 能指挥盲人，管理员不受限制
+func (s *wsSession) guideRoom(roomName string, userID *string) (*ConfRoom, error) {
+	if err := s.authorize(roomName, userID, roleVolunteer); err != nil {
+		return nil, err
+	}
+	guideRoom, exists := Rooms.Get(roomName)
+	if !exists || !guideRoom.Joinable() {
+		return nil, newSignalError(errCodeRoomNotFound, "room %s does not exist", roomName)
+	}
+	if !s.isAdmin() && guideRoom.SubscriberRole(*userID) != subRoleGuide {
+		return nil, newSignalError(errCodeForbidden, "only the guide can send control in room %s", roomName)
+	}
+	return guideRoom, nil
+}
+
+// handleHandover 把 guide 交给房间里的另一个志愿者，房间里的志愿者都会收到新的 roles
+func (s *wsSession) handleHandover(message []byte) error {
+	var msg handoverMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	if err := s.authorize(msg.RoomName, &msg.UserID, roleVolunteer); err != nil {
+		return err
+	}
+	handoverRoom, exists := Rooms.Get(msg.RoomName)
+	if !exists || !handoverRoom.Joinable() {
+		return newSignalError(errCodeRoomNotFound, "room %s does not exist", msg.RoomName)
+	}
+	return handoverRoom.Handover(msg.UserID, msg.To, s.isAdmin())
+}
+
+// handleLeave 关闭当前连接上的 PeerConnection，后续清理由 OnICEConnectionStateChange 完成
+func (s *wsSession) handleLeave(message []byte) error {
+	var msg leaveMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+
+	s.mu.Lock()
+	pc := s.pc
+	s.pc = nil
+	s.mu.Unlock()
+
+	if pc == nil {
+		return newSignalError(errCodeNoPeerConnection, "nothing to leave")
+	}
+	return pc.Close()
+}
+
+func (s *wsSession) handleCandidate(message []byte) error {
+	var msg candidateMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+	if err := s.AddRemoteCandidate(msg.Candidate); err != nil {
+		return newSignalError(errCodeBadCandidate, "%v", err)
+	}
+	return nil
+}
+
+func (s *wsSession) handleAnswer(message []byte) error {
+	var msg answerMessage
+	if sErr := decodeMessage(message, &msg); sErr != nil {
+		return sErr
+	}
+
+	s.mu.Lock()
+	pc := s.pc
+	s.mu.Unlock()
+	if pc == nil {
+		return newSignalError(errCodeNoPeerConnection, "recv answer before offer")
+	}
+
+	answer := webrtc.SessionDescription{}
+	if err := decode(msg.Sdp, &answer); err != nil {
+		return newSignalError(errCodeBadSdp, "%v", err)
+	}
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		return newSignalError(errCodeBadSdp, "%v", err)
+	}
+	return nil
+}
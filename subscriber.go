@@ -0,0 +1,210 @@
+package main
+
+import (
+	"sync"
+	"yanglei_blinder/logger"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// 志愿者在房间里的角色：同一时间只有一个 guide 能对盲人说话和发 control，
+// observer 只收不发，trainer 的声音只有 guide 能听到（悄悄话）
+const (
+	subRoleGuide    = "guide"
+	subRoleObserver = "observer"
+	subRoleTrainer  = "trainer"
+)
+
+func validSubRole(role string) bool {
+	switch role {
+	case subRoleGuide, subRoleObserver, subRoleTrainer:
+		return true
+	}
+	return false
+}
+
+// Subscriber 是加入房间的志愿者。
+// 志愿者可以在盲人的视频/音频轨道到达之前加入，轨道出现（或编码变化）时由服务端
+// 通过 OnNegotiationNeeded 重新发 offer 给客户端。
+type Subscriber struct {
+	UserID string
+	PC     *webrtc.PeerConnection
+
+	trickle     bool
+	signaler    peerSignaler
+	recordSaver *webmSaver
+	closeOnce   sync.Once
+
+	mu          sync.Mutex
+	negotiated  bool // 首次 answer 已经发出
+	pending     bool // 首次 answer 发出之前有轨道变化，需要补一次协商
+	videoTrack  *webrtc.TrackLocalStaticRTP
+	audioTrack  *webrtc.TrackLocalStaticRTP
+	videoSender *webrtc.RTPSender
+	audioSender *webrtc.RTPSender
+	// role 由 ConfRoom 在持有 confRoom.mu 时分配，读不需要 confRoom.mu
+	role string
+	// whisperTrack 是 guide 收听 trainer 悄悄话的轨道，第一次有悄悄话时才加上
+	whisperTrack  *webrtc.TrackLocalStaticRTP
+	whisperSender *webrtc.RTPSender
+
+	negotiateMu sync.Mutex
+}
+
+// newSubscriber role 为空时由 AddSubscriber 决定：房间里还没有 guide 就是 guide，否则是 observer
+func newSubscriber(userID string, role string, pc *webrtc.PeerConnection, trickle bool, signaler peerSignaler, recordSaver *webmSaver) *Subscriber {
+	return &Subscriber{
+		UserID:      userID,
+		PC:          pc,
+		trickle:     trickle,
+		signaler:    signaler,
+		recordSaver: recordSaver,
+		role:        role,
+	}
+}
+
+func (sub *Subscriber) Role() string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.role
+}
+
+func (sub *Subscriber) setRole(role string) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.role = role
+}
+
+// Notify 通过志愿者的信令连接推送一条消息
+func (sub *Subscriber) Notify(v interface{}) {
+	if err := sub.signaler.WriteJSON(v); err != nil {
+		logger.Error(err)
+	}
+}
+
+// Close 关闭志愿者的 PeerConnection 并结束录制，可以重复调用
+func (sub *Subscriber) Close() {
+	sub.closeOnce.Do(func() {
+		if err := sub.PC.Close(); err != nil {
+			logger.Error(err)
+		}
+		sub.recordSaver.mu.Lock()
+		sub.recordSaver.Close()
+		sub.recordSaver.mu.Unlock()
+	})
+}
+
+func sameCodec(a, b webrtc.RTPCodecCapability) bool {
+	return a.MimeType == b.MimeType && a.ClockRate == b.ClockRate && a.Channels == b.Channels && a.SDPFmtpLine == b.SDPFmtpLine
+}
+
+// attachTrack 为盲人的某个远端轨道准备转发用的本地轨道。
+// 编码没变时复用原来的轨道（盲人重连时志愿者不需要重新协商），否则替换掉旧的 sender。
+func (sub *Subscriber) attachTrack(kind webrtc.RTPCodecType, capability webrtc.RTPCodecCapability) (*webrtc.TrackLocalStaticRTP, error) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	track, sender := &sub.videoTrack, &sub.videoSender
+	if kind == webrtc.RTPCodecTypeAudio {
+		track, sender = &sub.audioTrack, &sub.audioSender
+	}
+	return sub.attachLocked(track, sender, capability, kind.String(), "pion")
+}
+
+// attachWhisperTrack 为 guide 准备收听悄悄话的轨道，和盲人的声音是两条轨道，客户端可以分开播放
+func (sub *Subscriber) attachWhisperTrack(capability webrtc.RTPCodecCapability) (*webrtc.TrackLocalStaticRTP, error) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.attachLocked(&sub.whisperTrack, &sub.whisperSender, capability, "whisper", "whisper")
+}
+
+func (sub *Subscriber) attachLocked(track **webrtc.TrackLocalStaticRTP, sender **webrtc.RTPSender, capability webrtc.RTPCodecCapability, id string, streamID string) (*webrtc.TrackLocalStaticRTP, error) {
+	if *track != nil && sameCodec((*track).Codec(), capability) {
+		return *track, nil
+	}
+
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(capability, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	if *sender != nil {
+		if err := sub.PC.RemoveTrack(*sender); err != nil {
+			logger.Error(err)
+		}
+	}
+	rtpSender, err := sub.PC.AddTrack(localTrack)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		rtcpBuf := make([]byte, 1500)
+		for {
+			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+				return
+			}
+		}
+	}()
+
+	*track, *sender = localTrack, rtpSender
+	if !sub.negotiated {
+		sub.pending = true
+	}
+	return localTrack, nil
+}
+
+// startNegotiation 在首次 answer 发出后调用，之后的轨道变化都通过 OnNegotiationNeeded 重新协商
+func (sub *Subscriber) startNegotiation() {
+	sub.PC.OnNegotiationNeeded(func() {
+		// 回调运行在 pion 的 operations 队列里，不能在这里同步地 SetLocalDescription
+		go sub.renegotiate()
+	})
+
+	sub.mu.Lock()
+	sub.negotiated = true
+	pending := sub.pending
+	sub.pending = false
+	sub.mu.Unlock()
+
+	if pending {
+		go sub.renegotiate()
+	}
+}
+
+// clearPending 在 CreateAnswer 之前调用，此前挂上去的轨道都会包含在首次 answer 里
+func (sub *Subscriber) clearPending() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.pending = false
+}
+
+func (sub *Subscriber) renegotiate() {
+	sub.negotiateMu.Lock()
+	defer sub.negotiateMu.Unlock()
+
+	// 上一个 offer 还没有收到 answer，回到 stable 之后 pion 会再次触发 OnNegotiationNeeded
+	if sub.PC.SignalingState() != webrtc.SignalingStateStable {
+		return
+	}
+	logger.Infof("renegotiate with subscriber %s", sub.UserID)
+
+	offer, err := sub.PC.CreateOffer(nil)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	var gatherComplete <-chan struct{}
+	if !sub.trickle {
+		gatherComplete = webrtc.GatheringCompletePromise(sub.PC)
+	}
+	if err = sub.PC.SetLocalDescription(offer); err != nil {
+		logger.Error(err)
+		return
+	}
+	if gatherComplete != nil {
+		<-gatherComplete
+	}
+
+	if err := sub.signaler.SendOffer(encode(sub.PC.LocalDescription())); err != nil {
+		logger.Error(err)
+	}
+}
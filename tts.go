@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"yanglei_blinder/logger"
+)
+
+// promptCategoryTTS 是志愿者输入文字合成的提示音
+const promptCategoryTTS = "tts"
+
+var errTTSDisabled = errors.New("tts is disabled")
+
+// TTSConfig 是文字转语音的配置，Engine 为空时不启用
+type TTSConfig struct {
+	// Engine 取值 espeak-ng、piper
+	Engine string `yaml:"engine"`
+	// Command 是引擎的可执行文件，为空时就是 Engine
+	Command string `yaml:"command"`
+	// Voice 是默认的声音：espeak-ng 是语音名，为空时是 cmn；piper 是模型文件（.onnx），没有默认值
+	Voice string `yaml:"voice"`
+	// LanguageVoices 按房间的语言（盲人 create 时的 language）选择声音，zh-CN 没有时找 zh，再找 prompts.defaultLanguage，都没有时用 Voice
+	LanguageVoices map[string]string `yaml:"languageVoices"`
+	// Voices 是 control 里可以选择的其它声音
+	Voices []string `yaml:"voices"`
+	// CacheDir 保存合成好的 Ogg/Opus，同样的文字和声音不会再合成
+	CacheDir string `yaml:"cacheDir"`
+	// MaxCacheMB 是 CacheDir 最多占用的空间，超过时删除最久没有用过的
+	MaxCacheMB int `yaml:"maxCacheMB"`
+	// MaxText 是一次最多合成的字数
+	MaxText int           `yaml:"maxText"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *TTSConfig) Enabled() bool {
+	return len(c.Engine) > 0
+}
+
+// DefaultVoice 返回 Voice，为空时是引擎默认的声音
+func (c *TTSConfig) DefaultVoice() string {
+	if len(c.Voice) > 0 {
+		return c.Voice
+	}
+	return ttsEngines[c.Engine].defaultVoice
+}
+
+// voiceFor 按 language 选择声音，规则和提示音一样：先找 zh-CN，再找 zh，再找 defaultLanguage，都没有时用默认的声音
+func (c *TTSConfig) voiceFor(language string, defaultLanguage string) string {
+	language = strings.ToLower(language)
+	base, _, _ := strings.Cut(language, "-")
+	for _, candidate := range []string{language, base, strings.ToLower(defaultLanguage)} {
+		if voice, exists := c.LanguageVoices[candidate]; exists && len(candidate) > 0 {
+			return voice
+		}
+	}
+	return c.DefaultVoice()
+}
+
+// allowedVoice control 里能否选择 voice
+func (c *TTSConfig) allowedVoice(voice string) bool {
+	if voice == c.DefaultVoice() || slices.Contains(c.Voices, voice) {
+		return true
+	}
+	for _, languageVoice := range c.LanguageVoices {
+		if voice == languageVoice {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *TTSConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	engine, exists := ttsEngines[c.Engine]
+	if !exists {
+		return fmt.Errorf("tts.engine %q is invalid, use espeak-ng or piper", c.Engine)
+	}
+	if len(c.DefaultVoice()) == 0 {
+		return fmt.Errorf("tts.voice is required for %s", c.Engine)
+	}
+	voices := append([]string{c.DefaultVoice()}, c.Voices...)
+	for language, voice := range c.LanguageVoices {
+		if !promptIDPattern.MatchString(language) || language != strings.ToLower(language) {
+			return fmt.Errorf("tts.languageVoices: invalid language %q, use lower case like zh or en-us", language)
+		}
+		voices = append(voices, voice)
+	}
+	for _, voice := range voices {
+		if len(voice) == 0 {
+			return errors.New("tts voices must not be empty")
+		}
+		if len(engine.modelSuffix) > 0 && !strings.HasSuffix(voice, engine.modelSuffix) {
+			return fmt.Errorf("tts voice %q is not a %s model, %s voices are %s files", voice, c.Engine, c.Engine, engine.modelSuffix)
+		}
+	}
+	if len(c.CacheDir) == 0 {
+		return errors.New("tts.cacheDir is required")
+	}
+	if c.MaxCacheMB <= 0 {
+		return errors.New("tts.maxCacheMB must be positive")
+	}
+	if c.MaxText <= 0 || c.Timeout <= 0 {
+		return errors.New("tts.maxText and tts.timeout must be positive")
+	}
+	// 引擎输出的 wav 要用 ffmpeg 编码，没有时每次合成都会失败
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("tts needs ffmpeg with libopus: %w", err)
+	}
+	return nil
+}
+
+// ttsEngine 把文字合成为 wav 文件
+type ttsEngine interface {
+	Synthesize(ctx context.Context, text string, voice string, wavPath string) error
+}
+
+// ttsEngineInfo 描述一种引擎
+type ttsEngineInfo struct {
+	// defaultVoice 是 tts.voice 为空时用的声音，为空时必须配置 tts.voice
+	defaultVoice string
+	// modelSuffix 不为空时声音是这种扩展名的模型文件
+	modelSuffix string
+	// create 的参数是可执行文件
+	create func(command string) ttsEngine
+}
+
+// ttsEngines 是可以选择的引擎
+var ttsEngines = map[string]ttsEngineInfo{
+	"espeak-ng": {
+		defaultVoice: "cmn",
+		create: func(command string) ttsEngine {
+			return &commandTTS{command: command, args: func(voice, wavPath string) []string {
+				return []string{"-v", voice, "-w", wavPath, "--stdin"}
+			}}
+		},
+	},
+	"piper": {
+		modelSuffix: ".onnx",
+		create: func(command string) ttsEngine {
+			return &commandTTS{command: command, args: func(voice, wavPath string) []string {
+				return []string{"--model", voice, "--output_file", wavPath}
+			}}
+		},
+	},
+}
+
+// commandTTS 是本地命令行的引擎，文字从 stdin 传入，不经过 shell，也不会被当作参数解析
+type commandTTS struct {
+	command string
+	args    func(voice string, wavPath string) []string
+}
+
+func (e *commandTTS) Synthesize(ctx context.Context, text string, voice string, wavPath string) error {
+	cmd := exec.CommandContext(ctx, e.command, e.args(voice, wavPath)...)
+	cmd.Stdin = strings.NewReader(text)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", e.command, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// TTSService 合成志愿者输入的文字，结果按引擎、声音和文字缓存在 CacheDir 里
+type TTSService struct {
+	mu sync.Mutex
+	// pending 是正在合成的文字，同一段文字同时只合成一次，其它请求等它完成
+	pending map[string]chan struct{}
+}
+
+func NewTTSService() *TTSService {
+	return &TTSService{pending: make(map[string]chan struct{})}
+}
+
+// normalizeTTSText 去掉控制字符和多余的空白，超过 maxText 个字时返回错误
+func normalizeTTSText(text string, maxText int) (string, error) {
+	text = strings.Join(strings.FieldsFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+	if len(text) == 0 {
+		return "", errors.New("text is empty")
+	}
+	if n := utf8.RuneCountInString(text); n > maxText {
+		return "", fmt.Errorf("text has %d characters, at most %d", n, maxText)
+	}
+	return text, nil
+}
+
+// ttsRequest 是检查过的一次合成请求
+type ttsRequest struct {
+	text   string
+	voice  string
+	key    string
+	prompt *PromptInfo
+}
+
+// NewRequest 检查文字和声音，不合成。voice 为空时按房间的语言 language 选择
+func (t *TTSService) NewRequest(text string, voice string, language string) (*ttsRequest, error) {
+	c := &config.TTS
+	if !c.Enabled() {
+		return nil, errTTSDisabled
+	}
+	if len(voice) == 0 {
+		voice = c.voiceFor(language, config.Prompts.DefaultLanguage)
+	} else if !c.allowedVoice(voice) {
+		return nil, fmt.Errorf("voice %s is not allowed", voice)
+	}
+	text, err := normalizeTTSText(text, c.MaxText)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(c.Engine + "\x00" + voice + "\x00" + text))
+	key := hex.EncodeToString(sum[:16])
+	return &ttsRequest{text: text, voice: voice, key: key, prompt: &PromptInfo{
+		ID:        "tts-" + key,
+		Text:      text,
+		Category:  promptCategoryTTS,
+		path:      filepath.Join(c.CacheDir, key+".ogg"),
+		transient: true,
+	}}, nil
+}
+
+// Prompt 返回 req 合成后的提示音，缓存里没有时合成，最多等 tts.timeout
+func (t *TTSService) Prompt(ctx context.Context, req *ttsRequest) (*PromptInfo, error) {
+	c := &config.TTS
+	text, voice, key, prompt := req.text, req.voice, req.key, req.prompt
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	for {
+		if _, err := os.Stat(prompt.path); err == nil {
+			// 更新修改时间，清理缓存时最近用过的留下
+			now := time.Now()
+			os.Chtimes(prompt.path, now, now)
+			return prompt, nil
+		}
+		t.mu.Lock()
+		done, exists := t.pending[key]
+		if !exists {
+			break
+		}
+		t.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	t.pending[key] = done
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, key)
+		t.mu.Unlock()
+		close(done)
+	}()
+
+	start := time.Now()
+	if err := t.synthesize(ctx, text, voice, prompt.path); err != nil {
+		return nil, err
+	}
+	logger.Infof("synthesized %s in %v: %s", prompt.ID, time.Since(start), text)
+	return prompt, nil
+}
+
+// synthesize 调用引擎生成 wav，再用 ffmpeg 编码成和提示音一样的 48kHz 双声道 20ms Ogg/Opus
+func (t *TTSService) synthesize(ctx context.Context, text string, voice string, oggPath string) error {
+	c := &config.TTS
+	command := c.Command
+	if len(command) == 0 {
+		command = c.Engine
+	}
+	if err := os.MkdirAll(c.CacheDir, os.ModePerm); err != nil {
+		return err
+	}
+	wav, err := os.CreateTemp(c.CacheDir, "*.wav")
+	if err != nil {
+		return err
+	}
+	wav.Close()
+	defer os.Remove(wav.Name())
+
+	if err := ttsEngines[c.Engine].create(command).Synthesize(ctx, text, voice, wav.Name()); err != nil {
+		return err
+	}
+
+	// 先写临时文件再改名，其它连接不会读到写了一半的文件
+	tmp := oggPath + ".tmp"
+	defer os.Remove(tmp)
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-loglevel", "error",
+		"-i", wav.Name(),
+		"-c:a", "libopus",
+		"-ar", "48000",
+		"-ac", "2",
+		"-b:a", "64k",
+		"-frame_duration", "20",
+		"-f", "ogg",
+		tmp,
+	)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err := os.Rename(tmp, oggPath); err != nil {
+		return err
+	}
+	trimTTSCache(c.CacheDir, int64(c.MaxCacheMB)<<20, oggPath)
+	return nil
+}
+
+// trimTTSCache 缓存超过 limit 字节时从最久没有用过的开始删除，keep 是刚合成的，不删
+func trimTTSCache(dir string, limit int64, keep string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Warnf("read tts cache %s: %v", dir, err)
+		return
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".ogg" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	if total <= limit {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, info := range files {
+		if total <= limit {
+			break
+		}
+		path := filepath.Join(dir, info.Name())
+		if path == keep {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("remove tts cache %s: %v", path, err)
+			continue
+		}
+		total -= info.Size()
+	}
+	logger.Infof("tts cache %s trimmed to %d bytes", dir, total)
+}
+
+var Speech = NewTTSService()
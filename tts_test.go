@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTSVoiceForLanguage(t *testing.T) {
+	setupTest(t)
+	useFakeTTS(t, 0)
+	config.TTS.LanguageVoices = map[string]string{"zh": "cmn", "en": "en-us", "en-gb": "en-gb"}
+	config.TTS.Voices = []string{"yue"}
+	if err := config.TTS.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for language, want := range map[string]string{
+		"en-GB": "en-gb",
+		"en-US": "en-us",
+		"zh-CN": "cmn",
+		// 没有对应的声音时按 prompts.defaultLanguage（zh）选择
+		"fr": "cmn",
+		"":   "cmn",
+	} {
+		req, err := Speech.NewRequest("前面有台阶", "", language)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.voice != want {
+			t.Errorf("language %q: voice %s, want %s", language, req.voice, want)
+		}
+	}
+	// 指定的声音优先于语言，但必须是配置里的
+	if req, err := Speech.NewRequest("前面有台阶", "yue", "en"); err != nil || req.voice != "yue" {
+		t.Fatalf("explicit voice: %v", err)
+	}
+	if _, err := Speech.NewRequest("前面有台阶", "de", "zh"); err == nil {
+		t.Fatal("voice de is not configured but allowed")
+	}
+	// 不同的声音缓存在不同的文件里
+	zh, _ := Speech.NewRequest("stop", "", "zh")
+	en, _ := Speech.NewRequest("stop", "", "en")
+	if zh.prompt.ID == en.prompt.ID {
+		t.Fatal("voices share a cache entry")
+	}
+}
+
+func TestTTSConfigValidate(t *testing.T) {
+	setupTest(t)
+	useFakeTTS(t, 0)
+	if err := config.TTS.Validate(); err != nil || config.TTS.DefaultVoice() != "cmn" {
+		t.Fatalf("espeak-ng without voice: %v, default voice %q", err, config.TTS.DefaultVoice())
+	}
+	config.TTS.MaxCacheMB = 0
+	if err := config.TTS.Validate(); err == nil || !strings.Contains(err.Error(), "tts.maxCacheMB") {
+		t.Fatalf("unlimited cache: %v", err)
+	}
+	config.TTS.MaxCacheMB = 1
+	// 没有 ffmpeg 时不能启动
+	path := os.Getenv("PATH")
+	t.Setenv("PATH", t.TempDir())
+	if err := config.TTS.Validate(); err == nil || !strings.Contains(err.Error(), "ffmpeg") {
+		t.Fatalf("without ffmpeg: %v", err)
+	}
+	t.Setenv("PATH", path)
+
+	// piper 没有默认的声音，声音都必须是模型文件
+	config.TTS.Engine = "piper"
+	if err := config.TTS.Validate(); err == nil {
+		t.Fatal("piper without voice is valid")
+	}
+	config.TTS.Voice = "cmn"
+	if err := config.TTS.Validate(); err == nil {
+		t.Fatal("piper with voice cmn is valid")
+	}
+	config.TTS.Voice = "./voices/zh_CN-huayan-medium.onnx"
+	if err := config.TTS.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.TTS.LanguageVoices = map[string]string{"en": "en-us"}
+	if err := config.TTS.Validate(); err == nil {
+		t.Fatal("piper with language voice en-us is valid")
+	}
+	config.TTS.LanguageVoices = map[string]string{"EN": "./voices/en_US-amy-medium.onnx"}
+	if err := config.TTS.Validate(); err == nil {
+		t.Fatal("upper case language is valid")
+	}
+}
+
+// useFakeTTS 在 PATH 里放假的 espeak-ng 和 ffmpeg：合成要 delay，文字里有 fail 时失败，输出仓库里的提示音
+func useFakeTTS(t *testing.T, delay time.Duration) {
+	t.Helper()
+	ogg, err := filepath.Abs("audio/zh/ting.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := t.TempDir()
+	scripts := map[string]string{
+		"espeak-ng": "#!/bin/sh\nsleep " + fmt.Sprintf("%.2f", delay.Seconds()) + "\nif grep -q fail; then echo failed >&2; exit 1; fi\n: > \"$4\"\n",
+		"ffmpeg":    "#!/bin/sh\nfor a; do last=$a; done\ncp '" + ogg + "' \"$last\"\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	config.TTS.Engine = "espeak-ng"
+	config.TTS.CacheDir = t.TempDir()
+}
+
+func TestControlTextDoesNotBlock(t *testing.T) {
+	setupTest(t)
+	loadTestPrompts(t)
+	useFakeTTS(t, 500*time.Millisecond)
+	confRoom, err := Rooms.Create("room1", "blind", "", "zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer confRoom.Close(closeReasonPublisherLeft)
+	runMixer(confRoom)
+	guide := newTestSubscriber("guide1", "")
+	if _, err := confRoom.AddSubscriber(guide); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialSignaling(t, startSignaling(t), "", nil)
+
+	// 合成期间同一连接上的下一条命令马上有回应
+	start := time.Now()
+	c.send(cmdControl, map[string]interface{}{"roomName": "room1", "userId": "guide1", "text": "前面有台阶"})
+	c.send(cmdCancelPrompt, map[string]interface{}{"roomName": "room1", "userId": "guide1", "playId": "none"})
+	c.expectError(cmdCancelPrompt, errCodeUnknownPrompt)
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("cancelPrompt answered after %v, blocked by synthesis", elapsed)
+	}
+	if r := c.expect("promptQueued"); !strings.HasPrefix(r.PromptID, "tts-") {
+		t.Fatalf("reply %s, want the synthesized prompt queued", r.raw)
+	}
+
+	// 合成失败的错误在合成结束后异步发出；校验失败的立即返回
+	c.send(cmdControl, map[string]interface{}{"roomName": "room1", "userId": "guide1", "text": "fail"})
+	c.send(cmdControl, map[string]interface{}{"roomName": "room1", "userId": "guide1", "text": "ok", "voice": "de"})
+	for _, want := range []string{"voice de is not allowed", "failed"} {
+		if r := c.expectError(cmdControl, errCodeTTSFailed); !strings.Contains(r.Reason, want) {
+			t.Fatalf("reply %s, want tts_failed with %q for control", r.raw, want)
+		}
+	}
+}
+
+func TestTrimTTSCache(t *testing.T) {
+	dir := t.TempDir()
+	// 每个 400 字节，按 c、a、b、d 从旧到新，c.ogg 最旧但是刚合成的
+	now := time.Now()
+	for i, name := range []string{"c.ogg", "a.ogg", "b.ogg", "d.ogg"} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, make([]byte, 400), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(file, modTime, modTime)
+	}
+	os.WriteFile(filepath.Join(dir, "x.wav"), make([]byte, 4000), 0644)
+
+	trimTTSCache(dir, 1000, filepath.Join(dir, "c.ogg"))
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+	// 只算 .ogg，c.ogg 留下，删掉 a.ogg 和 b.ogg
+	if got := strings.Join(names, ","); got != "c.ogg,d.ogg,x.wav" {
+		t.Fatalf("cache after trim: %s", got)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"yanglei_blinder/logger"
+
+	"github.com/pion/turn/v4"
+)
+
+// TURNServerConfig 是内置 TURN server 的配置。
+// 认证使用和下发给客户端相同的 TURN REST 临时凭证，不需要单独部署 coturn。
+type TURNServerConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Realm 默认为 Host
+	Realm string `json:"realm,omitempty" yaml:"realm,omitempty"`
+	// Host 写进下发给客户端的 turn:/turns: URL，TLS 时需要和证书一致
+	Host string `json:"host" yaml:"host"`
+	// PublicIP 是分配给客户端的中继地址
+	PublicIP string `json:"publicIP" yaml:"publicIP"`
+
+	// 监听地址，为空时不启用对应的监听
+	UDPListen string `json:"udpListen,omitempty" yaml:"udpListen,omitempty"`
+	TCPListen string `json:"tcpListen,omitempty" yaml:"tcpListen,omitempty"`
+	TLSListen string `json:"tlsListen,omitempty" yaml:"tlsListen,omitempty"`
+	TLSCert   string `json:"tlsCert,omitempty" yaml:"tlsCert,omitempty"`
+	TLSKey    string `json:"tlsKey,omitempty" yaml:"tlsKey,omitempty"`
+
+	// 中继端口范围，都为 0 时由系统随机分配
+	RelayMinPort uint16 `json:"relayMinPort,omitempty" yaml:"relayMinPort,omitempty"`
+	RelayMaxPort uint16 `json:"relayMaxPort,omitempty" yaml:"relayMaxPort,omitempty"`
+
+	SharedSecret  string `json:"sharedSecret" yaml:"sharedSecret"`
+	CredentialTTL int    `json:"credentialTTL,omitempty" yaml:"credentialTTL,omitempty"`
+}
+
+func (c *TURNServerConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Host) == 0 {
+		return errors.New("turnServer: host is required")
+	}
+	if net.ParseIP(c.PublicIP) == nil {
+		return fmt.Errorf("turnServer: publicIP %q is invalid", c.PublicIP)
+	}
+	if len(c.SharedSecret) == 0 {
+		return errors.New("turnServer: sharedSecret is required")
+	}
+	if len(c.UDPListen) == 0 && len(c.TCPListen) == 0 && len(c.TLSListen) == 0 {
+		return errors.New("turnServer: at least one of udpListen, tcpListen and tlsListen is required")
+	}
+	if len(c.TLSListen) > 0 && (len(c.TLSCert) == 0 || len(c.TLSKey) == 0) {
+		return errors.New("turnServer: tlsCert and tlsKey are required by tlsListen")
+	}
+	if c.RelayMinPort > c.RelayMaxPort {
+		return errors.New("turnServer: relayMinPort is greater than relayMaxPort")
+	}
+	if _, err := c.ICEServer(); err != nil {
+		return fmt.Errorf("turnServer: %w", err)
+	}
+	return nil
+}
+
+func listenPort(addr string) (string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", fmt.Errorf("invalid port in %q", addr)
+	}
+	return port, nil
+}
+
+// ICEServer 返回内置 TURN server 对客户端公布的地址
+func (c *TURNServerConfig) ICEServer() (ICEServerConfig, error) {
+	var urls []string
+	if len(c.UDPListen) > 0 {
+		port, err := listenPort(c.UDPListen)
+		if err != nil {
+			return ICEServerConfig{}, err
+		}
+		urls = append(urls, fmt.Sprintf("turn:%s:%s?transport=udp", c.Host, port))
+	}
+	if len(c.TCPListen) > 0 {
+		port, err := listenPort(c.TCPListen)
+		if err != nil {
+			return ICEServerConfig{}, err
+		}
+		urls = append(urls, fmt.Sprintf("turn:%s:%s?transport=tcp", c.Host, port))
+	}
+	if len(c.TLSListen) > 0 {
+		port, err := listenPort(c.TLSListen)
+		if err != nil {
+			return ICEServerConfig{}, err
+		}
+		urls = append(urls, fmt.Sprintf("turns:%s:%s?transport=tcp", c.Host, port))
+	}
+	return ICEServerConfig{
+		URLs:          urls,
+		SharedSecret:  c.SharedSecret,
+		CredentialTTL: c.CredentialTTL,
+	}, nil
+}
+
+func (c *TURNServerConfig) relayAddressGenerator() turn.RelayAddressGenerator {
+	if c.RelayMinPort == 0 && c.RelayMaxPort == 0 {
+		return &turn.RelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP(c.PublicIP),
+			Address:      "0.0.0.0",
+		}
+	}
+	return &turn.RelayAddressGeneratorPortRange{
+		RelayAddress: net.ParseIP(c.PublicIP),
+		Address:      "0.0.0.0",
+		MinPort:      c.RelayMinPort,
+		MaxPort:      c.RelayMaxPort,
+	}
+}
+
+// startTURNServer 按配置启动内置 TURN server
+func startTURNServer(c *TURNServerConfig) (*turn.Server, error) {
+	serverConfig := turn.ServerConfig{
+		Realm:       c.Realm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(c.SharedSecret, nil),
+	}
+	if len(serverConfig.Realm) == 0 {
+		serverConfig.Realm = c.Host
+	}
+
+	// 启动失败时关闭已经打开的监听
+	var closers []func() error
+	fail := func(err error) (*turn.Server, error) {
+		for _, closer := range closers {
+			closer()
+		}
+		return nil, err
+	}
+
+	if len(c.UDPListen) > 0 {
+		udpListener, err := net.ListenPacket("udp4", c.UDPListen)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, udpListener.Close)
+		serverConfig.PacketConnConfigs = append(serverConfig.PacketConnConfigs, turn.PacketConnConfig{
+			PacketConn:            udpListener,
+			RelayAddressGenerator: c.relayAddressGenerator(),
+		})
+		logger.Infof("TURN server listen udp %s", c.UDPListen)
+	}
+	if len(c.TCPListen) > 0 {
+		tcpListener, err := net.Listen("tcp4", c.TCPListen)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, tcpListener.Close)
+		serverConfig.ListenerConfigs = append(serverConfig.ListenerConfigs, turn.ListenerConfig{
+			Listener:              tcpListener,
+			RelayAddressGenerator: c.relayAddressGenerator(),
+		})
+		logger.Infof("TURN server listen tcp %s", c.TCPListen)
+	}
+	var turnCerts *certManager
+	if len(c.TLSListen) > 0 {
+		certs, err := newCertManager(c.TLSCert, c.TLSKey, config.TLS.ExpiryWarning)
+		if err != nil {
+			return fail(err)
+		}
+		tlsListener, err := tls.Listen("tcp4", c.TLSListen, &tls.Config{
+			MinVersion:     config.TLSMinVersion(),
+			GetCertificate: certs.GetCertificate,
+		})
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, tlsListener.Close)
+		turnCerts = certs
+		serverConfig.ListenerConfigs = append(serverConfig.ListenerConfigs, turn.ListenerConfig{
+			Listener:              tlsListener,
+			RelayAddressGenerator: c.relayAddressGenerator(),
+		})
+		logger.Infof("TURN server listen tls %s", c.TLSListen)
+	}
+
+	server, err := turn.NewServer(serverConfig)
+	if err != nil {
+		return fail(err)
+	}
+	if turnCerts != nil {
+		go turnCerts.Watch(context.Background(), config.TLS.ReloadInterval)
+	}
+	return server, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+// freeUDPAddr 返回一个当前空闲的本机 UDP 地址
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+// allocateRelay 用 TURN 客户端登录内置 TURN server 并申请中继地址
+func allocateRelay(t *testing.T, serverAddr, realm, username, password string) (net.Addr, error) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: serverAddr,
+		TURNServerAddr: serverAddr,
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          realm,
+		RTO:            50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	relay, err := client.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	defer relay.Close()
+	return relay.LocalAddr(), nil
+}
+
+func TestTURNServerAcceptsRESTCredentials(t *testing.T) {
+	setupTest(t)
+	c := &TURNServerConfig{
+		Enabled:      true,
+		Host:         "turn.example.com",
+		PublicIP:     "127.0.0.1",
+		UDPListen:    freeUDPAddr(t),
+		SharedSecret: "s3cret",
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := startTURNServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	iceServer, err := c.ICEServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "turn:turn.example.com:" + c.UDPListen[strings.LastIndex(c.UDPListen, ":")+1:] + "?transport=udp"; iceServer.URLs[0] != want {
+		t.Fatalf("urls %v, want %s", iceServer.URLs, want)
+	}
+
+	// 下发给浏览器的临时凭证可以申请中继
+	username, password, err := iceServer.credentialsFor("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := allocateRelay(t, c.UDPListen, c.Host, username, password)
+	if err != nil {
+		t.Fatalf("allocate with %s: %v", username, err)
+	}
+	if ip := relay.(*net.UDPAddr).IP; !ip.Equal(net.ParseIP(c.PublicIP)) {
+		t.Fatalf("relay address %v, want %s", relay, c.PublicIP)
+	}
+
+	expired, expiredPassword, err := turn.GenerateLongTermTURNRESTCredentials(c.SharedSecret, "v1", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, username, password string
+	}{
+		{"expired", expired, expiredPassword},
+		{"wrong password", username, "d3JvbmcK"},
+		{"other secret", username, turnPassword("other", username)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 认证失败时 pion/turn 回 400
+			if _, err := allocateRelay(t, c.UDPListen, c.Host, tt.username, tt.password); err == nil || !strings.Contains(err.Error(), "error 400") {
+				t.Fatalf("allocate with %s credentials: %v", tt.name, err)
+			}
+		})
+	}
+}
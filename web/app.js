@@ -1,3 +1,6 @@
+// 服务端启用鉴权时，业务后台签发的 token 通过页面地址的 ?token= 传进来
+const authToken = new URLSearchParams(window.location.search).get('token');
+
 document.getElementById('mute-btn').addEventListener('click', toggleMute);
 document.getElementById('confInfoBtn').addEventListener('click', getConfInfo);
 
@@ -59,18 +62,18 @@ let isMuted = false;
 let isVideoStopped = false;
 let confName;
 let ws;
+// create/join 的 answer 中会下发服务端配置的 ICE server（包括 TURN 临时凭证）
+let iceServers = [{ urls: 'stun:stun.l.google.com:19302' }];
 async function joinSession(confName) {
     document.getElementById('join-screen').style.display = 'none';
     document.getElementById('participant-view').style.display = 'flex';
 
-    peerConnection = new RTCPeerConnection({
-        iceServers: [{ urls: 'stun:stun.l.google.com:19302' }]
-    });
+    peerConnection = new RTCPeerConnection({ iceServers });
 
     localStream = await navigator.mediaDevices.getUserMedia({ video: true, audio: true });
     localStream.getTracks().forEach(track => peerConnection.addTrack(track, localStream));
 
-    ws = new WebSocket(`wss://${window.location.host}/ws`);
+    ws = new WebSocket(`wss://${window.location.host}/ws` + (authToken ? `?token=${encodeURIComponent(authToken)}` : ''));
     ws.onopen = async () => {
         console.log('Connected to the signaling server');
 
@@ -82,14 +85,19 @@ async function joinSession(confName) {
             userId: '123456',
             sdp: btoa(JSON.stringify(offer)),
             cmd: 'join',
-            roomName: confName
+            roomName: confName,
+            trickle: true
         }));
     };
 
-    let iceCandidates = [];
     peerConnection.onicecandidate = (event) => {
+        if (ws.readyState !== WebSocket.OPEN) {
+            return;
+        }
         if (event.candidate) {
-            iceCandidates.push(event.candidate);
+            ws.send(JSON.stringify({ cmd: 'candidate', candidate: event.candidate.toJSON() }));
+        } else {
+            ws.send(JSON.stringify({ cmd: 'endOfCandidates' }));
         }
     };
 
@@ -125,6 +133,50 @@ async function joinSession(confName) {
                 const answerObject = JSON.parse(answerStr);
                 console.log(`Recv answer sdp:\n${answerStr}`);
                 await peerConnection.setRemoteDescription(new RTCSessionDescription(answerObject));
+                if (jsonObject['iceServers']) {
+                    iceServers = jsonObject['iceServers'];
+                    peerConnection.setConfiguration({ ...peerConnection.getConfiguration(), iceServers });
+                }
+                break;
+            case 'offer':
+                // 盲人的轨道到达或变化时服务端重新发起协商
+                const offerObject = JSON.parse(atob(jsonObject['offer']));
+                await peerConnection.setRemoteDescription(new RTCSessionDescription(offerObject));
+                const answer = await peerConnection.createAnswer();
+                await peerConnection.setLocalDescription(answer);
+                ws.send(JSON.stringify({
+                    cmd: 'answer',
+                    sdp: btoa(JSON.stringify(answer))
+                }));
+                break;
+            case 'candidate':
+                await peerConnection.addIceCandidate(jsonObject['candidate']);
+                break;
+            case 'endOfCandidates':
+                await peerConnection.addIceCandidate();
+                break;
+            case 'roomClosed':
+                console.log(`room ${jsonObject['roomName']} closed: ${jsonObject['reason']}`);
+                peerConnection.close();
+                document.getElementById('remoteVideos').innerHTML = '';
+                document.getElementById('participant-view').style.display = 'none';
+                document.getElementById('join-screen').style.display = 'block';
+                getConfInfo();
+                break;
+            case 'serverShutdown':
+                console.log('server is shutting down');
+                break;
+            case 'roles':
+                // 只有 guide 能对盲人说话和发控制指令
+                console.log(`room ${jsonObject['roomName']} guide: ${jsonObject['guide'] || 'none'}, roles: ${JSON.stringify(jsonObject['roles'])}`);
+                break;
+            case 'promptQueued':
+            case 'promptStarted':
+            case 'promptFinished':
+                console.log(`${jsonObject['type']} ${jsonObject['promptId']} (#${jsonObject['playId']})${jsonObject['reason'] ? ', ' + jsonObject['reason'] : ''}`);
+                break;
+            case 'error':
+                console.error(`${jsonObject['cmd']} failed, ${jsonObject['code']}: ${jsonObject['reason']}`);
                 break;
             default:
                 break;
@@ -136,7 +188,8 @@ async function joinSession(confName) {
 
 async function getConfInfo() {
     try {
-        const response = await fetch(`https://${window.location.host}/api/confInfo`);
+        const headers = authToken ? { Authorization: `Bearer ${authToken}` } : {};
+        const response = await fetch(`https://${window.location.host}/api/confInfo`, { headers });
         if (!response.ok) {
             throw new Error('Network response was not ok ' + response.statusText);
         }
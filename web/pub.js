@@ -16,6 +16,13 @@ let mediaStreamDestination = audioContext.createMediaStreamDestination(); // 创
 
 // 保存会议名称
 let confName;
+let ws;
+// create 成功后服务端下发，断线重连时凭它接管原来的房间
+let resumeToken = null;
+// create/join 的 answer 中会下发服务端配置的 ICE server（包括 TURN 临时凭证）
+let iceServers = [{ urls: 'stun:stun.l.google.com:19302' }];
+// 服务端启用鉴权时，业务后台签发的 token 通过页面地址的 ?token= 传进来
+const authToken = new URLSearchParams(window.location.search).get('token');
 
 
 function gotDevices(deviceInfos) {
@@ -141,9 +148,7 @@ async function joinSession() {
     document.getElementById('join-screen').style.display = 'none';
     document.getElementById('participant-view').style.display = 'block';
 
-    peerConnection = new RTCPeerConnection({
-        iceServers: [{ urls: 'stun:stun.l.google.com:19302' }]
-    });
+    peerConnection = new RTCPeerConnection({ iceServers });
 
     // 将音频流连接到目标音频流
     localStream.getAudioTracks().forEach(track => {
@@ -158,7 +163,10 @@ async function joinSession() {
         peerConnection.addTrack(track, localStream);
     });
 
-    const ws = new WebSocket(`wss://${window.location.host}/ws`);
+    if (ws) {
+        ws.close();
+    }
+    ws = new WebSocket(`wss://${window.location.host}/ws` + (authToken ? `?token=${encodeURIComponent(authToken)}` : ''));
     ws.onopen = async () => {
         console.log('Connected to the signaling server');
 
@@ -169,14 +177,23 @@ async function joinSession() {
         ws.send(JSON.stringify({
             userId: '123456',
             sdp: btoa(JSON.stringify(offer)),
-            cmd: 'create',
-            roomName: confName
+            cmd: resumeToken ? 'resume' : 'create',
+            resumeToken: resumeToken,
+            roomName: confName,
+            trickle: true,
+            // 提示音按浏览器的语言播放，服务端没有这种语言的提示音时用默认语言
+            language: navigator.language
         }));
     };
 
     peerConnection.onicecandidate = (event) => {
+        if (ws.readyState !== WebSocket.OPEN) {
+            return;
+        }
         if (event.candidate) {
-            // handle candidate
+            ws.send(JSON.stringify({ cmd: 'candidate', candidate: event.candidate.toJSON() }));
+        } else {
+            ws.send(JSON.stringify({ cmd: 'endOfCandidates' }));
         }
     };
 
@@ -213,8 +230,12 @@ async function joinSession() {
                 break;
             case 'disconnected':
                 message = '已断开连接。';
-                // 重新加入会话
-                rejoinSession();
+                // 移动网络经常短暂断开，等一会儿还没恢复再重连
+                setTimeout(() => {
+                    if (peerConnection && peerConnection.iceConnectionState === 'disconnected') {
+                        rejoinSession();
+                    }
+                }, 3000);
                 break;
             case 'closed':
                 message = '连接已关闭。';
@@ -246,6 +267,41 @@ async function joinSession() {
                 const answerObject = JSON.parse(answerStr);
                 console.log(`Recv answer sdp:\n${answerStr}`);
                 await peerConnection.setRemoteDescription(new RTCSessionDescription(answerObject));
+                if (jsonObject['iceServers']) {
+                    iceServers = jsonObject['iceServers'];
+                    peerConnection.setConfiguration({ ...peerConnection.getConfiguration(), iceServers });
+                }
+                if (jsonObject['resumeToken']) {
+                    resumeToken = jsonObject['resumeToken'];
+                }
+                if (jsonObject['roomName']) {
+                    // 没有填房间名时由服务端生成
+                    confName = jsonObject['roomName'];
+                }
+                if (jsonObject['joinCode']) {
+                    displayMessage(`加入码：${jsonObject['joinCode']}`);
+                }
+                break;
+            case 'candidate':
+                await peerConnection.addIceCandidate(jsonObject['candidate']);
+                break;
+            case 'endOfCandidates':
+                await peerConnection.addIceCandidate();
+                break;
+            case 'serverShutdown':
+                displayMessage('服务器正在重启，请稍后重新连接。', true);
+                break;
+            case 'roomClosed':
+                // 房间已经不存在，之后重连要重新创建
+                resumeToken = null;
+                break;
+            case 'error':
+                showError(`${jsonObject['code']}: ${jsonObject['reason']}`);
+                if (jsonObject['cmd'] === 'resume') {
+                    // 房间已经超时关闭，重新创建
+                    resumeToken = null;
+                    rejoinSession();
+                }
                 break;
             default:
                 break;
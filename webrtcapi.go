@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"yanglei_blinder/logger"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/intervalpli"
+	"github.com/pion/webrtc/v4"
+)
+
+// webrtcAPI 由盲人和志愿者的 PeerConnection 共用，启用端口复用时所有连接共享同一个 ICE 端口
+var webrtcAPI *webrtc.API
+
+// newWebRTCAPI 按 ICE 配置创建共用的 webrtc.API
+func newWebRTCAPI(c *ICEConfig) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	i.Add(intervalPliFactory)
+
+	s := webrtc.SettingEngine{}
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+	if c.UDPMuxPort > 0 {
+		udpListener, err := net.ListenUDP("udp4", &net.UDPAddr{Port: c.UDPMuxPort})
+		if err != nil {
+			return nil, fmt.Errorf("listen ICE udp mux: %w", err)
+		}
+		s.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
+		networkTypes = []webrtc.NetworkType{webrtc.NetworkTypeUDP4}
+		logger.Infof("ICE udp mux listen :%d", c.UDPMuxPort)
+	}
+	if c.TCPMuxPort > 0 {
+		tcpListener, err := net.ListenTCP("tcp4", &net.TCPAddr{Port: c.TCPMuxPort})
+		if err != nil {
+			return nil, fmt.Errorf("listen ICE tcp mux: %w", err)
+		}
+		s.SetICETCPMux(webrtc.NewICETCPMux(nil, tcpListener, 8))
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4)
+		logger.Infof("ICE tcp mux listen :%d", c.TCPMuxPort)
+	}
+	s.SetNetworkTypes(networkTypes)
+	if len(c.NAT1To1IPs) > 0 {
+		// 云主机上本机地址是内网 IP，host candidate 改成公网 IP
+		s.SetNAT1To1IPs(c.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s)), nil
+}